@@ -0,0 +1,163 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+const (
+	// StatusComplete is a '<timestamp>.dmp' backup with checksums.txt
+	StatusComplete = "complete"
+	// StatusIncomplete is a '<timestamp>.dmp' backup without checksums.txt (i.e. an interrupted upload)
+	StatusIncomplete = "incomplete"
+	// StatusStage is a '<timestamp>.dirty' dir of a running, failed or crashed dump
+	StatusStage = "stage"
+)
+
+const timestampLayout = "20060102150405"
+
+type CatalogContext struct {
+	// Location is a dir with backups (list, prune), or a backup dir (inspect): a local path, or s3://bucket/prefix
+	Location       string
+	StorageOptions storage.Options
+	Policy         Policy
+	// DryRun reports what prune would remove, without removing anything
+	DryRun bool
+}
+
+type Backup struct {
+	Name          string    `json:"name"`
+	Key           string    `json:"-"`
+	Timestamp     string    `json:"timestamp"`
+	Time          time.Time `json:"time"`
+	Status        string    `json:"status"`
+	SizeBytes     int64     `json:"size_bytes"`
+	Databases     int       `json:"databases"`
+	SourceVersion string    `json:"source_version,omitempty"`
+	Encrypted     bool      `json:"encrypted"`
+}
+
+// RunList returns backups and stages found in the location, newest first.
+func RunList(ctx context.Context, catalogContext *CatalogContext) ([]*Backup, error) {
+	st, prefix, err := storage.Open(catalogContext.Location, &catalogContext.StorageOptions)
+	if err != nil {
+		return nil, err
+	}
+	return listBackups(ctx, st, prefix)
+}
+
+func listBackups(ctx context.Context, st storage.Storage, prefix string) ([]*Backup, error) {
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := map[string]*Backup{}
+	hasManifest := map[string]bool{}
+	dumps := map[string]map[string]bool{}
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(strings.TrimPrefix(obj.Key, prefix), "/")
+		name, rest, ok := strings.Cut(rel, "/")
+		if !ok {
+			continue
+		}
+		b, ok := backups[name]
+		if !ok {
+			b, ok = parseName(name)
+			if !ok {
+				// not a backup, leave it alone
+				continue
+			}
+			b.Key = storage.Join(prefix, name)
+			backups[name] = b
+			dumps[name] = map[string]bool{}
+		}
+		b.SizeBytes += obj.Size
+		switch rest {
+		case xutil.ChecksumsFileName:
+			if b.Status == StatusIncomplete {
+				b.Status = StatusComplete
+			}
+		case manifest.FileName:
+			hasManifest[name] = true
+		}
+		if dir, _, ok := strings.Cut(rest, "/"); ok && strings.HasSuffix(dir, ".dmp") {
+			dumps[name][dir] = true
+		}
+	}
+
+	result := make([]*Backup, 0, len(backups))
+	for name, b := range backups {
+		b.Databases = len(dumps[name])
+		if hasManifest[name] && b.Status != StatusStage {
+			m, err := readManifest(ctx, st, b.Key)
+			if err != nil {
+				slog.Warn("list", slog.String("backup", name), slog.String("err-manifest", err.Error()))
+			} else {
+				b.SourceVersion = m.Source.ServerVersion
+				b.Encrypted = m.Encryption != nil
+			}
+		}
+		result = append(result, b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Timestamp > result[j].Timestamp
+	})
+	return result, nil
+}
+
+// parseName recognizes '<timestamp>.dmp' and '<timestamp>.dirty' dirs
+func parseName(name string) (*Backup, bool) {
+	status := StatusIncomplete
+	timestamp, ok := strings.CutSuffix(name, ".dmp")
+	if !ok {
+		status = StatusStage
+		timestamp, ok = strings.CutSuffix(name, ".dirty")
+	}
+	if !ok {
+		return nil, false
+	}
+	t, err := time.ParseInLocation(timestampLayout, timestamp, time.Local)
+	if err != nil {
+		return nil, false
+	}
+	return &Backup{Name: name, Timestamp: timestamp, Time: t, Status: status}, true
+}
+
+func readManifest(ctx context.Context, st storage.Storage, backupKey string) (*manifest.Manifest, error) {
+	data, err := readObject(ctx, st, storage.Join(backupKey, manifest.FileName))
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Parse(data)
+}
+
+func readObject(ctx context.Context, st storage.Storage, key string) ([]byte, error) {
+	r, err := st.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// PrintList renders backups as a human-readable table.
+func PrintList(w io.Writer, backups []*Backup) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIMESTAMP\tSTATUS\tSIZE\tDATABASES\tSOURCE-VERSION\tENCRYPTED")
+	for _, b := range backups {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%t\n",
+			b.Timestamp, b.Status, xutil.ByteCountIEC(b.SizeBytes), b.Databases, b.SourceVersion, b.Encrypted)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,68 @@
+package catalog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestListAndInspect(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+
+	complete := filepath.Join(outputDir, "20250328154501.dmp")
+	writeFile(t, filepath.Join(complete, "d1.dmp", "data", "toc.dat"), "toc")
+	writeFile(t, filepath.Join(complete, "d1.dmp", "dump.log"), `pg_dump: dumping contents of table "public.t1"
+pg_dump: dumping contents of table "public.t2"
+pg_dump: warning: there are circular foreign-key constraints
+`)
+	writeFile(t, filepath.Join(complete, "d2.dmp", "data", "toc.dat.age"), "ciphertext")
+	writeFile(t, filepath.Join(complete, "d2.dmp", "dump.log.age"), "ciphertext")
+	writeFile(t, filepath.Join(complete, xutil.ChecksumsFileName), "")
+	require.NoError(t, manifest.Write(complete, &manifest.Manifest{
+		FormatVersion: manifest.FormatVersion,
+		Timestamp:     "20250328154501",
+		Source:        manifest.Source{ServerVersion: "17.4"},
+		Selection:     &xutil.Selection{},
+		Databases:     []*manifest.Database{{DatName: "d1", SizeBytes: 1024, Jobs: 2}},
+	}))
+
+	writeFile(t, filepath.Join(outputDir, "20250329154501.dirty", "d1.dirty", "data", "toc.dat"), "toc")
+	writeFile(t, filepath.Join(outputDir, "20250327154501.dmp", "d1.dmp", "data", "toc.dat"), "toc")
+	writeFile(t, filepath.Join(outputDir, "not-a-backup", "file"), "data")
+
+	backups, err := RunList(ctx, &CatalogContext{Location: outputDir})
+	require.NoError(t, err)
+	require.Len(t, backups, 3)
+	assert.Equal(t, "20250329154501", backups[0].Timestamp)
+	assert.Equal(t, StatusStage, backups[0].Status)
+	assert.Equal(t, StatusComplete, backups[1].Status)
+	assert.Equal(t, 2, backups[1].Databases)
+	assert.Equal(t, "17.4", backups[1].SourceVersion)
+	assert.Equal(t, StatusIncomplete, backups[2].Status)
+
+	ins, err := RunInspect(ctx, &CatalogContext{Location: complete})
+	require.NoError(t, err)
+	assert.True(t, ins.Complete)
+	require.Len(t, ins.Databases, 2)
+	assert.Equal(t, "d1", ins.Databases[0].DatName)
+	assert.Equal(t, 2, ins.Databases[0].Jobs)
+	assert.Equal(t, 2, ins.Databases[0].Tables)
+	assert.Equal(t, 1, ins.Databases[0].Warnings)
+	assert.Equal(t, "encrypted", ins.Databases[1].LogStatus)
+
+	_, err = RunInspect(ctx, &CatalogContext{Location: filepath.Join(outputDir, "missing.dmp")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,162 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+const dumpLogFileName = "dump.log"
+
+type Inspection struct {
+	Location string `json:"location"`
+	Complete bool   `json:"complete"`
+	// Manifest is nil for backups made by older versions
+	Manifest  *manifest.Manifest `json:"manifest,omitempty"`
+	Databases []*DatabaseInfo    `json:"databases"`
+}
+
+type DatabaseInfo struct {
+	DatName         string  `json:"datname"`
+	SizeBytes       int64   `json:"size_bytes"`
+	DumpSizeBytes   int64   `json:"dump_size_bytes"`
+	Jobs            int     `json:"jobs"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// LogStatus is 'ok', 'encrypted' or 'missing', Tables and Warnings are counted from dump.log if it's readable
+	LogStatus string `json:"log_status"`
+	Tables    int    `json:"tables"`
+	Warnings  int    `json:"warnings"`
+}
+
+// RunInspect collects per-database details of a single backup.
+func RunInspect(ctx context.Context, catalogContext *CatalogContext) (*Inspection, error) {
+	st, prefix, err := storage.Open(catalogContext.Location, &catalogContext.StorageOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("backup not found: %s", catalogContext.Location)
+	}
+	keys := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keys[obj.Key] = true
+	}
+
+	ins := &Inspection{
+		Location:  catalogContext.Location,
+		Complete:  keys[storage.Join(prefix, xutil.ChecksumsFileName)],
+		Databases: []*DatabaseInfo{},
+	}
+	if keys[storage.Join(prefix, manifest.FileName)] {
+		ins.Manifest, err = readManifest(ctx, st, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var dumps []*xutil.DBInfo
+	if st.IsLocal() {
+		dumps, err = xutil.GetDumpsInDir(catalogContext.Location)
+	} else {
+		dumps, err = xutil.GetDumpsInStorage(ctx, st, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dump := range dumps {
+		db := &DatabaseInfo{
+			DatName:       xutil.DumpDirDBName(dump.DatName),
+			DumpSizeBytes: dump.SizeBytes,
+		}
+		if ins.Manifest != nil {
+			for _, mdb := range ins.Manifest.Databases {
+				if mdb.DatName == db.DatName {
+					db.SizeBytes = mdb.SizeBytes
+					db.Jobs = mdb.Jobs
+					db.DurationSeconds = mdb.DurationSeconds
+				}
+			}
+		}
+
+		logKey := storage.Join(prefix, filepath.Base(dump.DatName), dumpLogFileName)
+		switch {
+		case keys[logKey]:
+			data, err := readObject(ctx, st, logKey)
+			if err != nil {
+				return nil, err
+			}
+			db.LogStatus = "ok"
+			db.Tables, db.Warnings = parseDumpLog(data)
+		case keys[logKey+crypt.Suffix]:
+			db.LogStatus = "encrypted"
+		default:
+			db.LogStatus = "missing"
+		}
+		ins.Databases = append(ins.Databases, db)
+	}
+	return ins, nil
+}
+
+// parseDumpLog counts dumped tables and warnings in pg_dump verbose output
+func parseDumpLog(data []byte) (tables, warnings int) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "dumping contents of table") {
+			tables++
+		}
+		if strings.Contains(strings.ToLower(line), "warning:") {
+			warnings++
+		}
+	}
+	return tables, warnings
+}
+
+// PrintInspection renders the backup summary and a per-database table.
+func PrintInspection(w io.Writer, ins *Inspection) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Location:\t%s\n", ins.Location)
+	fmt.Fprintf(tw, "Complete:\t%t\n", ins.Complete)
+	if m := ins.Manifest; m != nil {
+		fmt.Fprintf(tw, "Timestamp:\t%s\n", m.Timestamp)
+		fmt.Fprintf(tw, "Source:\t%s:%d, %s\n", m.Source.Host, m.Source.Port, m.Source.ServerVersion)
+		fmt.Fprintf(tw, "Client:\t%s\n", m.Client.PgDumpVersion)
+		fmt.Fprintf(tw, "Duration:\t%.0fs\n", m.DurationSeconds)
+		fmt.Fprintf(tw, "Encrypted:\t%t\n", m.Encryption != nil)
+		fmt.Fprintf(tw, "Skipped:\t%s\n", strings.Join(m.Selection.Skipped, ", "))
+	} else {
+		fmt.Fprintf(tw, "Manifest:\tnot found\n")
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "DATABASE\tSIZE\tDUMP-SIZE\tJOBS\tDURATION\tTABLES\tWARNINGS\tLOG")
+	for _, db := range ins.Databases {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.0fs\t%d\t%d\t%s\n",
+			db.DatName,
+			xutil.ByteCountIEC(db.SizeBytes),
+			xutil.ByteCountIEC(db.DumpSizeBytes),
+			db.Jobs,
+			db.DurationSeconds,
+			db.Tables,
+			db.Warnings,
+			db.LogStatus,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,171 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// Policy is a set of retention rules.
+// Keep-rules are combined: a complete backup is kept if any of them selects it (all are kept if none is set).
+// MaxAge and MaxTotalSize then remove kept backups, but the newest complete backup is never removed.
+type Policy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	MaxAge      time.Duration
+	// MaxTotalSize limits the size of kept complete backups, older ones are removed once it's exceeded
+	MaxTotalSize int64
+	// StaleAfter is the age of stages and incomplete backups to be removed (0 - never, the default:
+	// a stage of a running dump cannot be told from an abandoned one)
+	StaleAfter time.Duration
+}
+
+type PruneResult struct {
+	Kept    []*Backup `json:"kept"`
+	Removed []*Backup `json:"removed"`
+	DryRun  bool      `json:"dry_run"`
+}
+
+// RunPrune applies the retention policy to backups in the location.
+func RunPrune(ctx context.Context, catalogContext *CatalogContext) (*PruneResult, error) {
+	st, prefix, err := storage.Open(catalogContext.Location, &catalogContext.StorageOptions)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := listBackups(ctx, st, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	kept, removed := catalogContext.Policy.Apply(backups, time.Now())
+	result := &PruneResult{Kept: kept, Removed: removed, DryRun: catalogContext.DryRun}
+
+	for _, b := range removed {
+		if catalogContext.DryRun {
+			slog.Info("prune", slog.String("status", "would-remove"), slog.String("backup", b.Name))
+			continue
+		}
+		if err := st.Remove(ctx, b.Key); err != nil {
+			return result, fmt.Errorf("cannot remove %s: %w", b.Name, err)
+		}
+		slog.Info("prune", slog.String("status", "removed"), slog.String("backup", b.Name))
+	}
+	return result, nil
+}
+
+func (p *Policy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// Apply splits backups into kept and removed ones, both are ordered newest first.
+func (p *Policy) Apply(backups []*Backup, now time.Time) (kept, removed []*Backup) {
+	var complete []*Backup
+	for _, b := range backups {
+		if b.Status == StatusComplete {
+			complete = append(complete, b)
+			continue
+		}
+		if p.StaleAfter > 0 && now.Sub(b.Time) > p.StaleAfter {
+			removed = append(removed, b)
+		} else {
+			kept = append(kept, b)
+		}
+	}
+
+	sortNewestFirst(complete)
+
+	selected := map[*Backup]bool{}
+	if p.hasKeepRules() {
+		keepBuckets(selected, complete, p.KeepLast, func(t time.Time) string {
+			return t.Format(timestampLayout)
+		})
+		keepBuckets(selected, complete, p.KeepDaily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+		keepBuckets(selected, complete, p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		})
+		keepBuckets(selected, complete, p.KeepMonthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+	} else {
+		for _, b := range complete {
+			selected[b] = true
+		}
+	}
+
+	var total int64
+	exceeded := false
+	for i, b := range complete {
+		keep := selected[b]
+		if keep && p.MaxAge > 0 && now.Sub(b.Time) > p.MaxAge {
+			keep = false
+		}
+		if keep && p.MaxTotalSize > 0 && (exceeded || total+b.SizeBytes > p.MaxTotalSize) {
+			exceeded = true
+			keep = false
+		}
+		// never leave the location without a usable backup
+		if i == 0 {
+			keep = true
+		}
+		if keep {
+			total += b.SizeBytes
+			kept = append(kept, b)
+		} else {
+			removed = append(removed, b)
+		}
+	}
+	sortNewestFirst(kept)
+	sortNewestFirst(removed)
+	return kept, removed
+}
+
+// keepBuckets selects the newest backup of each of the n newest time buckets (days, weeks, etc...)
+func keepBuckets(selected map[*Backup]bool, complete []*Backup, n int, bucket func(t time.Time) string) {
+	seen := map[string]bool{}
+	for _, b := range complete {
+		if len(seen) >= n {
+			return
+		}
+		key := bucket(b.Time)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		selected[b] = true
+	}
+}
+
+func sortNewestFirst(backups []*Backup) {
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Timestamp > backups[j].Timestamp
+	})
+}
+
+// PrintPruneResult renders kept and removed backups as a human-readable table.
+func PrintPruneResult(w io.Writer, result *PruneResult) error {
+	removeAction := "remove"
+	if result.DryRun {
+		removeAction = "would-remove"
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tTIMESTAMP\tSTATUS\tSIZE")
+	for _, b := range result.Kept {
+		fmt.Fprintf(tw, "keep\t%s\t%s\t%s\n", b.Timestamp, b.Status, xutil.ByteCountIEC(b.SizeBytes))
+	}
+	for _, b := range result.Removed {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", removeAction, b.Timestamp, b.Status, xutil.ByteCountIEC(b.SizeBytes))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,86 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func backupAt(t *testing.T, ts, status string, size int64) *Backup {
+	t.Helper()
+	b, ok := parseName(ts + ".dmp")
+	require.True(t, ok)
+	b.Status = status
+	b.SizeBytes = size
+	return b
+}
+
+func names(backups []*Backup) []string {
+	result := []string{}
+	for _, b := range backups {
+		result = append(result, b.Timestamp)
+	}
+	return result
+}
+
+func TestPolicyApply(t *testing.T) {
+	now, err := time.ParseInLocation(timestampLayout, "20250401120000", time.Local)
+	require.NoError(t, err)
+
+	backups := []*Backup{
+		backupAt(t, "20250401100000", StatusComplete, 10),
+		backupAt(t, "20250401020000", StatusComplete, 10),
+		backupAt(t, "20250331020000", StatusComplete, 10),
+		backupAt(t, "20250320020000", StatusComplete, 10),
+		backupAt(t, "20250215020000", StatusComplete, 10),
+		backupAt(t, "20250401110000", StatusStage, 5),
+		backupAt(t, "20250330110000", StatusIncomplete, 5),
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		kept    []string
+		removed []string
+	}{
+		{
+			name:    "keep-last",
+			policy:  Policy{KeepLast: 2},
+			kept:    []string{"20250401110000", "20250401100000", "20250401020000", "20250330110000"},
+			removed: []string{"20250331020000", "20250320020000", "20250215020000"},
+		},
+		{
+			name:    "keep-daily and keep-monthly",
+			policy:  Policy{KeepDaily: 2, KeepMonthly: 3, StaleAfter: 24 * time.Hour},
+			kept:    []string{"20250401110000", "20250401100000", "20250331020000", "20250215020000"},
+			removed: []string{"20250401020000", "20250330110000", "20250320020000"},
+		},
+		{
+			name:    "max-age",
+			policy:  Policy{MaxAge: 7 * 24 * time.Hour},
+			kept:    []string{"20250401110000", "20250401100000", "20250401020000", "20250331020000", "20250330110000"},
+			removed: []string{"20250320020000", "20250215020000"},
+		},
+		{
+			name:    "max-total-size",
+			policy:  Policy{MaxTotalSize: 25},
+			kept:    []string{"20250401110000", "20250401100000", "20250401020000", "20250330110000"},
+			removed: []string{"20250331020000", "20250320020000", "20250215020000"},
+		},
+		{
+			name:    "the newest complete backup is never removed",
+			policy:  Policy{MaxAge: time.Minute},
+			kept:    []string{"20250401110000", "20250401100000", "20250330110000"},
+			removed: []string{"20250401020000", "20250331020000", "20250320020000", "20250215020000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, removed := tt.policy.Apply(backups, now)
+			assert.Equal(t, tt.kept, names(kept))
+			assert.Equal(t, tt.removed, names(removed))
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package compare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// ClusterLevel is a pseudo database name, used for cluster-wide objects (roles, etc...) in a report.
+const ClusterLevel = "<cluster>"
+
+// Row counts of tables are compared either by planner estimates (pg_class.reltuples, cheap, within
+// estimateTolerance), or exactly (count(*) of every table, reads all the data of both clusters).
+const (
+	RowCountsNone     = "none"
+	RowCountsEstimate = "estimate"
+	RowCountsExact    = "exact"
+
+	estimateTolerance = 0.1
+)
+
+type CompareContext struct {
+	SourceConnStr string
+	TargetConnStr string
+	ParallelDBS   int
+	Filter        xutil.DBFilter
+	// Databases, when set, is the exact list of databases to compare, the Filter is ignored
+	Databases []string
+	// TargetNames maps source databases to their names in the target, when they're restored under new names
+	TargetNames map[string]string
+	// RowCounts is one of RowCountsNone, RowCountsEstimate (the default of --row-counts), RowCountsExact;
+	// empty is the same as RowCountsNone: row counts are not compared
+	RowCounts string
+	// RoleMapping and SkipRoles are the restore's --role-map and --skip-role: role memberships of the source
+	// are compared under target role names, memberships of skipped roles are not compared
+	RoleMapping map[string]string
+	SkipRoles   []string
+	// ExistingTarget is a target cluster that had roles of its own before the restore:
+	// only memberships of the source are checked in it, extra ones of the target are not differences
+	ExistingTarget bool
+	// SkipMemberships disables the comparison of role memberships (i.e. globals were not restored)
+	SkipMemberships bool
+	// ReportPath is a file to save JSON report to (optional)
+	ReportPath string
+}
+
+type Report struct {
+	Passed    bool              `json:"passed"`
+	Databases []*DatabaseReport `json:"databases"`
+}
+
+type DatabaseReport struct {
+	DatName     string        `json:"datname"`
+	Passed      bool          `json:"passed"`
+	Error       string        `json:"error,omitempty"`
+	Differences []*Difference `json:"differences,omitempty"`
+}
+
+type Difference struct {
+	Category string `json:"category"`
+	Object   string `json:"object"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+}
+
+const (
+	missing = "<missing>"
+	present = "<present>"
+)
+
+// RunCompare compares object inventories of the source and the target clusters, database by database.
+// An error is returned if any database does not match.
+func RunCompare(ctx context.Context, compareContext *CompareContext) (*Report, error) {
+	if err := compareContext.Filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateRowCounts(compareContext.RowCounts); err != nil {
+		return nil, err
+	}
+
+	databases, err := selectDatabases(ctx, compareContext)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Passed: true}
+
+	// cluster-wide objects first
+	report.Databases = append(report.Databases, compareCluster(ctx, compareContext, databases))
+
+	workerCount := max(compareContext.ParallelDBS, 1)
+	dbChan := make(chan string, len(databases))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dbname := range dbChan {
+				dbReport := compareDatabase(ctx, compareContext, dbname)
+				mu.Lock()
+				report.Databases = append(report.Databases, dbReport)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, dbname := range databases {
+		dbChan <- dbname
+	}
+	close(dbChan)
+	wg.Wait()
+
+	sort.SliceStable(report.Databases[1:], func(i, j int) bool {
+		return report.Databases[i+1].DatName < report.Databases[j+1].DatName
+	})
+	for _, dbReport := range report.Databases {
+		if !dbReport.Passed {
+			report.Passed = false
+		}
+		slog.Info("compare",
+			slog.String("dbname", dbReport.DatName),
+			slog.Bool("passed", dbReport.Passed),
+			slog.Int("differences", len(dbReport.Differences)),
+		)
+	}
+
+	if compareContext.ReportPath != "" {
+		if err := writeReport(compareContext.ReportPath, report); err != nil {
+			return report, err
+		}
+	}
+	if !report.Passed {
+		return report, fmt.Errorf("source and target clusters do not match")
+	}
+	return report, nil
+}
+
+// ValidateRowCounts checks the row counts mode
+func ValidateRowCounts(mode string) error {
+	switch mode {
+	case "", RowCountsNone, RowCountsEstimate, RowCountsExact:
+		return nil
+	}
+	return fmt.Errorf("invalid row counts mode: %s (expected: %s, %s, %s)", mode, RowCountsNone, RowCountsEstimate, RowCountsExact)
+}
+
+func selectDatabases(ctx context.Context, compareContext *CompareContext) ([]string, error) {
+	if len(compareContext.Databases) > 0 {
+		return compareContext.Databases, nil
+	}
+	sourceDatabases, err := xutil.GetDatabases(ctx, compareContext.SourceConnStr)
+	if err != nil {
+		return nil, err
+	}
+	selected, _ := compareContext.Filter.Split(sourceDatabases)
+	databases := make([]string, 0, len(selected))
+	for _, db := range selected {
+		databases = append(databases, db.DatName)
+	}
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("no databases matched the filter")
+	}
+	return databases, nil
+}
+
+// compareCluster checks that every database exists in the target, and compares cluster-wide objects.
+func compareCluster(ctx context.Context, compareContext *CompareContext, databases []string) *DatabaseReport {
+	dbReport := &DatabaseReport{DatName: ClusterLevel}
+
+	targetDatabases, err := xutil.GetDatabases(ctx, compareContext.TargetConnStr)
+	if err != nil {
+		dbReport.Error = err.Error()
+		return dbReport
+	}
+	existing := map[string]bool{}
+	for _, db := range targetDatabases {
+		existing[db.DatName] = true
+	}
+	// extra target databases are out of scope, only the selected ones are expected (under their target names)
+	sourceNames := map[string]string{}
+	targetNames := map[string]string{}
+	for _, dbname := range databases {
+		sourceNames[dbname] = present
+		if existing[compareContext.targetName(dbname)] {
+			targetNames[dbname] = present
+		} else {
+			targetNames[dbname] = missing
+		}
+	}
+	dbReport.Differences = diffObjects("databases", sourceNames, targetNames)
+
+	source, err := getClusterInventory(ctx, compareContext.SourceConnStr)
+	if err != nil {
+		dbReport.Error = err.Error()
+		return dbReport
+	}
+	target, err := getClusterInventory(ctx, compareContext.TargetConnStr)
+	if err != nil {
+		dbReport.Error = err.Error()
+		return dbReport
+	}
+	source[categoryMemberships], target[categoryMemberships] = compareContext.mapMemberships(
+		source[categoryMemberships], target[categoryMemberships])
+	if compareContext.SkipMemberships {
+		delete(source, categoryMemberships)
+		delete(target, categoryMemberships)
+	}
+	dbReport.Differences = append(dbReport.Differences, diffInventories(source, target)...)
+	dbReport.Passed = len(dbReport.Differences) == 0
+	return dbReport
+}
+
+// mapMemberships applies the role mapping and skipped roles to memberships the way restore applies them to globals.sql.
+// Target roles of the mapping belong to the target environment: their memberships the source has no match for
+// are not compared, neither are ones of an ExistingTarget.
+func (compareContext *CompareContext) mapMemberships(source, target map[string]string) (mappedSource, mappedTarget map[string]string) {
+	if len(compareContext.RoleMapping) == 0 && len(compareContext.SkipRoles) == 0 && !compareContext.ExistingTarget {
+		return source, target
+	}
+	skipped := make(map[string]bool, len(compareContext.SkipRoles))
+	for _, role := range compareContext.SkipRoles {
+		skipped[role] = true
+	}
+	targetRoles := make(map[string]bool, len(compareContext.RoleMapping))
+	for _, to := range compareContext.RoleMapping {
+		targetRoles[to] = true
+	}
+
+	mappedSource = make(map[string]string, len(source))
+	for key, value := range source {
+		member, group, ok := strings.Cut(key, membershipSeparator)
+		if !ok {
+			mappedSource[key] = value
+			continue
+		}
+		if skipped[member] || skipped[group] {
+			continue
+		}
+		mappedSource[compareContext.mapRole(member)+membershipSeparator+compareContext.mapRole(group)] = value
+	}
+
+	mappedTarget = make(map[string]string, len(target))
+	for key, value := range target {
+		_, inSource := mappedSource[key]
+		if !inSource && compareContext.ExistingTarget {
+			continue
+		}
+		if member, group, ok := strings.Cut(key, membershipSeparator); ok {
+			if skipped[member] || skipped[group] {
+				continue
+			}
+			if !inSource && (targetRoles[member] || targetRoles[group]) {
+				continue
+			}
+		}
+		mappedTarget[key] = value
+	}
+	return mappedSource, mappedTarget
+}
+
+// mapRole is the name of the source role in the target
+func (compareContext *CompareContext) mapRole(role string) string {
+	if to, ok := compareContext.RoleMapping[role]; ok {
+		return to
+	}
+	return role
+}
+
+// targetName is the name of the source database in the target
+func (compareContext *CompareContext) targetName(dbname string) string {
+	if target, ok := compareContext.TargetNames[dbname]; ok {
+		return target
+	}
+	return dbname
+}
+
+func compareDatabase(ctx context.Context, compareContext *CompareContext, dbname string) *DatabaseReport {
+	dbReport := &DatabaseReport{DatName: dbname}
+
+	source, err := getDatabaseInventory(ctx, compareContext.SourceConnStr, dbname, compareContext.RowCounts)
+	if err != nil {
+		dbReport.Error = fmt.Sprintf("source: %v", err)
+		return dbReport
+	}
+	target, err := getDatabaseInventory(ctx, compareContext.TargetConnStr, compareContext.targetName(dbname), compareContext.RowCounts)
+	if err != nil {
+		dbReport.Error = fmt.Sprintf("target: %v", err)
+		return dbReport
+	}
+
+	dbReport.Differences = diffInventories(source, target)
+	dbReport.Passed = len(dbReport.Differences) == 0
+	return dbReport
+}
+
+func diffInventories(source, target inventory) []*Difference {
+	categories := make([]string, 0, len(source))
+	for category := range source {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	var result []*Difference
+	for _, category := range categories {
+		result = append(result, diffObjects(category, source[category], target[category])...)
+	}
+	return result
+}
+
+func diffObjects(category string, source, target map[string]string) []*Difference {
+	keys := map[string]bool{}
+	for k := range source {
+		keys[k] = true
+	}
+	for k := range target {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var result []*Difference
+	for _, k := range sorted {
+		sourceValue, inSource := source[k]
+		targetValue, inTarget := target[k]
+		if !inSource {
+			sourceValue = missing
+		}
+		if !inTarget {
+			targetValue = missing
+		}
+		if sourceValue != targetValue && !(category == categoryRowEstimate && estimatesMatch(sourceValue, targetValue)) {
+			result = append(result, &Difference{
+				Category: category,
+				Object:   k,
+				Source:   sourceValue,
+				Target:   targetValue,
+			})
+		}
+	}
+	return result
+}
+
+func writeReport(path string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// PrintReport renders a human-readable pass/fail table.
+func PrintReport(w io.Writer, report *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tRESULT\tCATEGORY\tOBJECT\tSOURCE\tTARGET")
+	for _, dbReport := range report.Databases {
+		result := "PASS"
+		if !dbReport.Passed {
+			result = "FAIL"
+		}
+		if dbReport.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\terror\t%s\t\t\n", dbReport.DatName, result, dbReport.Error)
+		}
+		if dbReport.Error == "" && len(dbReport.Differences) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t\t\t\t\n", dbReport.DatName, result)
+		}
+		for _, d := range dbReport.Differences {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", dbReport.DatName, result, d.Category, d.Object, d.Source, d.Target)
+		}
+	}
+	return tw.Flush()
+}
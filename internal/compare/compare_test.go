@@ -0,0 +1,125 @@
+package compare
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffInventories(t *testing.T) {
+	source := inventory{
+		categoryRelations: {"public.t1": "r", "public.t2": "r"},
+		categoryRowCounts: {"public.t1": "10", "public.t2": "20"},
+	}
+	target := inventory{
+		categoryRelations: {"public.t1": "r", "public.t3": "r"},
+		categoryRowCounts: {"public.t1": "9"},
+	}
+
+	diff := diffInventories(source, target)
+	require.Len(t, diff, 4)
+
+	assert.Equal(t, &Difference{Category: categoryRelations, Object: "public.t2", Source: "r", Target: missing}, diff[0])
+	assert.Equal(t, &Difference{Category: categoryRelations, Object: "public.t3", Source: missing, Target: "r"}, diff[1])
+	assert.Equal(t, &Difference{Category: categoryRowCounts, Object: "public.t1", Source: "10", Target: "9"}, diff[2])
+	assert.Equal(t, &Difference{Category: categoryRowCounts, Object: "public.t2", Source: "20", Target: missing}, diff[3])
+}
+
+func TestDiffInventoriesRowEstimates(t *testing.T) {
+	source := inventory{categoryRowEstimate: {
+		"public.t1": "1000",
+		"public.t2": "1000",
+		"public.t3": "-1",
+		"public.t4": "0",
+		"public.t5": "50",
+	}}
+	target := inventory{categoryRowEstimate: {
+		"public.t1": "950",
+		"public.t2": "500",
+		"public.t3": "20",
+		"public.t4": "0",
+	}}
+
+	// estimates within the tolerance match, tables without statistics are not compared
+	diff := diffInventories(source, target)
+	require.Len(t, diff, 2)
+	assert.Equal(t, &Difference{Category: categoryRowEstimate, Object: "public.t2", Source: "1000", Target: "500"}, diff[0])
+	assert.Equal(t, &Difference{Category: categoryRowEstimate, Object: "public.t5", Source: "50", Target: missing}, diff[1])
+}
+
+func TestValidateRowCounts(t *testing.T) {
+	for _, mode := range []string{"", RowCountsNone, RowCountsEstimate, RowCountsExact} {
+		assert.NoError(t, ValidateRowCounts(mode))
+	}
+	assert.ErrorContains(t, ValidateRowCounts("true"), "invalid row counts mode")
+}
+
+func TestMapMemberships(t *testing.T) {
+	compareContext := &CompareContext{
+		RoleMapping: map[string]string{"prod_app": "stage_app"},
+		SkipRoles:   []string{"dba_alice"},
+	}
+	source := map[string]string{
+		"prod_readonly -> prod_app":     "",
+		"dba_alice -> pg_read_all_data": "",
+		"app_admin -> app_owners":       "",
+	}
+	target := map[string]string{
+		"prod_readonly -> stage_app":   "",
+		"stage_app -> stage_deployers": "",
+		"dba_alice -> pg_monitor":      "",
+		"app_admin -> app_owners":      "",
+	}
+
+	// mapped and skipped on purpose: no differences
+	mappedSource, mappedTarget := compareContext.mapMemberships(source, target)
+	assert.Empty(t, diffObjects(categoryMemberships, mappedSource, mappedTarget))
+
+	// a membership lost by the restore is still reported
+	delete(target, "prod_readonly -> stage_app")
+	mappedSource, mappedTarget = compareContext.mapMemberships(source, target)
+	assert.Equal(t, []*Difference{{
+		Category: categoryMemberships,
+		Object:   "prod_readonly -> stage_app",
+		Source:   "",
+		Target:   missing,
+	}}, diffObjects(categoryMemberships, mappedSource, mappedTarget))
+}
+
+func TestMapMembershipsExistingTarget(t *testing.T) {
+	source := map[string]string{"app_admin -> app_owners": ""}
+	target := map[string]string{
+		"app_admin -> app_owners": "",
+		"ops -> pg_monitor":       "",
+	}
+
+	// an empty target gets every membership of the source, an extra one is a difference
+	mappedSource, mappedTarget := (&CompareContext{}).mapMemberships(source, target)
+	assert.Len(t, diffObjects(categoryMemberships, mappedSource, mappedTarget), 1)
+
+	// roles of a non-empty target are its own
+	mappedSource, mappedTarget = (&CompareContext{ExistingTarget: true}).mapMemberships(source, target)
+	assert.Empty(t, diffObjects(categoryMemberships, mappedSource, mappedTarget))
+
+	delete(target, "app_admin -> app_owners")
+	mappedSource, mappedTarget = (&CompareContext{ExistingTarget: true}).mapMemberships(source, target)
+	assert.Len(t, diffObjects(categoryMemberships, mappedSource, mappedTarget), 1)
+}
+
+func TestDiffInventoriesEqual(t *testing.T) {
+	inv := inventory{categorySchemas: {"public": ""}}
+	assert.Empty(t, diffInventories(inv, inv))
+}
+
+func TestPrintReport(t *testing.T) {
+	var buf bytes.Buffer
+	err := PrintReport(&buf, &Report{Databases: []*DatabaseReport{
+		{DatName: "d1", Passed: true},
+		{DatName: "d2", Differences: []*Difference{{Category: categoryExtensions, Object: "pgcrypto", Source: "", Target: missing}}},
+	}})
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "d1        PASS")
+	assert.Contains(t, buf.String(), "pgcrypto")
+}
@@ -0,0 +1,237 @@
+package compare
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/jackc/pgx/v5"
+)
+
+// inventory is a set of objects by category, each object has an optional value (count, last_value, etc...)
+type inventory map[string]map[string]string
+
+const (
+	categorySchemas     = "schemas"
+	categoryRelations   = "relations"
+	categoryRowCounts   = "row-counts"
+	categoryRowEstimate = "row-estimates"
+	categorySequences   = "sequences"
+	categoryIndexes     = "indexes"
+	categoryConstraints = "constraints"
+	categoryExtensions  = "extensions"
+	categoryMemberships = "role-memberships"
+)
+
+const userSchemasPredicate = `
+	n.nspname not in ('pg_catalog', 'information_schema')
+	and n.nspname not like 'pg\_toast%'
+	and n.nspname not like 'pg\_temp\_%'
+`
+
+var databaseQueries = []struct {
+	category string
+	query    string
+}{
+	{
+		category: categorySchemas,
+		query: `
+		select n.nspname, ''
+		from pg_namespace n
+		where ` + userSchemasPredicate,
+	},
+	{
+		category: categoryRelations,
+		query: `
+		select n.nspname || '.' || c.relname, c.relkind::text
+		from pg_class c
+				 join pg_namespace n on n.oid = c.relnamespace
+		where c.relkind in ('r', 'p', 'v', 'm', 'f')
+		  and ` + userSchemasPredicate,
+	},
+	{
+		category: categorySequences,
+		query: `
+		select n.nspname || '.' || s.sequencename, coalesce(s.last_value::text, '')
+		from pg_sequences s
+				 join pg_namespace n on n.nspname = s.schemaname
+		where ` + userSchemasPredicate,
+	},
+	{
+		category: categoryIndexes,
+		query: `
+		select n.nspname || '.' || c.relname, count(*)::text
+		from pg_index i
+				 join pg_class c on c.oid = i.indrelid
+				 join pg_namespace n on n.oid = c.relnamespace
+		where ` + userSchemasPredicate + `
+		group by 1`,
+	},
+	{
+		category: categoryConstraints,
+		query: `
+		select n.nspname || '.' || c.relname, count(*)::text
+		from pg_constraint k
+				 join pg_class c on c.oid = k.conrelid
+				 join pg_namespace n on n.oid = c.relnamespace
+		where ` + userSchemasPredicate + `
+		group by 1`,
+	},
+	{
+		category: categoryExtensions,
+		query: `
+		select e.extname, ''
+		from pg_extension e`,
+	},
+}
+
+// membershipSeparator joins the member and the group in keys of role memberships, see membershipsQuery
+const membershipSeparator = " -> "
+
+const membershipsQuery = `
+select r.rolname || ' -> ' || g.rolname, ''
+from pg_auth_members m
+		 join pg_roles r on r.oid = m.member
+		 join pg_roles g on g.oid = m.roleid
+where g.rolname not like 'pg\_%'
+`
+
+// rowEstimatesQuery reads planner estimates, -1 is a table that was never analyzed (vacuumed) since PostgreSQL 14
+const rowEstimatesQuery = `
+select n.nspname || '.' || c.relname, c.reltuples::bigint::text
+from pg_class c
+		 join pg_namespace n on n.oid = c.relnamespace
+where c.relkind = 'r'
+  and ` + userSchemasPredicate
+
+const tablesQuery = `
+select n.nspname, c.relname
+from pg_class c
+		 join pg_namespace n on n.oid = c.relnamespace
+where c.relkind = 'r'
+  and ` + userSchemasPredicate
+
+// getDatabaseInventory collects objects of a single database.
+func getDatabaseInventory(ctx context.Context, connStr, dbname, rowCounts string) (inventory, error) {
+	dbConnStr, err := xutil.ConnStrWithDB(connStr, dbname)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pgx.Connect(ctx, dbConnStr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	inv := inventory{}
+	for _, q := range databaseQueries {
+		objects, err := queryObjects(ctx, conn, q.query)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query %s of %s: %w", q.category, dbname, err)
+		}
+		inv[q.category] = objects
+	}
+
+	switch rowCounts {
+	case RowCountsExact:
+		counts, err := queryRowCounts(ctx, conn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot count rows of %s: %w", dbname, err)
+		}
+		inv[categoryRowCounts] = counts
+	case RowCountsEstimate:
+		estimates, err := queryObjects(ctx, conn, rowEstimatesQuery)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query %s of %s: %w", categoryRowEstimate, dbname, err)
+		}
+		inv[categoryRowEstimate] = estimates
+	}
+	return inv, nil
+}
+
+// getClusterInventory collects cluster-wide objects.
+func getClusterInventory(ctx context.Context, connStr string) (inventory, error) {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	memberships, err := queryObjects(ctx, conn, membershipsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query %s: %w", categoryMemberships, err)
+	}
+	return inventory{categoryMemberships: memberships}, nil
+}
+
+func queryObjects(ctx context.Context, conn *pgx.Conn, query string) (map[string]string, error) {
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		objects[key] = value
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return objects, nil
+}
+
+// queryRowCounts performs exact count(*) for every table.
+func queryRowCounts(ctx context.Context, conn *pgx.Conn) (map[string]string, error) {
+	rows, err := conn.Query(ctx, tablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	var tables []pgx.Identifier
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, pgx.Identifier{schema, table})
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	counts := make(map[string]string, len(tables))
+	for _, table := range tables {
+		var count int64
+		if err := conn.QueryRow(ctx, "select count(*) from only "+table.Sanitize()).Scan(&count); err != nil {
+			return nil, err
+		}
+		counts[table[0]+"."+table[1]] = fmt.Sprintf("%d", count)
+	}
+	return counts, nil
+}
+
+// estimatesMatch compares planner estimates of row counts, they're equal within estimateTolerance.
+// A table without statistics in either cluster cannot be compared, it's not reported.
+func estimatesMatch(source, target string) bool {
+	sourceRows, err := strconv.ParseInt(source, 10, 64)
+	if err != nil {
+		return false
+	}
+	targetRows, err := strconv.ParseInt(target, 10, 64)
+	if err != nil {
+		return false
+	}
+	if sourceRows < 0 || targetRows < 0 {
+		return true
+	}
+	diff := math.Abs(float64(sourceRows - targetRows))
+	return diff <= estimateTolerance*float64(max(sourceRows, targetRows))
+}
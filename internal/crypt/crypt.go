@@ -0,0 +1,198 @@
+package crypt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	// Method is recorded in the manifest of encrypted backups
+	Method = "age"
+	// Suffix is appended to the name of every encrypted file
+	Suffix = ".age"
+)
+
+// LoadRecipients parses age public keys (age1...), given directly or as recipients files (one key per line).
+func LoadRecipients(keys, files []string) ([]age.Recipient, error) {
+	var result []age.Recipient
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", key, err)
+		}
+		result = append(result, r)
+	}
+	for _, path := range files {
+		recipients, err := parseFile(path, age.ParseRecipients)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, recipients...)
+	}
+	return result, nil
+}
+
+// LoadIdentities parses age identity files (i.e. created by age-keygen).
+func LoadIdentities(files []string) ([]age.Identity, error) {
+	var result []age.Identity
+	for _, path := range files {
+		identities, err := parseFile(path, age.ParseIdentities)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, identities...)
+	}
+	return result, nil
+}
+
+func parseFile[T any](path string, parse func(io.Reader) ([]T, error)) ([]T, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	return result, nil
+}
+
+// RecipientStrings returns public keys, they are recorded in the manifest,
+// so it is known which private keys are able to restore the backup.
+// Every recipient is recorded, a recipient without a public key encoding is an error.
+func RecipientStrings(recipients []age.Recipient) ([]string, error) {
+	result := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		s, ok := r.(fmt.Stringer)
+		if !ok {
+			return nil, fmt.Errorf("cannot record recipient of type %T in the manifest", r)
+		}
+		result = append(result, s.String())
+	}
+	return result, nil
+}
+
+// Encrypt writes everything from r into the file at path, encrypted for all recipients.
+func Encrypt(path string, r io.Reader, recipients []age.Recipient) error {
+	w, err := Create(path, recipients)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.file.Close()
+		return fmt.Errorf("cannot encrypt %s: %w", path, err)
+	}
+	return w.Close()
+}
+
+// Create creates the file at path, everything written into it is encrypted for all recipients.
+// The file is complete only after Close.
+func Create(path string, recipients []age.Recipient) (*EncryptedFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := age.Encrypt(f, recipients...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &EncryptedFile{WriteCloser: w, file: f}, nil
+}
+
+// EncryptedFile is a file being encrypted, see Create
+type EncryptedFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+// Close writes the last chunk of ciphertext, and closes the file
+func (e *EncryptedFile) Close() error {
+	if err := e.WriteCloser.Close(); err != nil {
+		e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
+
+// EncryptFile replaces the file with its encrypted copy (path + Suffix).
+func EncryptFile(path string, recipients []age.Recipient) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := Encrypt(path+Suffix, src, recipients); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// EncryptDir replaces every file in the dir (recursively) with its encrypted copy.
+func EncryptDir(dir string, recipients []age.Recipient) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return EncryptFile(path, recipients)
+	})
+}
+
+// DecryptFile writes the plaintext of the encrypted file src into dst.
+func DecryptFile(src, dst string, identities []age.Identity) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt %s: %w", src, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return fmt.Errorf("cannot decrypt %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// DecryptDir writes plaintext copies of all files of the encrypted src dir into dst, the Suffix is removed.
+// A file without the Suffix means the backup was tampered with, so it is an error.
+func DecryptDir(src, dst string, identities []age.Identity) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		plainRel, ok := strings.CutSuffix(rel, Suffix)
+		if !ok {
+			return fmt.Errorf("unexpected not encrypted file in encrypted backup: %s", path)
+		}
+		return DecryptFile(path, filepath.Join(dst, plainRel), identities)
+	})
+}
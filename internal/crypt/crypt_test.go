@@ -0,0 +1,84 @@
+package crypt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecryptDir(t *testing.T) {
+	ops, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dr, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	stranger, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	recipients, err := LoadRecipients([]string{ops.Recipient().String(), dr.Recipient().String()}, nil)
+	require.NoError(t, err)
+	recorded, err := RecipientStrings(recipients)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ops.Recipient().String(), dr.Recipient().String()}, recorded)
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "data"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "data", "toc.dat"), []byte("toc"), 0o600))
+	require.NoError(t, EncryptDir(src, recipients))
+
+	_, err = os.Stat(filepath.Join(src, "data", "toc.dat"))
+	assert.True(t, os.IsNotExist(err), "plaintext must be removed")
+	ciphertext, err := os.ReadFile(filepath.Join(src, "data", "toc.dat"+Suffix))
+	require.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "toc\x00")
+
+	// every recipient is able to decrypt
+	for _, identity := range []age.Identity{ops, dr} {
+		dst := t.TempDir()
+		require.NoError(t, DecryptDir(src, dst, []age.Identity{identity}))
+		data, err := os.ReadFile(filepath.Join(dst, "data", "toc.dat"))
+		require.NoError(t, err)
+		assert.Equal(t, "toc", string(data))
+	}
+
+	assert.Error(t, DecryptDir(src, t.TempDir(), []age.Identity{stranger}))
+}
+
+func TestDecryptDirRejectsPlaintext(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "toc.dat"), []byte("toc"), 0o600))
+	assert.Error(t, DecryptDir(src, t.TempDir(), []age.Identity{identity}))
+}
+
+func TestLoadIdentities(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# created: now\n"+identity.String()+"\n"), 0o600))
+
+	identities, err := LoadIdentities([]string{path})
+	require.NoError(t, err)
+	assert.Len(t, identities, 1)
+
+	_, err = LoadRecipients([]string{"not-a-key"}, nil)
+	assert.Error(t, err)
+}
+
+// opaqueRecipient is a recipient (i.e. a plugin one) that has no public key encoding
+type opaqueRecipient struct{}
+
+func (opaqueRecipient) Wrap([]byte) ([]*age.Stanza, error) { return nil, nil }
+
+func TestRecipientStringsUnknownType(t *testing.T) {
+	ops, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	_, err = RecipientStrings([]age.Recipient{ops.Recipient(), opaqueRecipient{}})
+	assert.ErrorContains(t, err, "cannot record recipient of type crypt.opaqueRecipient")
+}
@@ -1,16 +1,25 @@
 package dump
 
 import (
-	"bytes"
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"filippo.io/age"
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/metrics"
+	"github.com/hashmap-kz/pgdump-each/internal/runlog"
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
 	"github.com/hashmap-kz/pgdump-each/internal/xutil"
 )
 
@@ -24,36 +33,133 @@ type ClusterDumpContext struct {
 	PgBinPath   string
 	Compress    string
 	ParallelDBS int
+	// MaxTotalJobs is the sum of pg_dump --jobs of all concurrently dumped databases (0 - number of CPUs)
+	MaxTotalJobs int
+	Filter       xutil.DBFilter
+	// ResumeStage is a '<timestamp>.dirty' dir of a failed run, only missing databases are dumped
+	ResumeStage string
+	// KeepFailedStage preserves the stage dir on failure, so it may be resumed
+	KeepFailedStage bool
+	// WorkDir is a local dir for the stage, when OutputDir is a remote storage (i.e. s3://bucket/prefix)
+	WorkDir        string
+	StorageOptions storage.Options
+	// ChecksumWorkers is the number of files hashed concurrently (0 - number of CPUs), independently of ParallelDBS
+	ChecksumWorkers int
+	// ChecksumAlgorithm is one of xutil.Hash* (default: sha256)
+	ChecksumAlgorithm string
+	// EncryptRecipients are age public keys (age1...), every file of the backup is encrypted for all of them
+	EncryptRecipients      []string
+	EncryptRecipientsFiles []string
+	// SigningKey is a PEM Ed25519 private key file, checksums.txt is signed with it (checksums.txt.sig)
+	SigningKey string
+	// ProgressInterval is how often progress is logged, when stderr is not a terminal (0 - no progress)
+	ProgressInterval time.Duration
+	// Metrics records live progress and results of databases (optional)
+	Metrics *metrics.Run
+	// StreamStderr prints stderr of pg_dump/pg_dumpall to the console as it's written, prefixed with the database
+	StreamStderr bool
+	// RunID is recorded in the manifest, LogDir is the run dir: logs of pg_dump/pg_dumpall are saved there,
+	// including failed ones (optional)
+	RunID  string
+	LogDir string
+
+	recipients []age.Recipient
+	signingKey ed25519.PrivateKey
 }
 
-func RunDumpJobs(ctx context.Context, dumpContext *ClusterDumpContext) error {
-	if err := xutil.SetupEnv(ctx, dumpContext.ConnStr); err != nil {
+func RunDumpJobs(ctx context.Context, dumpContext *ClusterDumpContext) (err error) {
+	st, prefix, localOutputDir, err := prepareDump(ctx, dumpContext)
+	if err != nil {
+		return err
+	}
+
+	stageDir, finalDir, timestamp, err := prepareStage(dumpContext, localOutputDir)
+	if err != nil {
 		return err
 	}
 
-	stageDir := filepath.Join(dumpContext.OutputDir, fmt.Sprintf("%s.dirty", WorkingTimestamp))
-	finalDir := filepath.Join(dumpContext.OutputDir, fmt.Sprintf("%s.dmp", WorkingTimestamp))
+	var pub *publisher
+	if !st.IsLocal() {
+		pub = newPublisher(st, prefix, timestamp)
+	}
+
+	// in case job failed, cleanup the stage (or keep it for resume)
+	defer func() {
+		if err != nil && pub != nil {
+			// cancelled context cannot be used for cleanup
+			if discardErr := pub.discard(context.WithoutCancel(ctx)); discardErr != nil {
+				slog.Warn("dump", slog.String("err-discard-upload", discardErr.Error()))
+			}
+		}
+		if err != nil && (dumpContext.KeepFailedStage || dumpContext.ResumeStage != "") {
+			if cleanupErr := removePartialDumps(stageDir); cleanupErr != nil {
+				slog.Warn("dump", slog.String("err-cleanup", cleanupErr.Error()))
+			}
+			slog.Warn("dump",
+				slog.String("status", "failed"),
+				slog.String("stage-kept", filepath.ToSlash(stageDir)),
+			)
+			return
+		}
+		os.RemoveAll(stageDir)
+	}()
+
+	m, err := newManifest(ctx, dumpContext, timestamp)
+	if err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(stageDir, 0o755); err != nil {
+	// dumps are hashed as soon as they are finished, while others are still running
+	sums, err := xutil.NewChecksums(stageDir, dumpContext.ChecksumWorkers, dumpContext.ChecksumAlgorithm)
+	if err != nil {
 		return err
 	}
-	// in case job failed, cleanup the stage
-	defer os.RemoveAll(stageDir)
 
 	// run jobs
-	if err := dumpCluster(ctx, dumpContext, stageDir); err != nil {
+	if err := dumpCluster(ctx, dumpContext, stageDir, m, sums, pub); err != nil {
 		return err
 	}
 
 	// save globals
-	if err := writeGlobalsFile(dumpContext, stageDir); err != nil {
+	if err := writeGlobalsFile(ctx, dumpContext, stageDir); err != nil {
 		return err
 	}
 
-	// save checksums
-	if err := xutil.WriteChecksumsFile(stageDir); err != nil {
+	// save manifest
+	m.Finish()
+	if err := manifest.Write(stageDir, m); err != nil {
 		return err
 	}
+	for _, name := range []string{resumeFileName, stageFileName} {
+		if err := os.Remove(filepath.Join(stageDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// save checksums (the rest of files, i.e. globals, manifest, dumps reused on resume, are hashed here)
+	if err := sums.Write(); err != nil {
+		return err
+	}
+	if dumpContext.signingKey != nil {
+		if err := sign.SignFile(filepath.Join(stageDir, xutil.ChecksumsFileName), dumpContext.signingKey); err != nil {
+			return err
+		}
+	}
+
+	if pub != nil {
+		// upload the rest, the local stage is not needed anymore
+		if err := pub.publish(ctx, stageDir); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(stageDir); err != nil {
+			slog.Warn("dump", slog.String("err-cleanup", err.Error()))
+		}
+		slog.Info("result",
+			slog.String("status", "ok"),
+			slog.String("path", pub.String()),
+		)
+		return nil
+	}
 
 	// ONLY if ALL backups were successfully finished, rename staging to final
 	if err := os.Rename(stageDir, finalDir); err != nil {
@@ -67,46 +173,176 @@ func RunDumpJobs(ctx context.Context, dumpContext *ClusterDumpContext) error {
 	return nil
 }
 
-func dumpCluster(ctx context.Context, dumpContext *ClusterDumpContext, stageDir string) error {
-	databases, err := xutil.GetDatabases(ctx, dumpContext.ConnStr)
+// prepareDump checks the connection, binaries, keys and options, and opens the output storage.
+// The local output dir is the stage location: the output dir itself, or the work dir for a remote storage.
+func prepareDump(ctx context.Context, dumpContext *ClusterDumpContext) (st storage.Storage, prefix, localOutputDir string, err error) {
+	if err := xutil.SetupEnv(ctx, dumpContext.ConnStr); err != nil {
+		return nil, "", "", err
+	}
+
+	// pg_dump must not be older than the server, fail fast instead of failing late and obscurely
+	dumpContext.PgBinPath, err = xutil.ResolvePgBinPath(ctx, dumpContext.ConnStr, dumpContext.PgBinPath, xutil.DumpBinaries)
 	if err != nil {
-		return err
+		return nil, "", "", err
+	}
+
+	if dumpContext.ChecksumAlgorithm != "" {
+		if _, err := xutil.NewHash(dumpContext.ChecksumAlgorithm); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	if err := resolveResumeOutput(dumpContext); err != nil {
+		return nil, "", "", err
 	}
+	if dumpContext.OutputDir == "" {
+		return nil, "", "", fmt.Errorf("--output is required, unless a stage is resumed")
+	}
+
+	dumpContext.recipients, err = crypt.LoadRecipients(dumpContext.EncryptRecipients, dumpContext.EncryptRecipientsFiles)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if dumpContext.SigningKey != "" {
+		dumpContext.signingKey, err = sign.LoadPrivateKey(dumpContext.SigningKey)
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	st, prefix, err = storage.Open(dumpContext.OutputDir, &dumpContext.StorageOptions)
+	if err != nil {
+		return nil, "", "", err
+	}
+	localOutputDir = dumpContext.OutputDir
+	if !st.IsLocal() {
+		localOutputDir = dumpContext.WorkDir
+		if localOutputDir == "" {
+			localOutputDir = os.TempDir()
+		}
+	}
+	return st, prefix, localOutputDir, nil
+}
 
-	jobsWeights, err := xutil.GetJobsWeights(ctx, databases, dumpContext.ConnStr)
+func dumpCluster(
+	ctx context.Context,
+	dumpContext *ClusterDumpContext,
+	stageDir string,
+	m *manifest.Manifest,
+	sums *xutil.Checksums,
+	pub *publisher,
+) error {
+	databases, selection, err := selectDatabases(ctx, dumpContext)
 	if err != nil {
 		return err
 	}
+	m.Selection = selection
+
+	if dumpContext.ResumeStage == "" {
+		info, err := newStageInfo(dumpContext, databases)
+		if err != nil {
+			return err
+		}
+		if err := writeStageInfo(stageDir, info); err != nil {
+			return err
+		}
+	} else {
+		if err := checkStageSource(dumpContext, stageDir, databases); err != nil {
+			return err
+		}
+		databases, m.Databases, err = resumeDatabases(stageDir, databases, len(dumpContext.recipients) > 0)
+		if err != nil {
+			return err
+		}
+		// the metrics list the same databases the manifest does
+		for _, db := range m.Databases {
+			dumpContext.Metrics.DatabaseReused(db.DatName, db.DumpSizeBytes, time.Duration(db.DurationSeconds*float64(time.Second)))
+		}
+		if len(databases) == 0 {
+			slog.Info("dump", slog.String("resume", "all databases were already dumped"))
+			return nil
+		}
+	}
+
+	for _, db := range databases {
+		db.Tables, err = xutil.GetTableStats(ctx, dumpContext.ConnStr, db.DatName)
+		if err != nil {
+			return err
+		}
+	}
+	budget := xutil.JobsBudget{ParallelDBS: dumpContext.ParallelDBS, MaxTotalJobs: dumpContext.MaxTotalJobs}
+	sched := xutil.NewJobsScheduler(databases, budget)
 
 	slog.Info("dump",
-		slog.Int("workers", dumpContext.ParallelDBS),
+		slog.Int("workers", budget.Workers()),
+		slog.Int("max-total-jobs", budget.Total()),
 	)
+	for _, p := range sched.Plan() {
+		slog.Info("dump",
+			slog.String("status", "plan"),
+			slog.String("dbname", p.DatName),
+			slog.String("dbsize", xutil.ByteCountSI(p.SizeBytes)),
+			slog.Int("jobs", p.Jobs),
+		)
+	}
 
-	workerCount := dumpContext.ParallelDBS
-	dbChan := make(chan *xutil.DBInfo, len(databases))
+	progress := xutil.NewProgress("dump", databases)
+	dumpContext.Metrics.SetProgress(progress)
+	stopProgress := progress.Run(ctx, dumpContext.ProgressInterval)
+	defer stopProgress()
+
+	workerCount := budget.Workers()
 	erChan := make(chan error, len(databases))
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	dumpOne := func(db *xutil.DBInfo, jobs int) error {
+		// do not start new jobs, when interrupted
+		if ctx.Err() != nil {
+			return fmt.Errorf("dump %s skipped: %w", db.DatName, ctx.Err())
+		}
+		started := time.Now()
+		result, err := dumpDatabase(ctx, dumpContext, db, stageDir, jobs, progress)
+		if err == nil {
+			err = sums.Add(db.DatName + ".dmp")
+		}
+		if err == nil && pub != nil {
+			err = pub.uploadDatabase(ctx, stageDir, db.DatName)
+		}
+		// a database is done, when it's checksummed and uploaded, not just dumped
+		if err != nil {
+			dumpContext.Metrics.DatabaseDone(db.DatName, 0, time.Since(started), err)
+			return err
+		}
+		dumpContext.Metrics.DatabaseDone(db.DatName, result.DumpSizeBytes, time.Since(started), nil)
+		mu.Lock()
+		m.Databases = append(m.Databases, result)
+		if err := writeResumeFile(stageDir, m.Databases); err != nil {
+			slog.Warn("dump", slog.String("err-save-resume", err.Error()))
+		}
+		mu.Unlock()
+		return nil
+	}
 
-	// Start worker goroutines
+	// Start worker goroutines, databases are taken largest first
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for db := range dbChan {
-				dumpErr := dumpDatabase(dumpContext, db, stageDir, jobsWeights)
-				if dumpErr != nil {
-					erChan <- dumpErr
+			for {
+				db, jobs, ok := sched.Next()
+				if !ok {
+					return
 				}
+				if err := dumpOne(db, jobs); err != nil {
+					erChan <- err
+				}
+				sched.Done(db)
 			}
 		}()
 	}
 
-	// Send databases to the pgDumpWorker channel
-	for _, db := range databases {
-		dbChan <- db
-	}
-	close(dbChan) // Close the task channel once all tasks are submitted
-
 	// Wait for all workers to finish
 	go func() {
 		wg.Wait()
@@ -118,23 +354,71 @@ func dumpCluster(ctx context.Context, dumpContext *ClusterDumpContext, stageDir
 		slog.Error("dump-error", slog.Any("err", e))
 		lastErr = e
 	}
+
+	sort.Slice(m.Databases, func(i, j int) bool {
+		return m.Databases[i].DatName < m.Databases[j].DatName
+	})
 	return lastErr
 }
 
+// selectDatabases applies include/exclude filters, the selection is recorded in the manifest,
+// so restore knows which databases were intentionally left out.
+func selectDatabases(ctx context.Context, dumpContext *ClusterDumpContext) ([]*xutil.DBInfo, *xutil.Selection, error) {
+	if err := dumpContext.Filter.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	allDatabases, err := xutil.GetDatabases(ctx, dumpContext.ConnStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	databases, skipped := dumpContext.Filter.Split(allDatabases)
+	if len(databases) == 0 {
+		return nil, nil, fmt.Errorf("no databases matched the filter")
+	}
+
+	selection := &xutil.Selection{
+		Filter:   dumpContext.Filter,
+		Selected: []string{},
+		Skipped:  []string{},
+	}
+	for _, db := range databases {
+		selection.Selected = append(selection.Selected, db.DatName)
+	}
+	for _, db := range skipped {
+		selection.Skipped = append(selection.Skipped, db.DatName)
+		slog.Info("dump",
+			slog.String("status", "skip"),
+			slog.String("dbname", db.DatName),
+		)
+	}
+	return databases, selection, nil
+}
+
 // dumpDatabase executes pg_dump for a given database.
-func dumpDatabase(dumpContext *ClusterDumpContext, dbInfo *xutil.DBInfo, stageDir string, jobsWeights map[string]int) error {
+func dumpDatabase(
+	ctx context.Context,
+	dumpContext *ClusterDumpContext,
+	dbInfo *xutil.DBInfo,
+	stageDir string,
+	pgDumpJobs int,
+	progress *xutil.Progress,
+) (*manifest.Database, error) {
 	var err error
 
 	db := dbInfo.DatName
 
 	pgDump, err := xutil.GetExec(dumpContext.PgBinPath, "pg_dump")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	pgDumpJobs, ok := jobsWeights[db]
-	if !ok {
-		return fmt.Errorf("cannot find database name in jobs-weights table: %s", db)
+	result := &manifest.Database{
+		DatName:   db,
+		SizeBytes: dbInfo.SizeBytes,
+		Jobs:      pgDumpJobs,
+		StartedAt: time.Now(),
 	}
 
 	slog.Info("dump",
@@ -150,86 +434,134 @@ func dumpDatabase(dumpContext *ClusterDumpContext, dbInfo *xutil.DBInfo, stageDi
 	okDest := filepath.Join(stageDir, db+".dmp")
 	// prepare directory
 	if err := os.MkdirAll(tmpDest, 0o755); err != nil {
-		return fmt.Errorf("cannot create target dir %s, cause: %w", tmpDest, err)
+		return nil, fmt.Errorf("cannot create target dir %s, cause: %w", tmpDest, err)
 	}
 
-	// prepare args with optional filters
+	// bytes written into the dir are compared with the database size, tables are counted from --verbose
+	task := progress.Track(db, dbInfo, pgDumpJobs, func() (int64, error) {
+		return xutil.DirSize(tmpDest)
+	})
+	defer task.Done()
 
-	args := []string{
-		"--dbname=" + db,
-		"--file=" + tmpDest + "/data",
-		"--format=directory",
-		"--jobs=" + fmt.Sprintf("%d", pgDumpJobs),
-		"--no-password",
-		"--verbose",
-		"--verbose", // yes, twice
+	runLog, err := runlog.CreateFile(dumpContext.LogDir, "pg_dump-"+db+".log")
+	if err != nil {
+		return nil, err
 	}
-	if dumpContext.Compress != "" {
-		args = append(args, fmt.Sprintf("--compress=%s", dumpContext.Compress))
+	defer runLog.Close()
+
+	// dump logs are saved as they're written, the file is a part of the dump
+	dumpLog, err := os.OpenFile(filepath.Join(tmpDest, "dump.log"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
 	}
+	defer dumpLog.Close()
 
 	// execute dump CMD
-	var stderrBuf bytes.Buffer
-	cmd := exec.Command(pgDump, args...)
-	cmd.Stderr = &stderrBuf
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to dump %s: %v - %s", db, err, stderrBuf.String())
+	stderr := xutil.NewStderr(db, dumpContext.StreamStderr, dumpLog, task.Stderr(), runLog)
+	defer stderr.Close()
+	cmd := exec.Command(pgDump, pgDumpArgs(dumpContext, db, tmpDest, pgDumpJobs)...)
+	cmd.Stderr = stderr
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("failed to dump %s: %v - %s", db, err, stderr.Tail())
+	}
+	if err := dumpLog.Close(); err != nil {
+		slog.Warn("logs", slog.String("err-save-logs", err.Error()))
+	}
+
+	// encrypt before rename, so a completed dump is never left in plaintext
+	if len(dumpContext.recipients) > 0 {
+		if err := crypt.EncryptDir(tmpDest, dumpContext.recipients); err != nil {
+			return nil, fmt.Errorf("cannot encrypt %s, cause: %w", db, err)
+		}
 	}
 
 	// if everything is ok, just rename a temporary dir into the target one
 	err = os.Rename(tmpDest, okDest)
 	if err != nil {
-		return fmt.Errorf("cannot rename %s to %s, cause: %w", tmpDest, okDest, err)
+		return nil, fmt.Errorf("cannot rename %s to %s, cause: %w", tmpDest, okDest, err)
 	}
 
-	logFileContent := stderrBuf.Bytes()
-
-	// save dump logs
-	err = os.WriteFile(filepath.Join(okDest, "dump.log"), logFileContent, 0o600)
+	result.Finish()
+	result.DumpSizeBytes, err = xutil.DirSize(okDest)
 	if err != nil {
-		slog.Warn("logs", slog.String("err-save-logs", err.Error()))
+		return nil, err
 	}
 
 	slog.Info("dump",
 		slog.String("status", "ok"),
 		slog.String("path", filepath.ToSlash(okDest)),
 	)
-	return nil
+	return result, nil
+}
+
+// pgDumpArgs returns arguments of pg_dump, the dump is written into dest/data
+func pgDumpArgs(dumpContext *ClusterDumpContext, db, dest string, jobs int) []string {
+	args := []string{
+		"--dbname=" + db,
+		"--file=" + dest + "/data",
+		"--format=directory",
+		"--jobs=" + fmt.Sprintf("%d", jobs),
+		"--no-password",
+		"--verbose",
+		"--verbose", // yes, twice
+	}
+	if dumpContext.Compress != "" {
+		args = append(args, fmt.Sprintf("--compress=%s", dumpContext.Compress))
+	}
+	return args
+}
+
+func pgDumpallArgs(dumpContext *ClusterDumpContext) []string {
+	return []string{
+		"--dbname=" + dumpContext.ConnStr,
+		"--globals-only",
+		"--clean",
+		"--if-exists",
+		"--verbose",
+		"--verbose", // yes, twice
+	}
 }
 
-func writeGlobalsFile(dumpContext *ClusterDumpContext, path string) error {
-	pgDumpAllSQL, _, err := dumpGlobals(dumpContext)
+// writeGlobalsFile streams the output of pg_dumpall into the globals file
+func writeGlobalsFile(ctx context.Context, dumpContext *ClusterDumpContext, path string) error {
+	var out io.WriteCloser
+	var err error
+	// globals contain password hashes, the plaintext never touches the disk when encrypted
+	if len(dumpContext.recipients) > 0 {
+		out, err = crypt.Create(filepath.Join(path, GlobalsFileName+crypt.Suffix), dumpContext.recipients)
+	} else {
+		out, err = os.OpenFile(filepath.Join(path, GlobalsFileName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	}
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(filepath.Join(path, GlobalsFileName), pgDumpAllSQL, 0o600); err != nil {
+	if err := dumpGlobals(ctx, dumpContext, out); err != nil {
+		out.Close()
 		return err
 	}
-	return nil
+	return out.Close()
 }
 
-func dumpGlobals(dumpContext *ClusterDumpContext) (sql, logs []byte, err error) {
+func dumpGlobals(ctx context.Context, dumpContext *ClusterDumpContext, out io.Writer) error {
 	pgDumpall, err := xutil.GetExec(dumpContext.PgBinPath, "pg_dumpall")
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	args := []string{
-		"--dbname=" + dumpContext.ConnStr,
-		"--globals-only",
-		"--clean",
-		"--if-exists",
-		"--verbose",
-		"--verbose", // yes, twice
+	runLog, err := runlog.CreateFile(dumpContext.LogDir, "pg_dumpall.log")
+	if err != nil {
+		return err
 	}
+	defer runLog.Close()
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd := exec.Command(pgDumpall, args...)
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	stderr := xutil.NewStderr("globals", dumpContext.StreamStderr, runLog)
+	defer stderr.Close()
+	cmd := exec.Command(pgDumpall, pgDumpallArgs(dumpContext)...)
+	cmd.Stdout = out
+	cmd.Stderr = stderr
 
-	if err := cmd.Run(); err != nil {
-		return nil, stderrBuf.Bytes(), err
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to dump globals: %v - %s", err, stderr.Tail())
 	}
-	return stdoutBuf.Bytes(), stderrBuf.Bytes(), nil
+	return nil
 }
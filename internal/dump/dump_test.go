@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
 	"github.com/hashmap-kz/pgdump-each/internal/xutil"
 	"github.com/stretchr/testify/assert"
 )
@@ -40,6 +41,7 @@ func TestDumpStage(t *testing.T) {
 	expectedFiles := []string{
 		xutil.ChecksumsFileName,
 		GlobalsFileName,
+		manifest.FileName,
 	}
 	for _, expFile := range expectedFiles {
 		path := filepath.Join(expectedPath, expFile)
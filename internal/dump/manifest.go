@@ -0,0 +1,82 @@
+package dump
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/version"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/jackc/pgconn"
+)
+
+// newManifest collects metadata about the source cluster and client tools,
+// databases and timings are filled while the dump is running.
+func newManifest(ctx context.Context, dumpContext *ClusterDumpContext, timestamp string) (*manifest.Manifest, error) {
+	cfg, err := pgconn.ParseConfig(dumpContext.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+
+	serverVersion, serverVersionNum, err := xutil.GetServerVersion(ctx, dumpContext.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pgDumpVersion, err := xutil.GetExecVersion(dumpContext.PgBinPath, "pg_dump")
+	if err != nil {
+		return nil, err
+	}
+	pgDumpallVersion, err := xutil.GetExecVersion(dumpContext.PgBinPath, "pg_dumpall")
+	if err != nil {
+		return nil, err
+	}
+
+	var encryption *manifest.Encryption
+	if len(dumpContext.recipients) > 0 {
+		recipients, err := crypt.RecipientStrings(dumpContext.recipients)
+		if err != nil {
+			return nil, err
+		}
+		encryption = &manifest.Encryption{
+			Method:     crypt.Method,
+			Recipients: recipients,
+		}
+	}
+
+	var signature *manifest.Signature
+	if dumpContext.signingKey != nil {
+		signature = &manifest.Signature{
+			Method:    sign.Method,
+			PublicKey: sign.PublicKeyString(dumpContext.signingKey),
+		}
+	}
+
+	return &manifest.Manifest{
+		FormatVersion: manifest.FormatVersion,
+		ToolVersion:   version.Version,
+		Timestamp:     timestamp,
+		RunID:         dumpContext.RunID,
+		StartedAt:     time.Now(),
+		Source: manifest.Source{
+			Host:             cfg.Host,
+			Port:             cfg.Port,
+			User:             cfg.User,
+			ServerVersion:    serverVersion,
+			ServerVersionNum: serverVersionNum,
+		},
+		Client: manifest.Client{
+			PgDumpVersion:    pgDumpVersion,
+			PgDumpallVersion: pgDumpallVersion,
+		},
+		Options: manifest.Options{
+			Compress:    dumpContext.Compress,
+			ParallelDBS: dumpContext.ParallelDBS,
+		},
+		Encryption: encryption,
+		Signature:  signature,
+		Databases:  []*manifest.Database{},
+	}, nil
+}
@@ -0,0 +1,86 @@
+package dump
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// RunDumpPlan reports what RunDumpJobs would do (--dry-run): the connection, binaries, keys and filters
+// are checked, databases are selected and jobs are assigned, but nothing is written or executed.
+func RunDumpPlan(ctx context.Context, dumpContext *ClusterDumpContext) (*xutil.RunPlan, error) {
+	st, prefix, localOutputDir, err := prepareDump(ctx, dumpContext)
+	if err != nil {
+		return nil, err
+	}
+	stageDir, finalDir, timestamp, err := stagePaths(dumpContext, localOutputDir)
+	if err != nil {
+		return nil, err
+	}
+	target := filepath.ToSlash(finalDir)
+	if !st.IsLocal() {
+		target = newPublisher(st, prefix, timestamp).String()
+	}
+
+	databases, selection, err := selectDatabases(ctx, dumpContext)
+	if err != nil {
+		return nil, err
+	}
+
+	// dumps completed by the resumed run are kept as is
+	var pending, completed []*xutil.DBInfo
+	for _, db := range databases {
+		if dumpContext.ResumeStage != "" {
+			if _, err := os.Stat(filepath.Join(stageDir, db.DatName+".dmp")); err == nil {
+				completed = append(completed, db)
+				continue
+			}
+		}
+		db.Tables, err = xutil.GetTableStats(ctx, dumpContext.ConnStr, db.DatName)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, db)
+	}
+
+	pgDump, err := xutil.GetExec(dumpContext.PgBinPath, "pg_dump")
+	if err != nil {
+		return nil, err
+	}
+	pgDumpall, err := xutil.GetExec(dumpContext.PgBinPath, "pg_dumpall")
+	if err != nil {
+		return nil, err
+	}
+
+	budget := xutil.JobsBudget{ParallelDBS: dumpContext.ParallelDBS, MaxTotalJobs: dumpContext.MaxTotalJobs}
+	plan := &xutil.RunPlan{
+		Source:       xutil.RedactConnStr(dumpContext.ConnStr),
+		Target:       target,
+		Workers:      budget.Workers(),
+		MaxTotalJobs: budget.Total(),
+		Databases:    []*xutil.PlannedDatabase{},
+		Skipped:      selection.Skipped,
+		Commands:     []string{xutil.CommandLine(pgDumpall, pgDumpallArgs(dumpContext))},
+	}
+	for _, p := range xutil.NewJobsScheduler(pending, budget).Plan() {
+		plan.Databases = append(plan.Databases, &xutil.PlannedDatabase{
+			DatName:   p.DatName,
+			SizeBytes: p.SizeBytes,
+			Jobs:      p.Jobs,
+			Status:    xutil.PlanStatusRun,
+			Path:      target + "/" + p.DatName + ".dmp",
+			Command:   xutil.CommandLine(pgDump, pgDumpArgs(dumpContext, p.DatName, filepath.Join(stageDir, p.DatName+".dirty"), p.Jobs)),
+		})
+	}
+	for _, db := range completed {
+		plan.Databases = append(plan.Databases, &xutil.PlannedDatabase{
+			DatName:   db.DatName,
+			SizeBytes: db.SizeBytes,
+			Status:    xutil.PlanStatusSkipCompleted,
+			Path:      filepath.ToSlash(filepath.Join(stageDir, db.DatName+".dmp")),
+		})
+	}
+	return plan, nil
+}
@@ -0,0 +1,75 @@
+package dump
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// publisher uploads a backup into a remote storage.
+// Database dumps are uploaded as soon as they finish, root files go last, and checksums.txt is the very last one:
+// a backup without checksums.txt is incomplete (the same way a local '.dirty' dir is).
+type publisher struct {
+	st  storage.Storage
+	key string
+
+	mu       sync.Mutex
+	uploaded map[string]bool
+}
+
+func newPublisher(st storage.Storage, prefix, timestamp string) *publisher {
+	return &publisher{
+		st:       st,
+		key:      storage.Join(prefix, fmt.Sprintf("%s.dmp", timestamp)),
+		uploaded: map[string]bool{},
+	}
+}
+
+func (p *publisher) uploadDatabase(ctx context.Context, stageDir, dbname string) error {
+	dir := dbname + ".dmp"
+	if err := storage.UploadDir(ctx, p.st, filepath.Join(stageDir, dir), storage.Join(p.key, dir)); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.uploaded[dir] = true
+	p.mu.Unlock()
+	return nil
+}
+
+// publish uploads everything that is not uploaded yet (i.e. dumps reused on resume), and checksums at the end.
+func (p *publisher) publish(ctx context.Context, stageDir string) error {
+	entries, err := os.ReadDir(stageDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == xutil.ChecksumsFileName || p.uploaded[name] {
+			continue
+		}
+		local := filepath.Join(stageDir, name)
+		if entry.IsDir() {
+			err = storage.UploadDir(ctx, p.st, local, storage.Join(p.key, name))
+		} else {
+			err = storage.UploadFile(ctx, p.st, local, storage.Join(p.key, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return storage.UploadFile(ctx, p.st, filepath.Join(stageDir, xutil.ChecksumsFileName), storage.Join(p.key, xutil.ChecksumsFileName))
+}
+
+// discard removes partially uploaded backup
+func (p *publisher) discard(ctx context.Context) error {
+	return p.st.Remove(ctx, p.key)
+}
+
+func (p *publisher) String() string {
+	return p.st.String() + "/" + p.key
+}
@@ -0,0 +1,303 @@
+package dump
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/jackc/pgconn"
+)
+
+// resumeFileName keeps results of finished databases in the stage dir, so a failed dump may be resumed.
+// It is removed before checksums are computed, and never gets into the final backup.
+const resumeFileName = "resume.json"
+
+// stageFileName keeps stageInfo of the run in the stage dir, it's removed the same way resumeFileName is.
+const stageFileName = "stage.json"
+
+// stageInfo is what a resumed run must share with the failed one: the output, the source cluster and databases.
+type stageInfo struct {
+	Output    string   `json:"output"`
+	Host      string   `json:"host"`
+	Port      uint16   `json:"port"`
+	Databases []string `json:"databases"`
+}
+
+// prepareStage returns the stage dir, the final dir and the timestamp of the backup.
+// A new stage is created, unless an existing one is resumed.
+func prepareStage(dumpContext *ClusterDumpContext, outputDir string) (stageDir, finalDir, timestamp string, err error) {
+	stageDir, finalDir, timestamp, err = stagePaths(dumpContext, outputDir)
+	if err != nil {
+		return "", "", "", err
+	}
+	if dumpContext.ResumeStage == "" {
+		if err := os.MkdirAll(stageDir, 0o755); err != nil {
+			return "", "", "", err
+		}
+	}
+	return stageDir, finalDir, timestamp, nil
+}
+
+// stagePaths is prepareStage without side effects, a resumed stage is validated
+func stagePaths(dumpContext *ClusterDumpContext, outputDir string) (stageDir, finalDir, timestamp string, err error) {
+	if dumpContext.ResumeStage == "" {
+		stageDir = filepath.Join(outputDir, fmt.Sprintf("%s.dirty", WorkingTimestamp))
+		finalDir = filepath.Join(outputDir, fmt.Sprintf("%s.dmp", WorkingTimestamp))
+		return stageDir, finalDir, WorkingTimestamp, nil
+	}
+
+	stageDir = filepath.Clean(dumpContext.ResumeStage)
+	timestamp, ok := strings.CutSuffix(filepath.Base(stageDir), ".dirty")
+	if !ok {
+		return "", "", "", fmt.Errorf("cannot resume, not a stage dir (expected <timestamp>.dirty): %s", stageDir)
+	}
+	info, err := os.Stat(stageDir)
+	if err != nil {
+		return "", "", "", fmt.Errorf("cannot resume: %w", err)
+	}
+	if !info.IsDir() {
+		return "", "", "", fmt.Errorf("cannot resume, not a directory: %s", stageDir)
+	}
+	// the final backup is placed next to the stage
+	finalDir = filepath.Join(filepath.Dir(stageDir), fmt.Sprintf("%s.dmp", timestamp))
+	if _, err := os.Stat(finalDir); err == nil {
+		return "", "", "", fmt.Errorf("cannot resume, backup already exists: %s", finalDir)
+	}
+	return stageDir, finalDir, timestamp, nil
+}
+
+// resumeDatabases returns databases that have no completed dump in the stage dir,
+// and manifest entries of the ones that were already dumped by a previous run.
+// Completed dumps must be encrypted (or not) the same way the current run does.
+func resumeDatabases(
+	stageDir string,
+	databases []*xutil.DBInfo,
+	encrypted bool,
+) (pending []*xutil.DBInfo, done []*manifest.Database, err error) {
+	if err := removePartialDumps(stageDir); err != nil {
+		return nil, nil, err
+	}
+
+	results, err := readResumeFile(stageDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := make(map[string]bool, len(databases))
+	for _, db := range databases {
+		selected[db.DatName] = true
+
+		okDest := filepath.Join(stageDir, db.DatName+".dmp")
+		if _, err := os.Stat(okDest); err != nil {
+			if os.IsNotExist(err) {
+				pending = append(pending, db)
+				continue
+			}
+			return nil, nil, err
+		}
+
+		if err := checkDumpEncryption(okDest, encrypted); err != nil {
+			return nil, nil, err
+		}
+
+		result, ok := results[db.DatName]
+		if !ok {
+			// the dump was completed, but the process died before the result was saved
+			result = &manifest.Database{DatName: db.DatName, SizeBytes: db.SizeBytes}
+		}
+		result.DumpSizeBytes, err = xutil.DirSize(okDest)
+		if err != nil {
+			return nil, nil, err
+		}
+		done = append(done, result)
+
+		slog.Info("dump",
+			slog.String("status", "skip-completed"),
+			slog.String("dbname", db.DatName),
+		)
+	}
+
+	// the stage must not contain dumps the current selection does not know about
+	dumps, err := xutil.GetDumpsInDir(stageDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dump := range dumps {
+		if dbname := xutil.DumpDirDBName(dump.DatName); !selected[dbname] {
+			return nil, nil, fmt.Errorf("cannot resume, stage contains a dump of not selected database: %s", dbname)
+		}
+	}
+	return pending, done, nil
+}
+
+// checkDumpEncryption refuses to mix encrypted and plaintext dumps in one backup
+func checkDumpEncryption(dumpDir string, encrypted bool) error {
+	toc := filepath.Join(dumpDir, "data", "toc.dat")
+	if encrypted {
+		if _, err := os.Stat(toc); err == nil {
+			return fmt.Errorf("cannot resume, dump is not encrypted: %s", dumpDir)
+		}
+		return nil
+	}
+	if _, err := os.Stat(toc + crypt.Suffix); err == nil {
+		return fmt.Errorf("cannot resume, dump is encrypted, but no recipients are given: %s", dumpDir)
+	}
+	return nil
+}
+
+// removePartialDumps removes '<dbname>.dirty' dirs left by failed pg_dump runs.
+func removePartialDumps(stageDir string) error {
+	entries, err := os.ReadDir(stageDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), ".dirty") {
+			if err := os.RemoveAll(filepath.Join(stageDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readResumeFile(stageDir string) (map[string]*manifest.Database, error) {
+	results := map[string]*manifest.Database{}
+	data, err := os.ReadFile(filepath.Join(stageDir, resumeFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return results, nil
+		}
+		return nil, err
+	}
+	var databases []*manifest.Database
+	if err := json.Unmarshal(data, &databases); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", resumeFileName, err)
+	}
+	for _, db := range databases {
+		results[db.DatName] = db
+	}
+	return results, nil
+}
+
+func writeResumeFile(stageDir string, databases []*manifest.Database) error {
+	data, err := json.MarshalIndent(databases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(stageDir, resumeFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(stageDir, resumeFileName))
+}
+
+func newStageInfo(dumpContext *ClusterDumpContext, databases []*xutil.DBInfo) (*stageInfo, error) {
+	cfg, err := pgconn.ParseConfig(dumpContext.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+	output, err := normalizeOutput(dumpContext.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(databases))
+	for _, db := range databases {
+		names = append(names, db.DatName)
+	}
+	slices.Sort(names)
+	return &stageInfo{Output: output, Host: cfg.Host, Port: cfg.Port, Databases: names}, nil
+}
+
+// normalizeOutput makes a local output absolute, so the same dir given as a relative path matches
+func normalizeOutput(output string) (string, error) {
+	if storage.IsRemote(output) {
+		return strings.TrimSuffix(output, "/"), nil
+	}
+	return filepath.Abs(output)
+}
+
+// resolveResumeOutput takes the output of a resumed stage from the stage itself, when --output is not given,
+// or checks that it's the same one. Stages of older versions have no stage file, --output is required for them.
+func resolveResumeOutput(dumpContext *ClusterDumpContext) error {
+	if dumpContext.ResumeStage == "" {
+		return nil
+	}
+	info, err := readStageInfo(filepath.Clean(dumpContext.ResumeStage))
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		if dumpContext.OutputDir == "" {
+			return fmt.Errorf("cannot resume, %s not found in the stage, --output is required", stageFileName)
+		}
+		return nil
+	}
+	if dumpContext.OutputDir == "" {
+		dumpContext.OutputDir = info.Output
+		return nil
+	}
+	output, err := normalizeOutput(dumpContext.OutputDir)
+	if err != nil {
+		return err
+	}
+	if output != info.Output {
+		return fmt.Errorf("cannot resume, the stage belongs to output %s, not %s", info.Output, output)
+	}
+	return nil
+}
+
+// checkStageSource ensures the resumed run dumps the same databases of the same cluster as the failed one did
+func checkStageSource(dumpContext *ClusterDumpContext, stageDir string, databases []*xutil.DBInfo) error {
+	info, err := readStageInfo(stageDir)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		slog.Warn("dump", slog.String("resume", stageFileName+" not found, the source is not checked"))
+		return nil
+	}
+	current, err := newStageInfo(dumpContext, databases)
+	if err != nil {
+		return err
+	}
+	if current.Host != info.Host || current.Port != info.Port {
+		return fmt.Errorf("cannot resume, the stage was dumped from %s:%d, not %s:%d", info.Host, info.Port, current.Host, current.Port)
+	}
+	if !slices.Equal(current.Databases, info.Databases) {
+		return fmt.Errorf("cannot resume, the stage was dumped with databases [%s], selected now: [%s]",
+			strings.Join(info.Databases, ", "), strings.Join(current.Databases, ", "))
+	}
+	return nil
+}
+
+func readStageInfo(stageDir string) (*stageInfo, error) {
+	data, err := os.ReadFile(filepath.Join(stageDir, stageFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var info stageInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", stageFileName, err)
+	}
+	return &info, nil
+}
+
+func writeStageInfo(stageDir string, info *stageInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stageDir, stageFileName), data, 0o600)
+}
@@ -0,0 +1,101 @@
+package dump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeDatabases(t *testing.T) {
+	stageDir := filepath.Join(t.TempDir(), "20250328154501.dirty")
+
+	// d1 is completed, d2 is partial, d3 was not started
+	require.NoError(t, os.MkdirAll(filepath.Join(stageDir, "d1.dmp", "data"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(stageDir, "d2.dirty", "data"), 0o755))
+	require.NoError(t, writeResumeFile(stageDir, []*manifest.Database{{DatName: "d1", Jobs: 3}}))
+
+	databases := []*xutil.DBInfo{{DatName: "d1"}, {DatName: "d2"}, {DatName: "d3"}}
+	pending, done, err := resumeDatabases(stageDir, databases, false)
+	require.NoError(t, err)
+
+	require.Len(t, done, 1)
+	assert.Equal(t, "d1", done[0].DatName)
+	assert.Equal(t, 3, done[0].Jobs)
+
+	require.Len(t, pending, 2)
+	assert.Equal(t, "d2", pending[0].DatName)
+	assert.Equal(t, "d3", pending[1].DatName)
+
+	assert.NoDirExists(t, filepath.Join(stageDir, "d2.dirty"))
+}
+
+func TestResumeRefusesUnknownDumps(t *testing.T) {
+	stageDir := filepath.Join(t.TempDir(), "20250328154501.dirty")
+	require.NoError(t, os.MkdirAll(filepath.Join(stageDir, "d9.dmp"), 0o755))
+
+	_, _, err := resumeDatabases(stageDir, []*xutil.DBInfo{{DatName: "d1"}}, false)
+	assert.ErrorContains(t, err, "not selected database: d9")
+}
+
+func TestResumeRefusesMixedEncryption(t *testing.T) {
+	stageDir := filepath.Join(t.TempDir(), "20250328154501.dirty")
+	require.NoError(t, os.MkdirAll(filepath.Join(stageDir, "d1.dmp", "data"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(stageDir, "d1.dmp", "data", "toc.dat"), []byte("toc"), 0o600))
+
+	_, _, err := resumeDatabases(stageDir, []*xutil.DBInfo{{DatName: "d1"}}, true)
+	assert.ErrorContains(t, err, "not encrypted")
+}
+
+func TestPrepareStageResume(t *testing.T) {
+	outputDir := t.TempDir()
+	stageDir := filepath.Join(outputDir, "20250328154501.dirty")
+	require.NoError(t, os.MkdirAll(stageDir, 0o755))
+
+	gotStage, gotFinal, timestamp, err := prepareStage(&ClusterDumpContext{ResumeStage: stageDir}, outputDir)
+	require.NoError(t, err)
+	assert.Equal(t, stageDir, gotStage)
+	assert.Equal(t, filepath.Join(outputDir, "20250328154501.dmp"), gotFinal)
+	assert.Equal(t, "20250328154501", timestamp)
+
+	_, _, _, err = prepareStage(&ClusterDumpContext{ResumeStage: outputDir}, outputDir)
+	assert.Error(t, err)
+}
+
+func TestResumeStageInfo(t *testing.T) {
+	outputDir := t.TempDir()
+	stageDir := filepath.Join(outputDir, "20250328154501.dirty")
+	require.NoError(t, os.MkdirAll(stageDir, 0o755))
+
+	dumpContext := &ClusterDumpContext{ConnStr: "postgres://postgres@db1:5432/postgres", OutputDir: outputDir}
+	databases := []*xutil.DBInfo{{DatName: "d2"}, {DatName: "d1"}}
+	info, err := newStageInfo(dumpContext, databases)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d1", "d2"}, info.Databases)
+	require.NoError(t, writeStageInfo(stageDir, info))
+
+	// --output is taken from the stage
+	resumed := &ClusterDumpContext{ConnStr: dumpContext.ConnStr, ResumeStage: stageDir}
+	require.NoError(t, resolveResumeOutput(resumed))
+	assert.Equal(t, outputDir, resumed.OutputDir)
+	require.NoError(t, checkStageSource(resumed, stageDir, []*xutil.DBInfo{{DatName: "d1"}, {DatName: "d2"}}))
+
+	// or must match it
+	resumed = &ClusterDumpContext{ResumeStage: stageDir, OutputDir: t.TempDir()}
+	assert.ErrorContains(t, resolveResumeOutput(resumed), "the stage belongs to output")
+
+	// the source cluster and selected databases must be the same
+	resumed = &ClusterDumpContext{ConnStr: "postgres://postgres@db2:5432/postgres", OutputDir: outputDir}
+	assert.ErrorContains(t, checkStageSource(resumed, stageDir, databases), "the stage was dumped from db1:5432")
+	resumed.ConnStr = dumpContext.ConnStr
+	assert.ErrorContains(t, checkStageSource(resumed, stageDir, databases[:1]), "selected now: [d2]")
+
+	// stages of older versions have no stage file
+	require.NoError(t, os.Remove(filepath.Join(stageDir, stageFileName)))
+	assert.ErrorContains(t, resolveResumeOutput(&ClusterDumpContext{ResumeStage: stageDir}), "--output is required")
+	require.NoError(t, resolveResumeOutput(&ClusterDumpContext{ResumeStage: stageDir, OutputDir: outputDir}))
+}
@@ -0,0 +1,142 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+const (
+	FileName = "manifest.json"
+
+	// FormatVersion must be incremented on every incompatible change of the manifest layout.
+	FormatVersion = 1
+)
+
+// Manifest describes a finished backup: where it was taken from, with which tools and options,
+// and what each database dump looks like.
+type Manifest struct {
+	FormatVersion int    `json:"format_version"`
+	ToolVersion   string `json:"tool_version"`
+	Timestamp     string `json:"timestamp"`
+	// RunID links the backup to its logs, see runlog
+	RunID           string           `json:"run_id,omitempty"`
+	StartedAt       time.Time        `json:"started_at"`
+	FinishedAt      time.Time        `json:"finished_at"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Source          Source           `json:"source"`
+	Client          Client           `json:"client"`
+	Options         Options          `json:"options"`
+	Selection       *xutil.Selection `json:"selection"`
+	Encryption      *Encryption      `json:"encryption,omitempty"`
+	Signature       *Signature       `json:"signature,omitempty"`
+	Databases       []*Database      `json:"databases"`
+}
+
+type Source struct {
+	Host             string `json:"host"`
+	Port             uint16 `json:"port"`
+	User             string `json:"user"`
+	ServerVersion    string `json:"server_version"`
+	ServerVersionNum int    `json:"server_version_num"`
+}
+
+type Client struct {
+	PgDumpVersion    string `json:"pg_dump_version"`
+	PgDumpallVersion string `json:"pg_dumpall_version"`
+}
+
+type Options struct {
+	Compress    string `json:"compress"`
+	ParallelDBS int    `json:"parallel_databases"`
+}
+
+// Encryption is set when every file of the backup (except the manifest and checksums) is encrypted.
+type Encryption struct {
+	Method     string   `json:"method"`
+	Recipients []string `json:"recipients"`
+}
+
+// Signature is set when checksums.txt of the backup is signed (checksums.txt.sig).
+// The key is informational, restore and verify trust only the configured public key.
+type Signature struct {
+	Method    string `json:"method"`
+	PublicKey string `json:"public_key"`
+}
+
+type Database struct {
+	DatName         string    `json:"datname"`
+	SizeBytes       int64     `json:"size_bytes"`
+	DumpSizeBytes   int64     `json:"dump_size_bytes"`
+	Jobs            int       `json:"jobs"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// Finish sets the end time and the duration of the database dump.
+func (d *Database) Finish() {
+	d.FinishedAt = time.Now()
+	d.DurationSeconds = d.FinishedAt.Sub(d.StartedAt).Seconds()
+}
+
+// Finish sets the end time and the duration of the whole backup.
+func (m *Manifest) Finish() {
+	m.FinishedAt = time.Now()
+	m.DurationSeconds = m.FinishedAt.Sub(m.StartedAt).Seconds()
+}
+
+func Write(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, FileName), data, 0o600)
+}
+
+// Read loads and validates the manifest of a backup.
+func Read(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates the manifest, i.e. fetched from a remote storage.
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", FileName, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *Manifest) Validate() error {
+	if m.FormatVersion < 1 {
+		return fmt.Errorf("%s: invalid format version: %d", FileName, m.FormatVersion)
+	}
+	if m.FormatVersion > FormatVersion {
+		return fmt.Errorf("%s: format version %d is newer than supported %d, upgrade pgdump-each",
+			FileName, m.FormatVersion, FormatVersion)
+	}
+	if m.Selection == nil {
+		return fmt.Errorf("%s: selection is missing", FileName)
+	}
+	if m.Encryption != nil && m.Encryption.Method != crypt.Method {
+		return fmt.Errorf("%s: unsupported encryption method: %s", FileName, m.Encryption.Method)
+	}
+	if m.Signature != nil && m.Signature.Method != sign.Method {
+		return fmt.Errorf("%s: unsupported signature method: %s", FileName, m.Signature.Method)
+	}
+	return nil
+}
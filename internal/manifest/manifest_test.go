@@ -0,0 +1,45 @@
+package manifest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRead(t *testing.T) {
+	dir := t.TempDir()
+
+	m := &Manifest{
+		FormatVersion: FormatVersion,
+		Timestamp:     "20250328154501",
+		Selection:     &xutil.Selection{Selected: []string{"d1"}, Skipped: []string{}},
+		Databases:     []*Database{{DatName: "d1", SizeBytes: 1024, Jobs: 2}},
+	}
+	m.Finish()
+	require.NoError(t, Write(dir, m))
+
+	got, err := Read(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "20250328154501", got.Timestamp)
+	assert.Equal(t, "d1", got.Databases[0].DatName)
+	assert.Equal(t, 2, got.Databases[0].Jobs)
+}
+
+func TestReadRefusesNewerFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	data, err := json.Marshal(&Manifest{
+		FormatVersion: FormatVersion + 1,
+		Selection:     &xutil.Selection{},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, FileName), data, 0o600))
+
+	_, err = Read(dir)
+	assert.ErrorContains(t, err, "newer than supported")
+}
@@ -0,0 +1,308 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pgdump_each"
+
+// lastSuccessName is carried over from the previous textfile, when the run fails
+const lastSuccessName = namespace + "_last_success_timestamp_seconds"
+
+var (
+	runLabels = []string{"operation"}
+	dbLabels  = []string{"operation", "dbname"}
+	// results of databases are labeled with their status, see dbResult.status
+	dbResultLabels = []string{"operation", "dbname", "status"}
+
+	lastRunDesc     = prometheus.NewDesc(namespace+"_last_run_timestamp_seconds", "Time the last run finished.", runLabels, nil)
+	lastSuccessDesc = prometheus.NewDesc(lastSuccessName, "Time the last successful run finished.", runLabels, nil)
+	lastResultDesc  = prometheus.NewDesc(namespace+"_last_run_success", "Whether the last run succeeded (1) or failed (0).", runLabels, nil)
+	durationDesc    = prometheus.NewDesc(namespace+"_last_run_duration_seconds", "Duration of the last run.", runLabels, nil)
+	failuresDesc    = prometheus.NewDesc(namespace+"_last_run_failed_databases", "Number of databases failed by the last run.", runLabels, nil)
+
+	dbBytesDesc    = prometheus.NewDesc(namespace+"_database_bytes", "Size of the dump of the database.", dbResultLabels, nil)
+	dbDurationDesc = prometheus.NewDesc(namespace+"_database_duration_seconds", "Duration of the dump/restore of the database.", dbResultLabels, nil)
+	dbSuccessDesc  = prometheus.NewDesc(namespace+"_database_success", "Whether the database succeeded (1) or failed (0).", dbResultLabels, nil)
+
+	runningDesc        = prometheus.NewDesc(namespace+"_running", "Whether the run is in progress.", runLabels, nil)
+	elapsedDesc        = prometheus.NewDesc(namespace+"_elapsed_seconds", "Time since the run started.", runLabels, nil)
+	databasesDesc      = prometheus.NewDesc(namespace+"_databases", "Number of databases to be processed.", runLabels, nil)
+	finishedDesc       = prometheus.NewDesc(namespace+"_databases_finished", "Number of databases processed so far.", runLabels, nil)
+	totalBytesDesc     = prometheus.NewDesc(namespace+"_total_bytes", "Total size of databases to be processed.", runLabels, nil)
+	processedBytesDesc = prometheus.NewDesc(namespace+"_processed_bytes", "Estimated size of databases processed so far.", runLabels, nil)
+	progressDesc       = prometheus.NewDesc(namespace+"_progress_ratio", "Estimated progress of the run (0..1).", runLabels, nil)
+	throughputDesc     = prometheus.NewDesc(namespace+"_throughput_bytes_per_second", "Estimated throughput in bytes of database size.", runLabels, nil)
+	etaDesc            = prometheus.NewDesc(namespace+"_eta_seconds", "Estimated time left (0 - unknown).", runLabels, nil)
+	dbProgressDesc     = prometheus.NewDesc(namespace+"_database_progress_ratio", "Estimated progress of a running database (0..1).", dbLabels, nil)
+	dbWrittenBytesDesc = prometheus.NewDesc(namespace+"_database_written_bytes", "Bytes written by a running dump.", dbLabels, nil)
+	dbTablesDesc       = prometheus.NewDesc(namespace+"_database_tables", "Number of tables of a running database.", dbLabels, nil)
+	dbTablesDoneDesc   = prometheus.NewDesc(namespace+"_database_tables_done", "Number of tables completed by a running database.", dbLabels, nil)
+	dbJobsDesc         = prometheus.NewDesc(namespace+"_database_jobs", "Number of --jobs of a running database.", dbLabels, nil)
+	dbElapsedDesc      = prometheus.NewDesc(namespace+"_database_elapsed_seconds", "Time since a running database started.", dbLabels, nil)
+)
+
+// Run collects metrics of a dump or a restore: live gauges (see Serve), and results of databases
+// written as a Prometheus textfile-collector file at the end (see WriteTextfile).
+// A nil Run records nothing, so callers don't check whether metrics are enabled.
+type Run struct {
+	operation string
+	started   time.Time
+
+	mu        sync.Mutex
+	progress  *xutil.Progress
+	databases map[string]*dbResult
+	finished  time.Time
+}
+
+type dbResult struct {
+	bytes    int64
+	duration time.Duration
+	failed   bool
+	// reused is a dump completed by the failed run, that a resumed one keeps as is
+	reused bool
+}
+
+// status is 'done', 'failed' or 'reused'
+func (db *dbResult) status() string {
+	switch {
+	case db.failed:
+		return "failed"
+	case db.reused:
+		return "reused"
+	}
+	return "done"
+}
+
+func NewRun(operation string) *Run {
+	return &Run{
+		operation: operation,
+		started:   time.Now(),
+		databases: map[string]*dbResult{},
+	}
+}
+
+// SetProgress exposes live progress of databases while they're processed
+func (r *Run) SetProgress(p *xutil.Progress) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = p
+}
+
+// DatabaseDone records the result of a database, bytes is the size of its dump
+func (r *Run) DatabaseDone(dbname string, bytes int64, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.databases[dbname] = &dbResult{bytes: bytes, duration: duration, failed: err != nil}
+}
+
+// DatabaseReused records a database completed by a previous run (dump --resume), with its recorded size and duration
+func (r *Run) DatabaseReused(dbname string, bytes int64, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.databases[dbname] = &dbResult{bytes: bytes, duration: duration, reused: true}
+}
+
+// Describe is not used, metrics are unchecked (their set depends on databases)
+func (r *Run) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (r *Run) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	progress := r.progress
+	running := r.finished.IsZero()
+	elapsed := time.Since(r.started)
+	if !running {
+		elapsed = r.finished.Sub(r.started)
+	}
+	r.collectDatabases(ch)
+	r.mu.Unlock()
+
+	gauge(ch, runningDesc, boolValue(running), r.operation)
+	gauge(ch, elapsedDesc, elapsed.Seconds(), r.operation)
+	if progress == nil || !running {
+		return
+	}
+
+	s := progress.Snapshot()
+	gauge(ch, databasesDesc, float64(s.Databases), r.operation)
+	gauge(ch, finishedDesc, float64(s.Finished), r.operation)
+	gauge(ch, totalBytesDesc, float64(s.TotalBytes), r.operation)
+	gauge(ch, processedBytesDesc, float64(s.ProcessedBytes), r.operation)
+	gauge(ch, progressDesc, s.Percent/100, r.operation)
+	gauge(ch, throughputDesc, s.BytesPerSec, r.operation)
+	gauge(ch, etaDesc, s.ETA.Seconds(), r.operation)
+	for _, db := range s.Running {
+		gauge(ch, dbProgressDesc, db.Percent/100, r.operation, db.DatName)
+		if db.WrittenBytes >= 0 {
+			gauge(ch, dbWrittenBytesDesc, float64(db.WrittenBytes), r.operation, db.DatName)
+		}
+		gauge(ch, dbTablesDesc, float64(db.Tables), r.operation, db.DatName)
+		gauge(ch, dbTablesDoneDesc, float64(db.TablesDone), r.operation, db.DatName)
+		gauge(ch, dbJobsDesc, float64(db.Jobs), r.operation, db.DatName)
+		gauge(ch, dbElapsedDesc, db.Elapsed.Seconds(), r.operation, db.DatName)
+	}
+}
+
+func (r *Run) collectDatabases(ch chan<- prometheus.Metric) {
+	for dbname, db := range r.databases {
+		status := db.status()
+		if !db.failed {
+			gauge(ch, dbBytesDesc, float64(db.bytes), r.operation, dbname, status)
+		}
+		gauge(ch, dbDurationDesc, db.duration.Seconds(), r.operation, dbname, status)
+		gauge(ch, dbSuccessDesc, boolValue(!db.failed), r.operation, dbname, status)
+	}
+}
+
+func (r *Run) failures() int {
+	n := 0
+	for _, db := range r.databases {
+		if db.failed {
+			n++
+		}
+	}
+	return n
+}
+
+// Handler renders live metrics in the Prometheus text format
+func (r *Run) Handler() (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(r); err != nil {
+		return nil, err
+	}
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), nil
+}
+
+// Serve exposes live metrics on http://<addr>/metrics until the returned func is called
+func (r *Run) Serve(addr string) (stop func(), err error) {
+	if r == nil || addr == "" {
+		return func() {}, nil
+	}
+	handler, err := r.Handler()
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen metrics: %w", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("metrics", slog.String("err-serve", err.Error()))
+		}
+	}()
+	slog.Info("metrics", slog.String("listen", ln.Addr().String()))
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("metrics", slog.String("err-shutdown", err.Error()))
+		}
+	}, nil
+}
+
+// WriteTextfile finishes the run, and writes its results for node_exporter's textfile collector.
+// The file is replaced atomically. When the run failed, the last success time is kept from the previous file.
+func (r *Run) WriteTextfile(path string, runErr error) error {
+	if r == nil || path == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finished = time.Now()
+
+	lastSuccess, ok := readLastSuccess(path, r.operation)
+	if runErr == nil {
+		lastSuccess, ok = float64(r.finished.Unix()), true
+	}
+
+	results := &textfile{run: r, runErr: runErr, lastSuccess: lastSuccess, hasLastSuccess: ok}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(results); err != nil {
+		return err
+	}
+	return prometheus.WriteToTextfile(path, reg)
+}
+
+// textfile collects results of a finished run, Run is locked by WriteTextfile
+type textfile struct {
+	run            *Run
+	runErr         error
+	lastSuccess    float64
+	hasLastSuccess bool
+}
+
+func (t *textfile) Describe(chan<- *prometheus.Desc) {}
+
+func (t *textfile) Collect(ch chan<- prometheus.Metric) {
+	r := t.run
+	gauge(ch, lastRunDesc, float64(r.finished.Unix()), r.operation)
+	if t.hasLastSuccess {
+		gauge(ch, lastSuccessDesc, t.lastSuccess, r.operation)
+	}
+	gauge(ch, lastResultDesc, boolValue(t.runErr == nil), r.operation)
+	gauge(ch, durationDesc, r.finished.Sub(r.started).Seconds(), r.operation)
+	gauge(ch, failuresDesc, float64(r.failures()), r.operation)
+	r.collectDatabases(ch)
+}
+
+// readLastSuccess finds the last success time of the operation in the textfile written before
+func readLastSuccess(path, operation string) (float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	prefix := fmt.Sprintf("%s{operation=%q} ", lastSuccessName, operation)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), prefix)
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+func gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgdump_each_dump.prom")
+
+	ok := NewRun("dump")
+	ok.DatabaseDone("db1", 1024, 2*time.Second, nil)
+	ok.DatabaseReused("db2", 2048, 3*time.Second)
+	require.NoError(t, ok.WriteTextfile(path, nil))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	out := string(data)
+	assert.Contains(t, out, `pgdump_each_last_run_success{operation="dump"} 1`)
+	assert.Contains(t, out, `pgdump_each_database_bytes{dbname="db1",operation="dump",status="done"} 1024`)
+	assert.Contains(t, out, `pgdump_each_database_duration_seconds{dbname="db1",operation="dump",status="done"} 2`)
+	// a dump reused by --resume is a part of the backup too
+	assert.Contains(t, out, `pgdump_each_database_bytes{dbname="db2",operation="dump",status="reused"} 2048`)
+	assert.Contains(t, out, `pgdump_each_database_success{dbname="db2",operation="dump",status="reused"} 1`)
+	lastSuccess, found := readLastSuccess(path, "dump")
+	require.True(t, found)
+	assert.InDelta(t, float64(time.Now().Unix()), lastSuccess, 5)
+
+	// a failed run keeps the last success time of the previous one
+	failed := NewRun("dump")
+	failed.DatabaseDone("db1", 0, time.Second, errors.New("pg_dump failed"))
+	require.NoError(t, failed.WriteTextfile(path, errors.New("pg_dump failed")))
+
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	out = string(data)
+	assert.Contains(t, out, `pgdump_each_last_run_success{operation="dump"} 0`)
+	assert.Contains(t, out, `pgdump_each_last_run_failed_databases{operation="dump"} 1`)
+	assert.Contains(t, out, `pgdump_each_database_success{dbname="db1",operation="dump",status="failed"} 0`)
+	assert.NotContains(t, out, `pgdump_each_database_bytes`)
+	kept, found := readLastSuccess(path, "dump")
+	require.True(t, found)
+	assert.Equal(t, lastSuccess, kept)
+
+	// the previous file of another operation is not trusted
+	_, found = readLastSuccess(path, "restore")
+	assert.False(t, found)
+}
+
+func TestHandler(t *testing.T) {
+	run := NewRun("restore")
+	progress := xutil.NewProgress("restore", []*xutil.DBInfo{{DatName: "db1", SizeBytes: 100}})
+	progress.Track("db1", &xutil.DBInfo{SizeBytes: 100, Tables: &xutil.TableStats{Count: 10}}, 2, nil)
+	run.SetProgress(progress)
+
+	handler, err := run.Handler()
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	out := rec.Body.String()
+	assert.Contains(t, out, `pgdump_each_running{operation="restore"} 1`)
+	assert.Contains(t, out, `pgdump_each_databases{operation="restore"} 1`)
+	assert.Contains(t, out, `pgdump_each_database_tables{dbname="db1",operation="restore"} 10`)
+	assert.Contains(t, out, `pgdump_each_database_jobs{dbname="db1",operation="restore"} 2`)
+	// restore writes nothing locally
+	assert.NotContains(t, out, `pgdump_each_database_written_bytes`)
+}
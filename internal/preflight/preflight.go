@@ -0,0 +1,377 @@
+package preflight
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	LevelOK       = "ok"
+	LevelWarning  = "warning"
+	LevelBlocking = "blocking"
+)
+
+type PreflightContext struct {
+	SourceConnStr string
+	TargetConnStr string
+	PgBinPath     string
+	// OutputDir is where the dump will be stored, its free space is checked (optional)
+	OutputDir string
+	Filter    xutil.DBFilter
+	// ReportPath is a file to save JSON report to (optional)
+	ReportPath string
+}
+
+type Report struct {
+	Blocking int        `json:"blocking"`
+	Warnings int        `json:"warnings"`
+	Findings []*Finding `json:"findings"`
+}
+
+type Finding struct {
+	Level   string `json:"level"`
+	Check   string `json:"check"`
+	DatName string `json:"datname,omitempty"`
+	Message string `json:"message"`
+}
+
+// clusterInfo is what checks need to know about a cluster
+type clusterInfo struct {
+	databases []*xutil.DBInfo
+}
+
+func (r *Report) add(level, check, datname, message string) {
+	r.Findings = append(r.Findings, &Finding{
+		Level:   level,
+		Check:   check,
+		DatName: datname,
+		Message: message,
+	})
+	switch level {
+	case LevelBlocking:
+		r.Blocking++
+	case LevelWarning:
+		r.Warnings++
+	}
+}
+
+// RunPreflight checks whether the source cluster may be migrated into the target one.
+// An error is returned if there are blocking findings.
+func RunPreflight(ctx context.Context, preflightContext *PreflightContext) (*Report, error) {
+	if err := preflightContext.Filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	source, err := getClusterInfo(ctx, preflightContext.SourceConnStr)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	target, err := getClusterInfo(ctx, preflightContext.TargetConnStr)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	selected, _ := preflightContext.Filter.Split(source.databases)
+
+	report := &Report{Findings: []*Finding{}}
+	checkTargetEmpty(report, target)
+	checkBinaries(ctx, report, preflightContext)
+	checkDiskSpace(report, preflightContext, selected)
+
+	checks := []func(ctx context.Context, report *Report, preflightContext *PreflightContext, selected []*xutil.DBInfo) error{
+		checkExtensions,
+		checkTablespaces,
+		checkCollations,
+	}
+	for _, check := range checks {
+		if err := check(ctx, report, preflightContext, selected); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Info("preflight",
+		slog.Int("blocking", report.Blocking),
+		slog.Int("warnings", report.Warnings),
+	)
+
+	if preflightContext.ReportPath != "" {
+		if err := writeReport(preflightContext.ReportPath, report); err != nil {
+			return report, err
+		}
+	}
+	if report.Blocking > 0 {
+		return report, fmt.Errorf("preflight failed: %d blocking finding(s)", report.Blocking)
+	}
+	return report, nil
+}
+
+func getClusterInfo(ctx context.Context, connStr string) (*clusterInfo, error) {
+	databases, err := xutil.GetDatabases(ctx, connStr)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterInfo{databases: databases}, nil
+}
+
+// checkTargetEmpty applies the same rule as restore does
+func checkTargetEmpty(report *Report, target *clusterInfo) {
+	const check = "target-empty"
+	existing, _ := (&xutil.DBFilter{}).Split(target.databases)
+	if len(existing) == 0 {
+		report.add(LevelOK, check, "", "target cluster has no user databases")
+		return
+	}
+	for _, db := range existing {
+		report.add(LevelBlocking, check, db.DatName, "database already exists in target cluster")
+	}
+}
+
+// checkBinaries resolves client tools the same way dump and restore do: pg_dump/pg_dumpall for the source,
+// pg_restore/psql for the target (from PgBinPath, or discovered installations)
+func checkBinaries(ctx context.Context, report *Report, preflightContext *PreflightContext) {
+	const check = "client-binaries"
+
+	for _, b := range []struct {
+		connStr string
+		binSet  *xutil.BinSet
+	}{
+		{connStr: preflightContext.SourceConnStr, binSet: xutil.DumpBinaries},
+		{connStr: preflightContext.TargetConnStr, binSet: xutil.RestoreBinaries},
+	} {
+		pgBinPath, err := xutil.ResolvePgBinPath(ctx, b.connStr, preflightContext.PgBinPath, b.binSet)
+		if err != nil {
+			report.add(LevelBlocking, check, "", err.Error())
+			continue
+		}
+		for _, bin := range b.binSet.Bins {
+			versionOutput, err := xutil.GetExecVersion(pgBinPath, bin)
+			if err != nil {
+				report.add(LevelBlocking, check, "", fmt.Sprintf("%s: %v", bin, err))
+				continue
+			}
+			report.add(LevelOK, check, "", versionOutput)
+		}
+	}
+}
+
+// checkDiskSpace compares free space of the output dir with the estimated dump size (total size of databases)
+func checkDiskSpace(report *Report, preflightContext *PreflightContext, selected []*xutil.DBInfo) {
+	const check = "disk-space"
+	if preflightContext.OutputDir == "" {
+		report.add(LevelWarning, check, "", "skipped, --output is not set")
+		return
+	}
+
+	var estimated int64
+	for _, db := range selected {
+		estimated += db.SizeBytes
+	}
+	free, err := xutil.FreeDiskSpace(preflightContext.OutputDir)
+	if err != nil {
+		report.add(LevelBlocking, check, "", fmt.Sprintf("cannot get free space of %s: %v", preflightContext.OutputDir, err))
+		return
+	}
+
+	message := fmt.Sprintf("free %s, estimated dump size %s", xutil.ByteCountIEC(free), xutil.ByteCountIEC(estimated))
+	if free < estimated {
+		report.add(LevelBlocking, check, "", message)
+		return
+	}
+	report.add(LevelOK, check, "", message)
+}
+
+// checkExtensions ensures every extension installed in source databases is available in target
+func checkExtensions(ctx context.Context, report *Report, preflightContext *PreflightContext, selected []*xutil.DBInfo) error {
+	const check = "extensions"
+
+	available, err := queryStrings(ctx, preflightContext.TargetConnStr, `select name from pg_available_extensions`)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+
+	for _, db := range selected {
+		dbConnStr, err := xutil.ConnStrWithDB(preflightContext.SourceConnStr, db.DatName)
+		if err != nil {
+			return err
+		}
+		installed, err := queryStrings(ctx, dbConnStr, `select extname from pg_extension`)
+		if err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+		ok := true
+		for _, ext := range sortedKeys(installed) {
+			if !available[ext] {
+				ok = false
+				report.add(LevelBlocking, check, db.DatName, fmt.Sprintf("extension %s is not available in target", ext))
+			}
+		}
+		if ok {
+			report.add(LevelOK, check, db.DatName, fmt.Sprintf("%d extension(s) available", len(installed)))
+		}
+	}
+	return nil
+}
+
+// checkTablespaces reports tablespaces missing in target, they are created by globals.sql,
+// but their locations must exist on the target host.
+func checkTablespaces(ctx context.Context, report *Report, preflightContext *PreflightContext, _ []*xutil.DBInfo) error {
+	const check = "tablespaces"
+
+	q := `select spcname || '=' || pg_tablespace_location(oid)
+	      from pg_tablespace
+	      where spcname not in ('pg_default', 'pg_global')`
+
+	source, err := queryStrings(ctx, preflightContext.SourceConnStr, q)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	target, err := queryStrings(ctx, preflightContext.TargetConnStr, q)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+
+	for _, spc := range sortedKeys(source) {
+		if !target[spc] {
+			report.add(LevelWarning, check, "", fmt.Sprintf("tablespace %s does not exist in target, its location must exist on target host", spc))
+		}
+	}
+	if len(source) == 0 {
+		report.add(LevelOK, check, "", "no custom tablespaces")
+	}
+	return nil
+}
+
+// checkCollations ensures that locales of source databases are available in target
+func checkCollations(ctx context.Context, report *Report, preflightContext *PreflightContext, selected []*xutil.DBInfo) error {
+	available, err := queryStrings(ctx, preflightContext.TargetConnStr, `
+	select collcollate from pg_collation where collcollate is not null
+	union
+	select collname from pg_collation
+	union
+	select unnest(array['C', 'POSIX'])`)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+
+	conn, err := pgx.Connect(ctx, preflightContext.SourceConnStr)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	for _, db := range selected {
+		var collate, ctype string
+		err := conn.QueryRow(ctx, `select datcollate, datctype from pg_database where datname = $1`, db.DatName).Scan(&collate, &ctype)
+		if err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+		checkLocales(report, db.DatName, collate, ctype, available)
+	}
+	return nil
+}
+
+// checkLocales reports whether collate and ctype of the source database are available in the target.
+// A locale installed under another spelling of the codeset (en_US.UTF-8 and en_US.utf8) is the same locale.
+func checkLocales(report *Report, datname, collate, ctype string, available map[string]bool) {
+	const check = "locales"
+
+	normalized := make(map[string]string, len(available))
+	for locale := range available {
+		normalized[normalizeLocale(locale)] = locale
+	}
+	ok := true
+	for _, locale := range []string{collate, ctype} {
+		if available[locale] {
+			continue
+		}
+		if installed, found := normalized[normalizeLocale(locale)]; found {
+			report.add(LevelWarning, check, datname, fmt.Sprintf("locale %s is available in target as %s", locale, installed))
+			ok = false
+			continue
+		}
+		ok = false
+		report.add(LevelBlocking, check, datname, fmt.Sprintf("locale %s is not available in target", locale))
+	}
+	if ok {
+		report.add(LevelOK, check, datname, fmt.Sprintf("collate %s, ctype %s", collate, ctype))
+	}
+}
+
+// normalizeLocale normalizes the codeset of language_territory.codeset@modifier the way glibc does:
+// lowercase, without '-' (UTF-8 -> utf8)
+func normalizeLocale(locale string) string {
+	name, codeset, ok := strings.Cut(locale, ".")
+	if !ok {
+		return locale
+	}
+	codeset, modifier, hasModifier := strings.Cut(codeset, "@")
+	codeset = strings.ToLower(strings.ReplaceAll(codeset, "-", ""))
+	if hasModifier {
+		return name + "." + codeset + "@" + modifier
+	}
+	return name + "." + codeset
+}
+
+func queryStrings(ctx context.Context, connStr, query string) (map[string]bool, error) {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string]bool{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result[s] = true
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return result, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeReport(path string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// PrintReport renders findings as a human-readable table.
+func PrintReport(w io.Writer, report *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LEVEL\tCHECK\tDATABASE\tMESSAGE")
+	for _, f := range report.Findings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Level, f.Check, f.DatName, f.Message)
+	}
+	fmt.Fprintf(tw, "\nblocking: %d, warnings: %d\n", report.Blocking, report.Warnings)
+	return tw.Flush()
+}
@@ -0,0 +1,68 @@
+package preflight
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTargetEmpty(t *testing.T) {
+	report := &Report{}
+	checkTargetEmpty(report, &clusterInfo{databases: []*xutil.DBInfo{{DatName: "postgres"}}})
+	assert.Equal(t, 0, report.Blocking)
+
+	report = &Report{}
+	checkTargetEmpty(report, &clusterInfo{databases: []*xutil.DBInfo{{DatName: "postgres"}, {DatName: "d1"}}})
+	assert.Equal(t, 1, report.Blocking)
+	assert.Equal(t, "d1", report.Findings[0].DatName)
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	report := &Report{}
+	checkDiskSpace(report, &PreflightContext{}, nil)
+	assert.Equal(t, 1, report.Warnings)
+
+	report = &Report{}
+	checkDiskSpace(report, &PreflightContext{OutputDir: t.TempDir()}, []*xutil.DBInfo{{DatName: "d1", SizeBytes: 1 << 62}})
+	assert.Equal(t, 1, report.Blocking)
+}
+
+func TestCheckLocales(t *testing.T) {
+	available := map[string]bool{"C": true, "POSIX": true, "en_US.utf8": true, "de_DE.iso88591@euro": true, "ru_RU": true}
+
+	for _, tt := range []struct {
+		locale string
+		level  string
+	}{
+		{locale: "C", level: LevelOK},
+		{locale: "en_US.utf8", level: LevelOK},
+		{locale: "en_US.UTF-8", level: LevelWarning},
+		{locale: "en_US.Utf8", level: LevelWarning},
+		{locale: "de_DE.ISO-8859-1@euro", level: LevelWarning},
+		{locale: "ru_RU", level: LevelOK},
+		{locale: "ru_RU.UTF-8", level: LevelBlocking},
+		{locale: "en_GB.UTF-8", level: LevelBlocking},
+		{locale: "en_us.utf8", level: LevelBlocking},
+	} {
+		t.Run(tt.locale, func(t *testing.T) {
+			report := &Report{}
+			checkLocales(report, "d1", tt.locale, tt.locale, available)
+			require.NotEmpty(t, report.Findings)
+			assert.Equal(t, tt.level, report.Findings[0].Level)
+		})
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	report := &Report{}
+	report.add(LevelBlocking, "extensions", "d1", "extension postgis is not available in target")
+	report.add(LevelWarning, "disk-space", "", "skipped, --output is not set")
+
+	var buf bytes.Buffer
+	require.NoError(t, PrintReport(&buf, report))
+	assert.Contains(t, buf.String(), "extension postgis is not available in target")
+	assert.Contains(t, buf.String(), "blocking: 1, warnings: 1")
+}
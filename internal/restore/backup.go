@@ -0,0 +1,245 @@
+package restore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// backup gives access to files of a backup, kept in a local dir or in a remote storage.
+// Remote files are fetched into a work dir on demand (one database at a time), and verified against checksums.txt.
+// Encrypted files are decrypted into a separate dir only after their ciphertext is verified.
+type backup struct {
+	st        storage.Storage
+	prefix    string
+	localDir  string
+	checksums *xutil.ChecksumsList
+	workers   int
+
+	identities []age.Identity
+	plainDir   string
+}
+
+func openBackup(ctx context.Context, restoreContext *ClusterRestoreContext) (*backup, error) {
+	st, prefix, err := storage.Open(restoreContext.InputDir, &restoreContext.StorageOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var verifyKey ed25519.PublicKey
+	if restoreContext.VerifyKey != "" {
+		verifyKey, err = sign.LoadPublicKey(restoreContext.VerifyKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if st.IsLocal() {
+		// everything is verified up front, checksums are trusted only if they're signed by the key
+		if err := verifySignature(filepath.Join(restoreContext.InputDir, xutil.ChecksumsFileName), verifyKey); err != nil {
+			return nil, err
+		}
+		// it takes as long as reading the whole backup, dry-run leaves it to the restore itself
+		if restoreContext.dryRun {
+			slog.Info("restore", slog.String("checksums", "skipped (dry-run)"))
+		} else if err := xutil.CompareChecksums(restoreContext.InputDir, restoreContext.ChecksumWorkers); err != nil {
+			return nil, err
+		}
+		return &backup{st: st, prefix: prefix, localDir: restoreContext.InputDir, workers: restoreContext.ChecksumWorkers}, nil
+	}
+
+	workDir, err := os.MkdirTemp(restoreContext.WorkDir, "pgdump-each-restore-")
+	if err != nil {
+		return nil, err
+	}
+	b := &backup{st: st, prefix: prefix, localDir: workDir, workers: restoreContext.ChecksumWorkers}
+
+	// checksums.txt is uploaded last, a backup without it is incomplete
+	checksumsPath := filepath.Join(workDir, xutil.ChecksumsFileName)
+	if err := storage.DownloadFile(ctx, st, storage.Join(prefix, xutil.ChecksumsFileName), checksumsPath); err != nil {
+		b.close()
+		return nil, fmt.Errorf("backup not found or incomplete: %w", err)
+	}
+	if verifyKey != nil {
+		sigName := xutil.ChecksumsSignatureFileName
+		if err := storage.DownloadFile(ctx, st, storage.Join(prefix, sigName), filepath.Join(workDir, sigName)); err != nil {
+			b.close()
+			return nil, fmt.Errorf("backup is not signed: %w", err)
+		}
+		if err := verifySignature(checksumsPath, verifyKey); err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	b.checksums, err = xutil.ReadChecksumsFile(checksumsPath)
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+
+	// small files in the backup root (globals, manifest, etc...) are fetched right away
+	for rel := range b.checksums.Sums {
+		if strings.Contains(rel, "/") {
+			continue
+		}
+		if _, err := b.fetch(ctx, rel); err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// enableDecryption is required for backups with encryption recorded in the manifest
+func (b *backup) enableDecryption(restoreContext *ClusterRestoreContext) error {
+	if len(restoreContext.DecryptIdentities) == 0 {
+		return fmt.Errorf("backup is encrypted, --decrypt-identity is required")
+	}
+	identities, err := crypt.LoadIdentities(restoreContext.DecryptIdentities)
+	if err != nil {
+		return err
+	}
+	plainDir, err := os.MkdirTemp(restoreContext.WorkDir, "pgdump-each-decrypt-")
+	if err != nil {
+		return err
+	}
+	b.identities = identities
+	b.plainDir = plainDir
+	return nil
+}
+
+func (b *backup) encrypted() bool {
+	return b.identities != nil
+}
+
+func (b *backup) remote() bool {
+	return !b.st.IsLocal()
+}
+
+// dumps lists '<dbname>.dmp' dirs of the backup
+func (b *backup) dumps(ctx context.Context) ([]*xutil.DBInfo, error) {
+	if b.remote() {
+		return xutil.GetDumpsInStorage(ctx, b.st, b.prefix)
+	}
+	return xutil.GetDumpsInDir(b.localDir)
+}
+
+// verifySignature checks checksums.txt against its detached signature, it's a no-op without the key
+func verifySignature(checksumsPath string, key ed25519.PublicKey) error {
+	if key == nil {
+		return nil
+	}
+	if err := sign.VerifyFile(checksumsPath, key); err != nil {
+		return fmt.Errorf("%s: %w", xutil.ChecksumsFileName, err)
+	}
+	slog.Info("restore", slog.String("status", "signature-verified"))
+	return nil
+}
+
+// fetch returns a local path of a file or a dir of the backup (relative to the backup root)
+func (b *backup) fetch(ctx context.Context, rel string) (string, error) {
+	localPath := filepath.Join(b.localDir, filepath.FromSlash(rel))
+	if !b.remote() {
+		return localPath, nil
+	}
+
+	key := storage.Join(b.prefix, rel)
+	var err error
+	if _, isFile := b.checksums.Sums[rel]; isFile {
+		err = storage.DownloadFile(ctx, b.st, key, localPath)
+	} else {
+		err = storage.DownloadDir(ctx, b.st, key, localPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := xutil.CompareChecksumsPrefix(b.localDir, b.checksums, rel, b.workers); err != nil {
+		return "", fmt.Errorf("%s: %w", rel, err)
+	}
+	slog.Info("restore",
+		slog.String("status", "fetched"),
+		slog.String("path", key),
+	)
+	return localPath, nil
+}
+
+// openFile returns a local path of a plaintext file of the backup (relative to the backup root)
+func (b *backup) openFile(ctx context.Context, rel string) (string, error) {
+	if !b.encrypted() {
+		return b.fetch(ctx, rel)
+	}
+	src, err := b.fetch(ctx, rel+crypt.Suffix)
+	if err != nil {
+		return "", err
+	}
+	dst := b.plainPath(rel)
+	if err := crypt.DecryptFile(src, dst, b.identities); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// openDir returns a local path of a plaintext dir of the backup (relative to the backup root)
+func (b *backup) openDir(ctx context.Context, rel string) (string, error) {
+	src, err := b.fetch(ctx, rel)
+	if err != nil || !b.encrypted() {
+		return src, err
+	}
+	dst := b.plainPath(rel)
+	if err := crypt.DecryptDir(src, dst, b.identities); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// plainPath returns a local path of a plaintext file or dir of the backup, as returned by openFile and openDir
+func (b *backup) plainPath(rel string) string {
+	if b.encrypted() {
+		return filepath.Join(b.plainDir, filepath.FromSlash(rel))
+	}
+	return filepath.Join(b.localDir, filepath.FromSlash(rel))
+}
+
+// release removes local copies of a fetched (and decrypted) file or dir
+func (b *backup) release(rel string) {
+	var paths []string
+	if b.remote() {
+		paths = append(paths,
+			filepath.Join(b.localDir, filepath.FromSlash(rel)),
+			filepath.Join(b.localDir, filepath.FromSlash(rel+crypt.Suffix)),
+		)
+	}
+	if b.encrypted() {
+		paths = append(paths, filepath.Join(b.plainDir, filepath.FromSlash(rel)))
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("restore", slog.String("err-cleanup", err.Error()))
+		}
+	}
+}
+
+func (b *backup) close() {
+	var paths []string
+	if b.remote() {
+		paths = append(paths, b.localDir)
+	}
+	if b.encrypted() {
+		paths = append(paths, b.plainDir)
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("restore", slog.String("err-cleanup", err.Error()))
+		}
+	}
+}
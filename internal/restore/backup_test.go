@@ -0,0 +1,54 @@
+package restore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenBackupSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "signing.pub")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0o600))
+
+	ctx := context.Background()
+	backupDir := filepath.Join(t.TempDir(), "20250328154501.dmp")
+	require.NoError(t, os.MkdirAll(filepath.Join(backupDir, "d1.dmp"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "d1.dmp", "toc.dat"), []byte("toc"), 0o600))
+	require.NoError(t, xutil.WriteChecksumsFile(backupDir, 2, ""))
+	restoreContext := &ClusterRestoreContext{InputDir: backupDir, VerifyKey: keyPath}
+
+	_, err = openBackup(ctx, restoreContext)
+	assert.ErrorContains(t, err, "backup is not signed")
+
+	checksumsPath := filepath.Join(backupDir, xutil.ChecksumsFileName)
+	require.NoError(t, sign.SignFile(checksumsPath, privateKey))
+	b, err := openBackup(ctx, restoreContext)
+	require.NoError(t, err)
+	b.close()
+
+	// checksums are regenerated after tampering, they match, but the signature does not
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "d1.dmp", "toc.dat"), []byte("tampered"), 0o600))
+	require.NoError(t, xutil.WriteChecksumsFile(backupDir, 2, ""))
+	_, err = openBackup(ctx, restoreContext)
+	assert.ErrorIs(t, err, sign.ErrInvalidSignature)
+
+	// without the key checksums are trusted as is
+	restoreContext.VerifyKey = ""
+	b, err = openBackup(ctx, restoreContext)
+	require.NoError(t, err)
+	b.close()
+}
@@ -0,0 +1,170 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// Policies of restoring a database that already exists in the target cluster (--on-conflict).
+// Without a policy, the target cluster must be empty.
+const (
+	ConflictFail = "fail"
+	ConflictSkip = "skip"
+	// ConflictDrop drops the existing database, it requires ConfirmDrop
+	ConflictDrop = "drop"
+	// ConflictRename renames the existing database to '<dbname>_<timestamp>', and restores the dump in its place
+	ConflictRename = "rename"
+)
+
+// maxIdentifierLen is NAMEDATALEN-1 of PostgreSQL
+const maxIdentifierLen = 63
+
+func validateConflictPolicy(restoreContext *ClusterRestoreContext) error {
+	switch restoreContext.OnConflict {
+	case "", ConflictFail, ConflictSkip, ConflictRename:
+		return nil
+	case ConflictDrop:
+		if !restoreContext.ConfirmDrop {
+			return fmt.Errorf("--on-conflict=%s drops existing databases, it requires --confirm-drop", ConflictDrop)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy: %s (expected: %s, %s, %s or %s)",
+			restoreContext.OnConflict, ConflictFail, ConflictSkip, ConflictDrop, ConflictRename)
+	}
+}
+
+// findConflicts returns databases of the target cluster that have dumps to restore (under their target names).
+// The 'postgres' database is never a conflict, it's always restored into the existing one.
+func findConflicts(restoreContext *ClusterRestoreContext, dirs, existing []*xutil.DBInfo) []*xutil.DBInfo {
+	byName := make(map[string]*xutil.DBInfo, len(existing))
+	for _, db := range existing {
+		byName[db.DatName] = db
+	}
+	var conflicts []*xutil.DBInfo
+	for _, dir := range dirs {
+		dbname := restoreContext.dumpTargetName(dir.DatName)
+		if db, ok := byName[dbname]; ok && dbname != xutil.PostgresDB {
+			conflicts = append(conflicts, db)
+		}
+	}
+	return conflicts
+}
+
+// splitByState separates databases restored by the previous run (known to the state) from other ones
+func splitByState(state *restoreState, databases []*xutil.DBInfo) (known, unknown []*xutil.DBInfo) {
+	for _, db := range databases {
+		if _, ok := state.Databases[db.DatName]; ok {
+			known = append(known, db)
+		} else {
+			unknown = append(unknown, db)
+		}
+	}
+	return known, unknown
+}
+
+// resolveConflicts applies the policy to conflicting databases, and returns dumps to restore
+func resolveConflicts(
+	ctx context.Context,
+	restoreContext *ClusterRestoreContext,
+	dirs []*xutil.DBInfo,
+	conflicts []*xutil.DBInfo,
+) ([]*xutil.DBInfo, error) {
+	if len(conflicts) == 0 {
+		return dirs, nil
+	}
+	names := make([]string, 0, len(conflicts))
+	for _, db := range conflicts {
+		names = append(names, db.DatName)
+	}
+
+	switch restoreContext.OnConflict {
+	case ConflictSkip:
+		skipped := make(map[string]bool, len(names))
+		for _, dbname := range names {
+			skipped[dbname] = true
+			slog.Info("restore",
+				slog.String("status", "skip-exists"),
+				slog.String("dbname", dbname),
+			)
+		}
+		var pending []*xutil.DBInfo
+		for _, dir := range dirs {
+			if !skipped[restoreContext.dumpTargetName(dir.DatName)] {
+				pending = append(pending, dir)
+			}
+		}
+		return pending, nil
+
+	case ConflictDrop:
+		for _, dbname := range names {
+			if err := xutil.DropDatabase(ctx, restoreContext.ConnStr, dbname); err != nil {
+				return nil, err
+			}
+			slog.Warn("restore",
+				slog.String("status", "dropped-existing"),
+				slog.String("dbname", dbname),
+			)
+		}
+		return dirs, nil
+
+	case ConflictRename:
+		suffix := "_" + time.Now().Format("20060102150405")
+		for _, dbname := range names {
+			newName := renamedDatabase(dbname, suffix)
+			if err := xutil.RenameDatabase(ctx, restoreContext.ConnStr, dbname, newName); err != nil {
+				return nil, err
+			}
+			slog.Info("restore",
+				slog.String("status", "renamed-existing"),
+				slog.String("dbname", dbname),
+				slog.String("renamed-to", newName),
+			)
+		}
+		return dirs, nil
+
+	default:
+		return nil, conflictsError(names)
+	}
+}
+
+// planConflicts returns plan statuses of conflicting databases, nothing is changed
+func planConflicts(restoreContext *ClusterRestoreContext, conflicts []*xutil.DBInfo) (map[string]string, error) {
+	statuses := make(map[string]string, len(conflicts))
+	var names []string
+	for _, db := range conflicts {
+		names = append(names, db.DatName)
+		switch restoreContext.OnConflict {
+		case ConflictSkip:
+			statuses[db.DatName] = xutil.PlanStatusSkipExists
+		case ConflictDrop:
+			statuses[db.DatName] = xutil.PlanStatusDropExisting
+		case ConflictRename:
+			statuses[db.DatName] = xutil.PlanStatusRenameExisting
+		}
+	}
+	if len(names) > 0 && len(statuses) == 0 {
+		return nil, conflictsError(names)
+	}
+	return statuses, nil
+}
+
+func conflictsError(names []string) error {
+	return fmt.Errorf("databases already exist in target cluster: %s (see --on-conflict)", strings.Join(names, ", "))
+}
+
+// renamedDatabase appends the suffix to the name, the name is truncated to fit into an identifier
+func renamedDatabase(dbname, suffix string) string {
+	name := dbname
+	for len(name)+len(suffix) > maxIdentifierLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name + suffix
+}
@@ -0,0 +1,131 @@
+package restore
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConflictPolicy(t *testing.T) {
+	assert.NoError(t, validateConflictPolicy(&ClusterRestoreContext{}))
+	assert.NoError(t, validateConflictPolicy(&ClusterRestoreContext{OnConflict: ConflictRename}))
+	assert.ErrorContains(t, validateConflictPolicy(&ClusterRestoreContext{OnConflict: "merge"}), "unknown conflict policy")
+	assert.ErrorContains(t, validateConflictPolicy(&ClusterRestoreContext{OnConflict: ConflictDrop}), "--confirm-drop")
+	assert.NoError(t, validateConflictPolicy(&ClusterRestoreContext{OnConflict: ConflictDrop, ConfirmDrop: true}))
+}
+
+func TestResolveConflicts(t *testing.T) {
+	dirs := []*xutil.DBInfo{
+		{DatName: "/backup/dumps/postgres.dmp"},
+		{DatName: "/backup/dumps/d1.dmp"},
+		{DatName: "/backup/dumps/d2.dmp"},
+	}
+	existing := []*xutil.DBInfo{{DatName: "postgres"}, {DatName: "d1"}, {DatName: "other"}}
+
+	conflicts := findConflicts(&ClusterRestoreContext{}, dirs, existing)
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, "d1", conflicts[0].DatName)
+
+	_, err := resolveConflicts(context.Background(), &ClusterRestoreContext{OnConflict: ConflictFail}, dirs, conflicts)
+	assert.ErrorContains(t, err, "already exist in target cluster: d1")
+
+	pending, err := resolveConflicts(context.Background(), &ClusterRestoreContext{OnConflict: ConflictSkip}, dirs, conflicts)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "postgres", xutil.DumpDirDBName(pending[0].DatName))
+	assert.Equal(t, "d2", xutil.DumpDirDBName(pending[1].DatName))
+
+	statuses, err := planConflicts(&ClusterRestoreContext{OnConflict: ConflictRename}, conflicts)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"d1": xutil.PlanStatusRenameExisting}, statuses)
+}
+
+func TestRenamedDatabase(t *testing.T) {
+	suffix := "_20250328154501"
+	assert.Equal(t, "d1"+suffix, renamedDatabase("d1", suffix))
+
+	long := renamedDatabase(strings.Repeat("a", 60), suffix)
+	assert.Len(t, long, maxIdentifierLen)
+	assert.True(t, strings.HasSuffix(long, suffix))
+
+	// multibyte names are not cut in the middle of a rune
+	multibyte := renamedDatabase(strings.Repeat("ж", 30), suffix)
+	assert.LessOrEqual(t, len(multibyte), maxIdentifierLen)
+	assert.Equal(t, strings.Repeat("ж", 24)+suffix, multibyte)
+}
+
+func TestRestoredDatabasesSkipExisting(t *testing.T) {
+	restoreContext := &ClusterRestoreContext{
+		InputDir:   t.TempDir(),
+		LogDir:     t.TempDir(),
+		OnConflict: ConflictSkip,
+	}
+	dirs := []*xutil.DBInfo{
+		{DatName: filepath.Join(restoreContext.InputDir, "d1.dmp")},
+		{DatName: filepath.Join(restoreContext.InputDir, "d2.dmp")},
+	}
+	existing := []*xutil.DBInfo{{DatName: "d1"}}
+
+	// a skipped database is neither restored nor verified against the source
+	state, pending, err := prepareState(context.Background(), restoreContext, dirs, existing)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, []string{"d2"}, restoredDatabases(restoreContext, dirs, state))
+
+	// databases restored by the resumed run are verified too
+	require.NoError(t, state.setDatabase("d2", statusDone, nil))
+	restoreContext.Resume = true
+	state, pending, err = prepareState(context.Background(), restoreContext, dirs, []*xutil.DBInfo{{DatName: "d1"}, {DatName: "d2"}})
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Equal(t, []string{"d2"}, restoredDatabases(restoreContext, dirs, state))
+}
+
+func TestGlobalsNonEmptyTarget(t *testing.T) {
+	restoreContext := &ClusterRestoreContext{
+		InputDir:   t.TempDir(),
+		LogDir:     t.TempDir(),
+		OnConflict: ConflictSkip,
+	}
+	require.NoError(t, validateRoles(restoreContext))
+	dirs := []*xutil.DBInfo{{DatName: filepath.Join(restoreContext.InputDir, "d1.dmp")}}
+	existing := []*xutil.DBInfo{{DatName: "other"}}
+
+	// roles and tablespaces of a non-empty target are never dropped by default
+	state, _, err := prepareState(context.Background(), restoreContext, dirs, existing)
+	require.NoError(t, err)
+	assert.Equal(t, statusSkipped, state.Globals)
+	assert.True(t, state.ExistingCluster)
+
+	// the decision is kept on resume
+	restoreContext.Resume = true
+	restoreContext.RestoreGlobals = true
+	state, err = loadState(restoreContext)
+	require.NoError(t, err)
+	assert.Equal(t, statusSkipped, state.Globals)
+
+	// opted in: globals are restored without DROP statements
+	restoreContext.Resume = false
+	state, _, err = prepareState(context.Background(), restoreContext, dirs, existing)
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, state.Globals)
+
+	restoreContext.roles.existingCluster = state.ExistingCluster
+	rewritten := restoreContext.roles.rewriteGlobals(`DROP ROLE IF EXISTS app;
+DROP TABLESPACE IF EXISTS fast;
+CREATE ROLE app;
+`)
+	assert.NotContains(t, rewritten, "DROP")
+	assert.Contains(t, rewritten, "CREATE ROLE app;")
+
+	// an empty target gets globals as they are
+	state, _, err = prepareState(context.Background(), restoreContext, dirs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, state.Globals)
+	assert.False(t, state.ExistingCluster)
+}
@@ -0,0 +1,130 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+// RunRestorePlan reports what RunRestoreJobs would do (--dry-run): the connection, binaries, the target cluster,
+// keys and the backup are checked, dumps are selected and jobs are assigned, but nothing is restored.
+// Checksums of a local backup are not verified here (it's as long as reading the whole backup), see 'verify'.
+func RunRestorePlan(ctx context.Context, restoreContext *ClusterRestoreContext) (*xutil.RunPlan, error) {
+	restoreContext.dryRun = true
+	b, dirs, existing, err := prepareRestore(ctx, restoreContext)
+	if err != nil {
+		return nil, err
+	}
+	defer b.close()
+
+	// on resume, completed databases are skipped, partial ones are dropped and restored again
+	statuses := map[string]string{}
+	globals := globalsStatus(restoreContext, existing)
+	conflicts := findConflicts(restoreContext, dirs, existing)
+	if restoreContext.Resume {
+		state, err := loadState(restoreContext)
+		if err != nil {
+			return nil, err
+		}
+		if restoreContext.OnConflict != "" {
+			existing, conflicts = splitByState(state, conflicts)
+		}
+		for _, db := range existing {
+			if _, ok := state.Databases[db.DatName]; !ok {
+				return nil, fmt.Errorf("cannot resume, unknown database in target cluster: %s", db.DatName)
+			}
+		}
+		for dbname, db := range state.Databases {
+			switch db.Status {
+			case statusDone:
+				statuses[dbname] = xutil.PlanStatusSkipCompleted
+			case statusPending:
+			default:
+				statuses[dbname] = xutil.PlanStatusRerun
+			}
+		}
+		globals = state.Globals
+	}
+	conflictStatuses, err := planConflicts(restoreContext, conflicts)
+	if err != nil {
+		return nil, err
+	}
+	for dbname, status := range conflictStatuses {
+		statuses[dbname] = status
+	}
+
+	psql, err := xutil.GetExec(restoreContext.PgBinPath, "psql")
+	if err != nil {
+		return nil, err
+	}
+	pgRestore, err := xutil.GetExec(restoreContext.PgBinPath, "pg_restore")
+	if err != nil {
+		return nil, err
+	}
+
+	var pending, skipped []*xutil.DBInfo
+	for _, dir := range dirs {
+		switch statuses[restoreContext.dumpTargetName(dir.DatName)] {
+		case xutil.PlanStatusSkipCompleted, xutil.PlanStatusSkipExists:
+			skipped = append(skipped, dir)
+		default:
+			pending = append(pending, dir)
+		}
+	}
+
+	budget := xutil.JobsBudget{ParallelDBS: restoreContext.ParallelDBS, MaxTotalJobs: restoreContext.MaxTotalJobs}
+	plan := &xutil.RunPlan{
+		Source:       restoreContext.InputDir,
+		Target:       xutil.RedactConnStr(restoreContext.ConnStr),
+		Workers:      budget.Workers(),
+		MaxTotalJobs: budget.Total(),
+		Databases:    []*xutil.PlannedDatabase{},
+		Skipped:      []string{},
+		Commands:     []string{},
+	}
+	if globals != statusDone && globals != statusSkipped {
+		plan.Commands = append(plan.Commands, xutil.CommandLine(psql, psqlGlobalsArgs(restoreContext, b.plainPath("globals.sql"))))
+	}
+	allDirs, err := b.dumps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range allDirs {
+		if dbname := xutil.DumpDirDBName(dir.DatName); !restoreContext.Filter.Match(dbname) {
+			plan.Skipped = append(plan.Skipped, dbname)
+		}
+	}
+
+	for _, p := range xutil.NewJobsScheduler(pending, budget).Plan() {
+		datName := xutil.DumpDirDBName(p.DatName)
+		target := restoreContext.targetName(datName)
+		status := statuses[target]
+		if status == "" {
+			status = xutil.PlanStatusRun
+		}
+		args, err := pgRestoreArgs(restoreContext, datName, b.plainPath(datName+".dmp"), p.Jobs, status == xutil.PlanStatusRerun)
+		if err != nil {
+			return nil, err
+		}
+		plan.Databases = append(plan.Databases, &xutil.PlannedDatabase{
+			DatName:   target,
+			SizeBytes: p.SizeBytes,
+			Jobs:      p.Jobs,
+			Status:    status,
+			Path:      filepath.ToSlash(p.DatName),
+			Command:   xutil.CommandLine(pgRestore, args),
+		})
+	}
+	for _, dir := range skipped {
+		target := restoreContext.dumpTargetName(dir.DatName)
+		plan.Databases = append(plan.Databases, &xutil.PlannedDatabase{
+			DatName:   target,
+			SizeBytes: dir.SizeBytes,
+			Status:    statuses[target],
+			Path:      filepath.ToSlash(dir.DatName),
+		})
+	}
+	return plan, nil
+}
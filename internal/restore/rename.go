@@ -0,0 +1,217 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/jackc/pgx/v5"
+)
+
+// validateRenames parses --rename mappings, and checks that every selected dump gets a unique valid name.
+func validateRenames(restoreContext *ClusterRestoreContext, dirs []*xutil.DBInfo) error {
+	renames := make(map[string]string, len(restoreContext.Rename))
+	for _, spec := range restoreContext.Rename {
+		from, to, ok := strings.Cut(spec, "=")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid rename: %s (expected: old=new)", spec)
+		}
+		if _, ok := renames[from]; ok {
+			return fmt.Errorf("database is renamed more than once: %s", from)
+		}
+		renames[from] = to
+	}
+	restoreContext.renames = renames
+
+	selected := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		selected[xutil.DumpDirDBName(dir.DatName)] = true
+	}
+	for from := range renames {
+		if !selected[from] {
+			return fmt.Errorf("cannot rename %s, its dump is not selected for restore", from)
+		}
+	}
+
+	// not renamed dumps keep their names, renamed ones must not take them
+	targets := make(map[string]string, len(dirs))
+	for _, dir := range dirs {
+		if datName := xutil.DumpDirDBName(dir.DatName); !restoreContext.renamed(datName) {
+			targets[datName] = datName
+		}
+	}
+	for _, dir := range dirs {
+		datName := xutil.DumpDirDBName(dir.DatName)
+		target := restoreContext.targetName(datName)
+		if target == datName {
+			continue
+		}
+		if len(target) > maxIdentifierLen {
+			return fmt.Errorf("cannot rename %s, the name is longer than %d bytes: %s", datName, maxIdentifierLen, target)
+		}
+		switch target {
+		case xutil.PostgresDB, "template0", "template1":
+			return fmt.Errorf("cannot restore %s into the '%s' database", datName, target)
+		}
+		if other, ok := targets[target]; ok {
+			return fmt.Errorf("cannot restore both %s and %s into the same database: %s", other, datName, target)
+		}
+		targets[target] = datName
+	}
+	return nil
+}
+
+// targetName is the database the dump is restored into: the one it was dumped from, unless it's renamed.
+// An explicit mapping (--rename) takes precedence over --rename-prefix/--rename-suffix.
+func (restoreContext *ClusterRestoreContext) targetName(datName string) string {
+	if to, ok := restoreContext.renames[datName]; ok {
+		return to
+	}
+	return restoreContext.RenamePrefix + datName + restoreContext.RenameSuffix
+}
+
+// renamed reports whether the dump is restored under a new name
+func (restoreContext *ClusterRestoreContext) renamed(datName string) bool {
+	return restoreContext.targetName(datName) != datName
+}
+
+// dumpTargetName is the target database of the dump dir
+func (restoreContext *ClusterRestoreContext) dumpTargetName(dumpDir string) string {
+	return restoreContext.targetName(xutil.DumpDirDBName(dumpDir))
+}
+
+// createRenamedDatabase creates the target database of a renamed dump, as pg_restore --create would create
+// the original one: with the same encoding, locale and owner, taken from the archive itself.
+// Properties of the database (ALTER DATABASE ... SET, comments, grants on the database) are not restored.
+func createRenamedDatabase(ctx context.Context, restoreContext *ClusterRestoreContext, pgRestore, dataDir, target string) error {
+	definition, err := databaseDefinition(ctx, pgRestore, dataDir)
+	if err != nil {
+		return err
+	}
+	create, owner, err := renameDefinition(definition, target)
+	if err != nil {
+		return fmt.Errorf("cannot read the definition of the database in %s: %w", dataDir, err)
+	}
+	statements := []string{create}
+	if owner, ok := restoreContext.roles.databaseOwner(restoreContext.NoOwner, owner); ok {
+		statements = append(statements, "ALTER DATABASE "+pgx.Identifier{target}.Sanitize()+" OWNER TO "+owner)
+	}
+	if err := xutil.ExecSQL(ctx, restoreContext.ConnStr, statements...); err != nil {
+		return fmt.Errorf("cannot create database %s: %w", target, err)
+	}
+	slog.Info("restore",
+		slog.String("status", "created"),
+		slog.String("dbname", target),
+	)
+	return nil
+}
+
+// databaseDefinition returns the script pg_restore --create would run to create the database of the archive
+func databaseDefinition(ctx context.Context, pgRestore, dataDir string) (string, error) {
+	var listing, stderr bytes.Buffer
+	cmd := exec.Command(pgRestore, "--list", dataDir)
+	cmd.Stdout = &listing
+	cmd.Stderr = &stderr
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return "", fmt.Errorf("pg_restore --list: %v - %s", err, strings.TrimSpace(stderr.String()))
+	}
+	entry := databaseTocEntry(listing.String())
+	if entry == "" {
+		return "", fmt.Errorf("database entry not found in %s", dataDir)
+	}
+
+	listFile, err := os.CreateTemp("", "pgdump-each-*.list")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(listFile.Name())
+	if _, err := listFile.WriteString(entry + "\n"); err != nil {
+		listFile.Close()
+		return "", err
+	}
+	if err := listFile.Close(); err != nil {
+		return "", err
+	}
+
+	var script bytes.Buffer
+	stderr.Reset()
+	cmd = exec.Command(pgRestore, "--create", "--use-list="+listFile.Name(), dataDir)
+	cmd.Stdout = &script
+	cmd.Stderr = &stderr
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return "", fmt.Errorf("pg_restore --create: %v - %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return script.String(), nil
+}
+
+// databaseTocEntry finds the entry of the database itself in 'pg_restore --list' output,
+// i.e. '3378; 1262 16384 DATABASE - mydb postgres'
+func databaseTocEntry(listing string) string {
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[3] == "DATABASE" && fields[4] == "-" {
+			return line
+		}
+	}
+	return ""
+}
+
+// renameDefinition rewrites CREATE DATABASE of the script to the target, and returns the owner from ALTER DATABASE.
+// Options of CREATE DATABASE (template, encoding, locale) and the owner are kept as pg_dump has written them.
+func renameDefinition(script, target string) (create, owner string, err error) {
+	name := pgx.Identifier{target}.Sanitize()
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ";")
+		if rest, ok := strings.CutPrefix(line, "CREATE DATABASE "); ok {
+			options, err := skipIdentifier(rest)
+			if err != nil {
+				return "", "", err
+			}
+			create = "CREATE DATABASE " + name + options
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "ALTER DATABASE "); ok {
+			rest, err := skipIdentifier(rest)
+			if err != nil {
+				return "", "", err
+			}
+			if role, ok := strings.CutPrefix(rest, " OWNER TO "); ok {
+				owner = role
+			}
+		}
+	}
+	if create == "" {
+		return "", "", fmt.Errorf("CREATE DATABASE not found")
+	}
+	return create, owner, nil
+}
+
+// skipIdentifier returns the rest of the statement after a (possibly quoted) identifier written by pg_dump
+func skipIdentifier(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.IndexByte(s, ' '); i >= 0 {
+			return s[i:], nil
+		}
+		return "", nil
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			i++
+			continue
+		}
+		return s[i+1:], nil
+	}
+	return "", fmt.Errorf("unterminated identifier: %s", s)
+}
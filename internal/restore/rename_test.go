@@ -0,0 +1,118 @@
+package restore
+
+import (
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/compare"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRenames(t *testing.T) {
+	dirs := []*xutil.DBInfo{
+		{DatName: "/backup/dumps/postgres.dmp"},
+		{DatName: "/backup/dumps/app.dmp"},
+		{DatName: "/backup/dumps/billing.dmp"},
+	}
+
+	restoreContext := &ClusterRestoreContext{Rename: []string{"app=app_stage"}}
+	require.NoError(t, validateRenames(restoreContext, dirs))
+	assert.Equal(t, "app_stage", restoreContext.targetName("app"))
+	assert.Equal(t, "billing", restoreContext.targetName("billing"))
+	assert.False(t, restoreContext.renamed(xutil.PostgresDB))
+
+	// explicit mappings take precedence over the prefix/suffix
+	restoreContext = &ClusterRestoreContext{Rename: []string{"app=app_stage"}, RenamePrefix: "stage_"}
+	require.NoError(t, validateRenames(restoreContext, dirs))
+	assert.Equal(t, "app_stage", restoreContext.targetName("app"))
+	assert.Equal(t, "stage_billing", restoreContext.targetName("billing"))
+	assert.Equal(t, "stage_postgres", restoreContext.targetName(xutil.PostgresDB))
+
+	for spec, expected := range map[string]string{
+		"app":                         "expected: old=new",
+		"app=":                        "expected: old=new",
+		"unknown=new":                 "not selected",
+		"app=billing":                 "into the same database: billing",
+		"billing=" + xutil.PostgresDB: "into the 'postgres' database",
+	} {
+		err := validateRenames(&ClusterRestoreContext{Rename: []string{spec}}, dirs)
+		assert.ErrorContains(t, err, expected, spec)
+	}
+	err := validateRenames(&ClusterRestoreContext{Rename: []string{"app=a", "app=b"}}, dirs)
+	assert.ErrorContains(t, err, "renamed more than once")
+}
+
+func TestRenameDefinition(t *testing.T) {
+	listing := `;
+; Archive created at 2025-03-28 15:45:01 UTC
+;     dbname: app
+;
+3375; 0 0 ENCODING - ENCODING
+3378; 1262 16384 DATABASE - app app_owner
+3379; 0 0 DATABASE PROPERTIES - app app_owner
+`
+	assert.Equal(t, "3378; 1262 16384 DATABASE - app app_owner", databaseTocEntry(listing))
+
+	script := `--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+
+--
+-- Name: "my ""app"""; Type: DATABASE; Schema: -; Owner: app_owner
+--
+
+CREATE DATABASE "my ""app""" WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.UTF-8';
+
+
+ALTER DATABASE "my ""app""" OWNER TO app_owner;
+
+\connect -reuse-previous=on "dbname='my \"app\"'"
+`
+	create, owner, err := renameDefinition(script, "app stage")
+	require.NoError(t, err)
+	assert.Equal(t, `CREATE DATABASE "app stage" WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.UTF-8'`, create)
+	assert.Equal(t, "app_owner", owner)
+
+	_, _, err = renameDefinition("SET statement_timeout = 0;\n", "app_stage")
+	assert.ErrorContains(t, err, "CREATE DATABASE not found")
+}
+
+func TestPgRestoreArgsRenamed(t *testing.T) {
+	restoreContext := &ClusterRestoreContext{
+		ConnStr:      "postgres://postgres@localhost:5432/postgres",
+		RenamePrefix: "stage_",
+	}
+	args, err := pgRestoreArgs(restoreContext, "app", "/backup/dumps/app.dmp", 2, true)
+	require.NoError(t, err)
+	assert.Contains(t, args, "--dbname=postgres://postgres@localhost:5432/stage_app")
+	assert.NotContains(t, args, "--create")
+	assert.NotContains(t, args, "--clean")
+}
+
+func TestVerifyContextRenamed(t *testing.T) {
+	dirs := []*xutil.DBInfo{
+		{DatName: "/backup/dumps/app.dmp"},
+		{DatName: "/backup/dumps/billing.dmp"},
+	}
+	restoreContext := &ClusterRestoreContext{
+		Rename:          []string{"app=app_copy"},
+		RenameSuffix:    "_stage",
+		VerifyRowCounts: compare.RowCountsExact,
+	}
+	require.NoError(t, validateRenames(restoreContext, dirs))
+
+	// every restored database is compared with its target, renamed by the prefix/suffix too
+	compareContext := verifyContext(restoreContext, &restoreState{}, []string{"app", "billing"})
+	assert.Equal(t, []string{"app", "billing"}, compareContext.Databases)
+	assert.Equal(t, map[string]string{"app": "app_copy", "billing": "billing_stage"}, compareContext.TargetNames)
+	assert.Equal(t, compare.RowCountsExact, compareContext.RowCounts)
+	assert.False(t, compareContext.ExistingTarget)
+
+	// roles of a non-empty target are its own, memberships are not checked when globals were skipped
+	compareContext = verifyContext(restoreContext, &restoreState{ExistingCluster: true, Globals: statusSkipped}, []string{"app"})
+	assert.True(t, compareContext.ExistingTarget)
+	assert.True(t, compareContext.SkipMemberships)
+}
@@ -1,7 +1,6 @@
 package restore
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"log/slog"
@@ -9,7 +8,13 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/hashmap-kz/pgdump-each/internal/compare"
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/metrics"
+	"github.com/hashmap-kz/pgdump-each/internal/runlog"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
 	"github.com/hashmap-kz/pgdump-each/internal/xutil"
 )
 
@@ -19,61 +24,378 @@ type ClusterRestoreContext struct {
 	PgBinPath   string
 	ExitOnError bool
 	ParallelDBS int
-	LogDir      string
+	// MaxTotalJobs is the sum of pg_restore --jobs of all concurrently restored databases (0 - number of CPUs)
+	MaxTotalJobs int
+	// LogDir is where the state file is kept (see --resume)
+	LogDir string
+	// StreamStderr prints stderr of psql/pg_restore to the console as it's written, prefixed with the database
+	StreamStderr bool
+	// RunLogDir is the run dir: logs of psql/pg_restore are saved there (optional)
+	RunLogDir string
+	Filter    xutil.DBFilter
+	Resume    bool
+	// OnConflict is the policy for databases that already exist in the target cluster (see Conflict*),
+	// without it the target cluster must be empty. ConfirmDrop is required by ConflictDrop.
+	OnConflict  string
+	ConfirmDrop bool
+	// RestoreGlobals restores globals.sql into a cluster that has databases of its own (with OnConflict),
+	// without DROP statements of roles and tablespaces. Globals are skipped there by default.
+	RestoreGlobals bool
+	// Rename are 'old=new' mappings of databases restored under new names, other databases get
+	// RenamePrefix and RenameSuffix. Renamed databases are created before pg_restore, instead of --create.
+	Rename       []string
+	RenamePrefix string
+	RenameSuffix string
+	// RoleMapFile maps source roles to roles of the target environment ('prod_app -> stage_app' lines),
+	// SkipRoles are not restored. Both are applied to globals.sql, mapped owners of database objects are
+	// reassigned after restore (it requires NoPrivileges), see roleRewriter.
+	RoleMapFile string
+	SkipRoles   []string
+	// NoOwner and NoPrivileges are passed to pg_restore (--no-owner, --no-privileges)
+	NoOwner      bool
+	NoPrivileges bool
+	// VerifyAgainst is a source cluster connection string, restored databases are compared with it (optional)
+	VerifyAgainst string
+	// VerifyRowCounts is how row counts are compared with VerifyAgainst, see compare.RowCountsEstimate
+	VerifyRowCounts string
+	// WorkDir is a local dir dumps are fetched to, when InputDir is a remote storage (i.e. s3://bucket/prefix/<ts>.dmp),
+	// and decrypted to, when the backup is encrypted
+	WorkDir        string
+	StorageOptions storage.Options
+	// ChecksumWorkers is the number of files hashed concurrently (0 - number of CPUs)
+	ChecksumWorkers int
+	// DecryptIdentities are age identity files, required to restore an encrypted backup
+	DecryptIdentities []string
+	// VerifyKey is a PEM Ed25519 public key file, checksums.txt must be signed with its private key
+	VerifyKey string
+	// ProgressInterval is how often progress is logged, when stderr is not a terminal (0 - no progress)
+	ProgressInterval time.Duration
+	// Metrics records live progress and results of databases (optional)
+	Metrics *metrics.Run
+
+	dryRun  bool
+	renames map[string]string
+	roles   *roleRewriter
 }
 
 func RunRestoreJobs(ctx context.Context, restoreContext *ClusterRestoreContext) error {
-	if err := xutil.SetupEnv(ctx, restoreContext.ConnStr); err != nil {
+	b, dirs, existing, err := prepareRestore(ctx, restoreContext)
+	if err != nil {
 		return err
 	}
+	defer b.close()
 
-	databases, err := xutil.GetDatabases(ctx, restoreContext.ConnStr)
+	state, pending, err := prepareState(ctx, restoreContext, dirs, existing)
 	if err != nil {
 		return err
 	}
-	if len(databases) > 0 {
-		return fmt.Errorf("cannot restore on non-empty cluster")
+	restoredNames := restoredDatabases(restoreContext, dirs, state)
+	dirs = pending
+
+	switch state.Globals {
+	case statusDone:
+	case statusSkipped:
+		slog.Warn("restore",
+			slog.String("globals", "skipped"),
+			slog.String("reason", "target cluster is not empty (see --restore-globals)"),
+		)
+	default:
+		restoreContext.roles.existingCluster = state.ExistingCluster
+		if err := restoreGlobals(ctx, restoreContext, b); err != nil {
+			return err
+		}
+		if err := state.setGlobals(statusDone); err != nil {
+			return err
+		}
 	}
 
-	inputPath := restoreContext.InputDir
+	if err := prepareMappedRoles(ctx, restoreContext, state); err != nil {
+		return err
+	}
+	if err := restoreCluster(ctx, restoreContext, dirs, state, b); err != nil {
+		return err
+	}
+	if err := dropPlaceholderRoles(ctx, restoreContext, state); err != nil {
+		return err
+	}
 
-	dirs, err := xutil.GetDumpsInDir(inputPath)
+	if restoreContext.VerifyAgainst != "" {
+		if err := verifyRestored(ctx, restoreContext, state, restoredNames); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("result", slog.String("status", "ok"))
+	return nil
+}
+
+// prepareRestore checks the connection, binaries and the target cluster, opens the backup,
+// and selects dumps to restore. Existing are databases of the target cluster (expected on resume only).
+func prepareRestore(
+	ctx context.Context,
+	restoreContext *ClusterRestoreContext,
+) (b *backup, dirs, existing []*xutil.DBInfo, err error) {
+	if err := xutil.SetupEnv(ctx, restoreContext.ConnStr); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := restoreContext.Filter.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := validateConflictPolicy(restoreContext); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := compare.ValidateRowCounts(restoreContext.VerifyRowCounts); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := validateRoles(restoreContext); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// pg_restore must match the server version
+	pgBinPath, err := xutil.ResolvePgBinPath(ctx, restoreContext.ConnStr, restoreContext.PgBinPath, xutil.RestoreBinaries)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
-	if len(dirs) == 0 {
-		return fmt.Errorf("no dumps were found")
+	restoreContext.PgBinPath = pgBinPath
+
+	databases, err := xutil.GetDatabases(ctx, restoreContext.ConnStr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	existing, _ = (&xutil.DBFilter{}).Split(databases)
+	if len(existing) > 0 && !restoreContext.Resume && restoreContext.OnConflict == "" {
+		return nil, nil, nil, fmt.Errorf("cannot restore on non-empty cluster (see --on-conflict)")
 	}
 
-	if err := xutil.CompareChecksums(inputPath); err != nil {
-		return err
+	opened, err := openBackup(ctx, restoreContext)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	defer func() {
+		if err != nil {
+			opened.close()
+		}
+	}()
 
-	if err := restoreGlobals(restoreContext, inputPath); err != nil {
-		return err
+	m, err := readManifest(opened.localDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if m != nil && m.Encryption != nil {
+		if err = opened.enableDecryption(restoreContext); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	if err := restoreCluster(ctx, restoreContext, dirs); err != nil {
-		return err
+	allDirs, err := opened.dumps(ctx)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	dirs, err = selectDumps(restoreContext, allDirs, m)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = validateRenames(restoreContext, dirs); err != nil {
+		return nil, nil, nil, err
+	}
+	return opened, dirs, existing, nil
+}
 
-	slog.Info("result", slog.String("status", "ok"))
+// verifyRestored compares restored databases with the source cluster.
+func verifyRestored(ctx context.Context, restoreContext *ClusterRestoreContext, state *restoreState, databases []string) error {
+	if restoreContext.VerifyRowCounts == compare.RowCountsEstimate {
+		if err := analyzeRestored(ctx, restoreContext, databases); err != nil {
+			return err
+		}
+	}
+	report, err := compare.RunCompare(ctx, verifyContext(restoreContext, state, databases))
+	if report != nil {
+		if printErr := compare.PrintReport(os.Stdout, report); printErr != nil {
+			slog.Warn("verify", slog.String("err-print-report", printErr.Error()))
+		}
+	}
+	return err
+}
+
+// restoredDatabases returns selected dumps that are restored by this run or were restored by the resumed one,
+// i.e. ones in the state: dumps skipped by --on-conflict=skip are not there.
+func restoredDatabases(restoreContext *ClusterRestoreContext, dirs []*xutil.DBInfo, state *restoreState) []string {
+	names := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if _, ok := state.Databases[restoreContext.dumpTargetName(dir.DatName)]; ok {
+			names = append(names, xutil.DumpDirDBName(dir.DatName))
+		}
+	}
+	return names
+}
+
+// verifyContext compares source databases with ones they're restored into,
+// under new names too (--rename, --rename-prefix, --rename-suffix).
+// Roles of a non-empty target are its own: only memberships of the source are checked there,
+// and none at all, when globals were not restored.
+func verifyContext(restoreContext *ClusterRestoreContext, state *restoreState, databases []string) *compare.CompareContext {
+	targetNames := make(map[string]string, len(databases))
+	for _, dbname := range databases {
+		targetNames[dbname] = restoreContext.targetName(dbname)
+	}
+	var roleMapping map[string]string
+	if restoreContext.roles != nil {
+		roleMapping = restoreContext.roles.mapping
+	}
+	return &compare.CompareContext{
+		SourceConnStr: restoreContext.VerifyAgainst,
+		TargetConnStr: restoreContext.ConnStr,
+		ParallelDBS:   restoreContext.ParallelDBS,
+		Databases:     databases,
+		TargetNames:   targetNames,
+		RowCounts:     restoreContext.VerifyRowCounts,
+		RoleMapping:   roleMapping,
+		SkipRoles:     restoreContext.SkipRoles,
+
+		ExistingTarget:  state.ExistingCluster,
+		SkipMemberships: state.Globals == statusSkipped,
+	}
+}
+
+// analyzeRestored collects statistics of restored databases: pg_restore does not, and row estimates are read from them
+func analyzeRestored(ctx context.Context, restoreContext *ClusterRestoreContext, databases []string) error {
+	for _, dbname := range databases {
+		target := restoreContext.targetName(dbname)
+		connStr, err := xutil.ConnStrWithDB(restoreContext.ConnStr, target)
+		if err != nil {
+			return err
+		}
+		if err := xutil.ExecSQL(ctx, connStr, "ANALYZE"); err != nil {
+			return fmt.Errorf("cannot analyze %s: %w", target, err)
+		}
+		slog.Info("verify",
+			slog.String("status", "analyzed"),
+			slog.String("dbname", target),
+		)
+	}
 	return nil
 }
 
-func restoreGlobals(restoreContext *ClusterRestoreContext, inputPath string) error {
+// prepareState creates a new restore state, or loads the previous one and selects unfinished dumps with --resume.
+// Existing databases that conflict with dumps are resolved by the policy, except ones restored by the previous run.
+func prepareState(
+	ctx context.Context,
+	restoreContext *ClusterRestoreContext,
+	dirs []*xutil.DBInfo,
+	existing []*xutil.DBInfo,
+) (*restoreState, []*xutil.DBInfo, error) {
+	if !restoreContext.Resume {
+		dirs, err := resolveConflicts(ctx, restoreContext, dirs, findConflicts(restoreContext, dirs, existing))
+		if err != nil {
+			return nil, nil, err
+		}
+		state, err := newState(restoreContext, dirs, existing)
+		return state, dirs, err
+	}
+
+	state, err := loadState(restoreContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if restoreContext.OnConflict != "" {
+		var unknown []*xutil.DBInfo
+		existing, unknown = splitByState(state, findConflicts(restoreContext, dirs, existing))
+		dirs, err = resolveConflicts(ctx, restoreContext, dirs, unknown)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	pending, err := resumeDumps(ctx, restoreContext, state, dirs, existing)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pending) == 0 {
+		slog.Info("restore", slog.String("resume", "all databases were already restored"))
+	}
+	return state, pending, nil
+}
+
+// readManifest loads the backup manifest, backups made by older versions may have none.
+func readManifest(inputPath string) (*manifest.Manifest, error) {
+	m, err := manifest.Read(inputPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			slog.Warn("restore", slog.String("manifest", "not found, skipping validation"))
+			return nil, nil
+		}
+		return nil, err
+	}
+	slog.Info("restore",
+		slog.String("manifest", "ok"),
+		slog.String("timestamp", m.Timestamp),
+		slog.String("source-version", m.Source.ServerVersion),
+		slog.String("source-host", m.Source.Host),
+	)
+	return m, nil
+}
+
+// selectDumps applies include/exclude filters to dumps found in the backup,
+// and ensures that every database recorded in the manifest is actually presented.
+func selectDumps(restoreContext *ClusterRestoreContext, allDirs []*xutil.DBInfo, m *manifest.Manifest) ([]*xutil.DBInfo, error) {
+	found := make(map[string]bool, len(allDirs))
+	var dirs []*xutil.DBInfo
+	for _, dir := range allDirs {
+		dbname := xutil.DumpDirDBName(dir.DatName)
+		found[dbname] = true
+		if !restoreContext.Filter.Match(dbname) {
+			slog.Info("restore",
+				slog.String("status", "skip"),
+				slog.String("dbname", dbname),
+			)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+
+	if m != nil {
+		for _, db := range m.Databases {
+			if !found[db.DatName] {
+				return nil, fmt.Errorf("backup is incomplete, dump not found: %s", db.DatName)
+			}
+		}
+		for _, dbname := range m.Selection.Skipped {
+			slog.Info("restore",
+				slog.String("status", "excluded-at-dump"),
+				slog.String("dbname", dbname),
+			)
+		}
+	}
+
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no dumps were found")
+	}
+	return dirs, nil
+}
+
+func restoreGlobals(ctx context.Context, restoreContext *ClusterRestoreContext, b *backup) error {
 	psql, err := xutil.GetExec(restoreContext.PgBinPath, "psql")
 	if err != nil {
 		return err
 	}
 
-	globalsScript := filepath.Join(inputPath, "globals.sql")
-
-	args := []string{
-		"--dbname=" + restoreContext.ConnStr,
-		"--file=" + globalsScript,
+	globalsScript, err := b.openFile(ctx, "globals.sql")
+	if err != nil {
+		return err
+	}
+	defer b.release("globals.sql")
+
+	if !restoreContext.roles.empty() {
+		rewritten, err := rewriteGlobalsFile(restoreContext, globalsScript)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(rewritten)
+		globalsScript = rewritten
 	}
 
+	args := psqlGlobalsArgs(restoreContext, globalsScript)
+
 	// It's completely fine to have errors when restoring globals.
 	// For instance: in 99.9% cases you already have role 'postgres' in your newly created cluster.
 	// And in 99.9% cases this role is also presented in globals objects for restore.
@@ -82,12 +404,19 @@ func restoreGlobals(restoreContext *ClusterRestoreContext, inputPath string) err
 	// "--variable=ON_ERROR_STOP=1",
 	// "--single-transaction",
 
+	runLog, err := runlog.CreateFile(restoreContext.RunLogDir, "psql-globals.log")
+	if err != nil {
+		return err
+	}
+	defer runLog.Close()
+
 	// execute psql
-	var stderrBuf bytes.Buffer
+	stderr := xutil.NewStderr("globals", restoreContext.StreamStderr, runLog)
+	defer stderr.Close()
 	cmd := exec.Command(psql, args...)
-	cmd.Stderr = &stderrBuf
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to restore globals %s: %v - %s", inputPath, err, stderrBuf.String())
+	cmd.Stderr = stderr
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to restore globals %s: %v - %s", globalsScript, err, stderr.Tail())
 	}
 
 	slog.Info("restore",
@@ -97,41 +426,70 @@ func restoreGlobals(restoreContext *ClusterRestoreContext, inputPath string) err
 	return nil
 }
 
-func restoreCluster(ctx context.Context, restoreContext *ClusterRestoreContext, dirs []*xutil.DBInfo) error {
-	jobsWeights, err := xutil.GetJobsWeights(ctx, dirs, restoreContext.ConnStr)
-	if err != nil {
-		return err
+func psqlGlobalsArgs(restoreContext *ClusterRestoreContext, globalsScript string) []string {
+	return []string{
+		"--dbname=" + restoreContext.ConnStr,
+		"--file=" + globalsScript,
 	}
+}
+
+func restoreCluster(
+	ctx context.Context,
+	restoreContext *ClusterRestoreContext,
+	dirs []*xutil.DBInfo,
+	state *restoreState,
+	b *backup,
+) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	budget := xutil.JobsBudget{ParallelDBS: restoreContext.ParallelDBS, MaxTotalJobs: restoreContext.MaxTotalJobs}
+	sched := xutil.NewJobsScheduler(dirs, budget)
 
 	slog.Info("restore",
-		slog.Int("workers", restoreContext.ParallelDBS),
+		slog.Int("workers", budget.Workers()),
+		slog.Int("max-total-jobs", budget.Total()),
 	)
+	for _, p := range sched.Plan() {
+		slog.Info("restore",
+			slog.String("status", "plan"),
+			slog.String("dumpname", filepath.Base(p.DatName)),
+			slog.String("dumpsize", xutil.ByteCountSI(p.SizeBytes)),
+			slog.Int("jobs", p.Jobs),
+		)
+	}
 
-	workerCount := restoreContext.ParallelDBS
-	dbChan := make(chan *xutil.DBInfo, len(dirs))
+	progress := xutil.NewProgress("restore", dirs)
+	restoreContext.Metrics.SetProgress(progress)
+	stopProgress := progress.Run(ctx, restoreContext.ProgressInterval)
+	defer stopProgress()
+
+	workerCount := budget.Workers()
 	erChan := make(chan error, len(dirs))
 	var wg sync.WaitGroup
 
-	// Start worker goroutines
+	// Start worker goroutines, dumps are taken largest first
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for dumpDir := range dbChan {
-				restoreErr := restoreDump(restoreContext, dumpDir, jobsWeights)
-				if restoreErr != nil {
+			for {
+				dumpDir, jobs, ok := sched.Next()
+				if !ok {
+					return
+				}
+				// do not start new jobs, when interrupted
+				if ctx.Err() != nil {
+					erChan <- fmt.Errorf("restore %s skipped: %w", dumpDir.DatName, ctx.Err())
+				} else if restoreErr := restoreDump(ctx, restoreContext, dumpDir, jobs, state, b, progress); restoreErr != nil {
 					erChan <- restoreErr
 				}
+				sched.Done(dumpDir)
 			}
 		}()
 	}
 
-	// Send databases to the pgDumpWorker channel
-	for _, db := range dirs {
-		dbChan <- db
-	}
-	close(dbChan) // Close the task channel once all tasks are submitted
-
 	// Wait for all workers to finish
 	go func() {
 		wg.Wait()
@@ -146,7 +504,15 @@ func restoreCluster(ctx context.Context, restoreContext *ClusterRestoreContext,
 	return lastErr
 }
 
-func restoreDump(restoreContext *ClusterRestoreContext, dumpDirInfo *xutil.DBInfo, jobsWeights map[string]int) error {
+func restoreDump(
+	ctx context.Context,
+	restoreContext *ClusterRestoreContext,
+	dumpDirInfo *xutil.DBInfo,
+	pgDumpJobs int,
+	state *restoreState,
+	b *backup,
+	progress *xutil.Progress,
+) (err error) {
 	pgRestore, err := xutil.GetExec(restoreContext.PgBinPath, "pg_restore")
 	if err != nil {
 		return err
@@ -154,11 +520,6 @@ func restoreDump(restoreContext *ClusterRestoreContext, dumpDirInfo *xutil.DBInf
 
 	dumpDir := dumpDirInfo.DatName
 
-	pgDumpJobs, ok := jobsWeights[dumpDir]
-	if !ok {
-		return fmt.Errorf("cannot find dump dir name in jobs-weights table: %s", dumpDir)
-	}
-
 	slog.Info("restore",
 		slog.String("status", "run"),
 		slog.String("dumpname", filepath.Base(dumpDir)),
@@ -166,37 +527,123 @@ func restoreDump(restoreContext *ClusterRestoreContext, dumpDirInfo *xutil.DBInf
 		slog.Int("jobs", pgDumpJobs),
 	)
 
-	args := []string{
-		"--dbname=" + restoreContext.ConnStr,
-		"--create",
-		"--format=directory",
-		"--jobs=" + fmt.Sprintf("%d", pgDumpJobs),
-		"--no-password",
-		"--verbose",
-		dumpDir + "/data",
+	// the state, logs and metrics are of the target database, it differs from the dump when renamed
+	datName := xutil.DumpDirDBName(dumpDir)
+	target := restoreContext.targetName(datName)
+	if err := state.setDatabase(target, statusRunning, nil); err != nil {
+		return err
 	}
-	if restoreContext.ExitOnError {
-		args = append(args, "--exit-on-error")
+	started := time.Now()
+	defer func() {
+		restoreContext.Metrics.DatabaseDone(target, dumpDirInfo.SizeBytes, time.Since(started), err)
+		if err != nil {
+			if stateErr := state.setDatabase(target, statusFailed, err); stateErr != nil {
+				slog.Warn("restore", slog.String("err-save-state", stateErr.Error()))
+			}
+			return
+		}
+		err = state.setDatabase(target, statusDone, nil)
+	}()
+
+	// remote dumps are fetched (and verified) right before restore, and removed right after,
+	// encrypted ones are decrypted the same way
+	rel := datName + ".dmp"
+	localDumpDir, err := b.openDir(ctx, rel)
+	if err != nil {
+		return err
+	}
+	defer b.release(rel)
+
+	args, err := pgRestoreArgs(restoreContext, datName, localDumpDir, pgDumpJobs, state.attempted[target])
+	if err != nil {
+		return err
+	}
+	if restoreContext.renamed(datName) {
+		if err := createRenamedDatabase(ctx, restoreContext, pgRestore, localDumpDir+"/data", target); err != nil {
+			return err
+		}
 	}
 
 	// preserve logs for debug
-	logFileName := fmt.Sprintf("restore-%s.log", filepath.Base(dumpDir))
-	logFile, err := os.Create(filepath.Join(restoreContext.LogDir, logFileName))
+	logFile, err := runlog.CreateFile(restoreContext.RunLogDir, "pg_restore-"+target+".log")
 	if err != nil {
-		return fmt.Errorf("failed to create log file: %w", err)
+		return err
 	}
 	defer logFile.Close()
 
+	// nothing is written locally, tables are counted from --verbose
+	task := progress.Track(target, dumpDirInfo, pgDumpJobs, nil)
+	defer task.Done()
+
 	// execute CMD
 	cmd := exec.Command(pgRestore, args...)
-	cmd.Stderr = logFile // write directly to file
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to restore %s: %v", dumpDir, err)
+	stderr := xutil.NewStderr(target, restoreContext.StreamStderr, logFile, task.Stderr())
+	defer stderr.Close()
+	cmd.Stderr = stderr
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to restore %s: %v - %s", dumpDir, err, stderr.Tail())
+	}
+	if err := reassignOwned(ctx, restoreContext, target); err != nil {
+		return err
 	}
 
 	slog.Info("restore",
 		slog.String("status", "ok"),
 		slog.String("dump", filepath.ToSlash(dumpDir)),
+		slog.String("dbname", target),
 	)
 	return nil
 }
+
+// pgRestoreArgs returns arguments of pg_restore for the dump dir of the database.
+// The 'postgres' database always exists in the target cluster,
+// so it is restored into the existing one, instead of being created.
+// It cannot be dropped on resume, so its objects are cleaned instead (if it was attempted before).
+// A renamed database is created before pg_restore (see createRenamedDatabase), and restored into.
+func pgRestoreArgs(restoreContext *ClusterRestoreContext, datName, dumpDir string, jobs int, attempted bool) ([]string, error) {
+	dbname := restoreContext.ConnStr
+	create := true
+	clean := false
+	switch {
+	case restoreContext.renamed(datName):
+		var err error
+		dbname, err = xutil.ConnStrWithDB(restoreContext.ConnStr, restoreContext.targetName(datName))
+		if err != nil {
+			return nil, err
+		}
+		create = false
+	case datName == xutil.PostgresDB:
+		var err error
+		dbname, err = xutil.ConnStrWithDB(restoreContext.ConnStr, xutil.PostgresDB)
+		if err != nil {
+			return nil, err
+		}
+		create = false
+		clean = attempted
+	}
+
+	args := []string{
+		"--dbname=" + dbname,
+		"--format=directory",
+		"--jobs=" + fmt.Sprintf("%d", jobs),
+		"--no-password",
+		"--verbose",
+		dumpDir + "/data",
+	}
+	if create {
+		args = append(args, "--create")
+	}
+	if clean {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if restoreContext.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	if restoreContext.NoPrivileges {
+		args = append(args, "--no-privileges")
+	}
+	if restoreContext.ExitOnError {
+		args = append(args, "--exit-on-error")
+	}
+	return args, nil
+}
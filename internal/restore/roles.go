@@ -0,0 +1,498 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/jackc/pgx/v5"
+)
+
+// roleRewriter applies the role mapping (--role-map) and skipped roles (--skip-role) to globals.sql.
+// A mapped role belongs to the target environment: it's not dropped, created or altered, references to the source
+// role (memberships, owners, grants) are rewritten to it. Statements of skipped roles are not restored at all.
+// Owners of database objects are mapped after each database is restored, see prepareMappedRoles.
+type roleRewriter struct {
+	mapping map[string]string
+	skipped map[string]bool
+	// existingCluster removes DROP ROLE/TABLESPACE statements (pg_dumpall --clean), roles of the target are kept
+	existingCluster bool
+
+	rewritten int
+	dropped   int
+}
+
+// validateRoles reads the role map file, and checks that no role is both mapped and skipped.
+func validateRoles(restoreContext *ClusterRestoreContext) error {
+	r := &roleRewriter{mapping: map[string]string{}, skipped: map[string]bool{}}
+	if restoreContext.RoleMapFile != "" {
+		mapping, err := xutil.ReadRoleMap(restoreContext.RoleMapFile)
+		if err != nil {
+			return err
+		}
+		r.mapping = mapping
+	}
+	for _, role := range restoreContext.SkipRoles {
+		r.skipped[role] = true
+	}
+	for from, to := range r.mapping {
+		if r.skipped[from] || r.skipped[to] {
+			return fmt.Errorf("role is both mapped and skipped: %s -> %s", from, to)
+		}
+	}
+	// owners are reassigned after restore, there's no such thing for grants: they'd stay with placeholder roles
+	if len(r.mapping) > 0 && !restoreContext.NoPrivileges {
+		return fmt.Errorf("--role-map requires --no-privileges: grants to mapped roles cannot be carried over")
+	}
+	// skipped roles are never created, pg_restore would fail on ALTER ... OWNER TO them
+	if len(r.skipped) > 0 && !restoreContext.NoOwner {
+		return fmt.Errorf("--skip-role requires --no-owner: objects of skipped roles cannot be restored with their owners")
+	}
+	restoreContext.roles = r
+	return nil
+}
+
+// prepareMappedRoles checks that target roles exist, and creates mapped source roles as placeholders
+// (NOLOGIN, without a password), so pg_restore restores owners of database objects to them.
+// A source role that exists in the target cluster is refused: REASSIGN OWNED would take its objects too.
+// Owners are reassigned to target roles after each database is restored (see reassignOwned),
+// and placeholders are dropped when the whole restore is finished (see dropPlaceholderRoles).
+func prepareMappedRoles(ctx context.Context, restoreContext *ClusterRestoreContext, state *restoreState) error {
+	r := restoreContext.roles
+	if r == nil || len(r.mapping) == 0 {
+		return nil
+	}
+	existing, err := xutil.GetRoles(ctx, restoreContext.ConnStr)
+	if err != nil {
+		return err
+	}
+	for _, from := range r.sources() {
+		if to := r.mapping[from]; !existing[to] {
+			return fmt.Errorf("target role of %s does not exist: %s", from, to)
+		}
+	}
+	if restoreContext.NoOwner {
+		return nil
+	}
+
+	placeholders := slices.Clone(state.PlaceholderRoles)
+	for _, from := range r.sources() {
+		if slices.Contains(placeholders, from) {
+			continue
+		}
+		if existing[from] {
+			return fmt.Errorf("mapped role exists in the target cluster: %s (use --no-owner)", from)
+		}
+		if err := xutil.ExecSQL(ctx, restoreContext.ConnStr, "CREATE ROLE "+pgx.Identifier{from}.Sanitize()+" NOLOGIN"); err != nil {
+			return fmt.Errorf("cannot create placeholder role %s: %w", from, err)
+		}
+		// saved one by one: a failed restore must know all placeholders it has created
+		placeholders = append(placeholders, from)
+		if err := state.setPlaceholderRoles(placeholders); err != nil {
+			return err
+		}
+		slog.Info("restore",
+			slog.String("status", "placeholder-role"),
+			slog.String("role", from),
+			slog.String("mapped-to", r.mapping[from]),
+		)
+	}
+	return nil
+}
+
+// reassignOwned passes objects of mapped source roles in the restored database (and the database itself) to target roles
+func reassignOwned(ctx context.Context, restoreContext *ClusterRestoreContext, dbname string) error {
+	r := restoreContext.roles
+	if r == nil || len(r.mapping) == 0 || restoreContext.NoOwner {
+		return nil
+	}
+	connStr, err := xutil.ConnStrWithDB(restoreContext.ConnStr, dbname)
+	if err != nil {
+		return err
+	}
+	statements := make([]string, 0, len(r.mapping))
+	for _, from := range r.sources() {
+		statements = append(statements,
+			"REASSIGN OWNED BY "+pgx.Identifier{from}.Sanitize()+" TO "+pgx.Identifier{r.mapping[from]}.Sanitize())
+	}
+	if err := xutil.ExecSQL(ctx, connStr, statements...); err != nil {
+		return fmt.Errorf("cannot reassign owners of mapped roles in %s: %w", dbname, err)
+	}
+	return nil
+}
+
+// dropPlaceholderRoles drops roles created by prepareMappedRoles, a role that still owns something is kept
+func dropPlaceholderRoles(ctx context.Context, restoreContext *ClusterRestoreContext, state *restoreState) error {
+	var kept []string
+	for _, role := range state.PlaceholderRoles {
+		if err := xutil.ExecSQL(ctx, restoreContext.ConnStr, "DROP ROLE IF EXISTS "+pgx.Identifier{role}.Sanitize()); err != nil {
+			slog.Warn("restore",
+				slog.String("placeholder-role", role),
+				slog.String("err-drop", err.Error()),
+			)
+			kept = append(kept, role)
+		}
+	}
+	return state.setPlaceholderRoles(kept)
+}
+
+// sources returns mapped source roles in a stable order
+func (r *roleRewriter) sources() []string {
+	sources := make([]string, 0, len(r.mapping))
+	for from := range r.mapping {
+		sources = append(sources, from)
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+func (r *roleRewriter) empty() bool {
+	return r == nil || (len(r.mapping) == 0 && len(r.skipped) == 0 && !r.existingCluster)
+}
+
+// mapRole returns the identifier of the target role, if the identifier is of a mapped role
+func (r *roleRewriter) mapRole(ident string) (string, bool) {
+	to, ok := r.mapping[identValue(ident)]
+	if !ok {
+		return ident, false
+	}
+	return pgx.Identifier{to}.Sanitize(), true
+}
+
+func (r *roleRewriter) isSkipped(ident string) bool {
+	return r.skipped[identValue(ident)]
+}
+
+func (r *roleRewriter) isMapped(ident string) bool {
+	_, ok := r.mapping[identValue(ident)]
+	return ok
+}
+
+// rewriteGlobals rewrites the script written by pg_dumpall --globals-only
+func (r *roleRewriter) rewriteGlobals(script string) string {
+	var sb strings.Builder
+	for _, chunk := range splitStatements(script) {
+		if !chunk.statement {
+			sb.WriteString(chunk.text)
+			continue
+		}
+		rewritten, keep := r.rewriteStatement(chunk.text)
+		if !keep {
+			r.dropped++
+			continue
+		}
+		if rewritten != chunk.text {
+			r.rewritten++
+		}
+		sb.WriteString(rewritten)
+	}
+	return sb.String()
+}
+
+// rewriteStatement maps roles referenced by the statement, keep is false when the statement must not be restored
+func (r *roleRewriter) rewriteStatement(statement string) (rewritten string, keep bool) {
+	tokens := tokenize(statement)
+	sig := significant(tokens)
+	word := func(i int) string {
+		if i < len(sig) {
+			return strings.ToUpper(tokens[sig[i]])
+		}
+		return ""
+	}
+
+	if word(0) == "DROP" && (word(1) == "ROLE" || word(1) == "TABLESPACE") && r.existingCluster {
+		return statement, false
+	}
+
+	// statements that define the role itself
+	subject := -1
+	switch {
+	case word(0) == "DROP" && word(1) == "ROLE" && word(2) == "IF" && word(3) == "EXISTS":
+		// DROP ROLE IF EXISTS role (pg_dumpall --clean), roles of the target must not be dropped by source names
+		subject = 4
+	case word(0) == "DROP" && word(1) == "ROLE":
+		subject = 2
+	case word(0) == "CREATE" && word(1) == "ROLE", word(0) == "ALTER" && word(1) == "ROLE":
+		subject = 2
+	case word(0) == "COMMENT" && word(1) == "ON" && word(2) == "ROLE":
+		subject = 3
+	case word(0) == "SECURITY" && word(1) == "LABEL":
+		for i := 2; i+2 < len(sig); i++ {
+			if word(i) == "ON" && word(i+1) == "ROLE" {
+				subject = i + 2
+				break
+			}
+		}
+	}
+	if subject >= 0 && subject < len(sig) {
+		role := tokens[sig[subject]]
+		return statement, !r.isSkipped(role) && !r.isMapped(role)
+	}
+
+	var roles []int
+	switch word(0) {
+	case "GRANT", "REVOKE":
+		roles = grantRoles(tokens, sig)
+	default:
+		for i := 0; i+1 < len(sig); i++ {
+			if word(i) != "OWNER" {
+				continue
+			}
+			if word(i+1) == "TO" && i+2 < len(sig) {
+				// ALTER ... OWNER TO role
+				if r.isSkipped(tokens[sig[i+2]]) {
+					return statement, false
+				}
+				roles = append(roles, sig[i+2])
+			} else if word(0) == "CREATE" {
+				// CREATE TABLESPACE ... OWNER role, the restoring user owns it when the role is skipped
+				if r.isSkipped(tokens[sig[i+1]]) {
+					for j := sig[i]; j <= sig[i+1]; j++ {
+						tokens[j] = ""
+					}
+					continue
+				}
+				roles = append(roles, sig[i+1])
+			}
+		}
+	}
+
+	for _, i := range roles {
+		if r.isSkipped(tokens[i]) {
+			return statement, false
+		}
+		tokens[i], _ = r.mapRole(tokens[i])
+	}
+	return strings.Join(tokens, ""), true
+}
+
+// grantRoles returns tokens of roles in GRANT/REVOKE: granted roles (membership), grantees and the grantor
+func grantRoles(tokens []string, sig []int) []int {
+	var roles []int
+	hasOn := false
+	for _, i := range sig {
+		if strings.EqualFold(tokens[i], "ON") {
+			hasOn = true
+		}
+	}
+
+	const (
+		head = iota
+		privileges
+		grantees
+		grantor
+		options
+	)
+	phase := head
+	for n, i := range sig[1:] {
+		tok := strings.ToUpper(tokens[i])
+		switch {
+		case tok == ",":
+			continue
+		case tok == "ON":
+			phase = privileges
+			continue
+		case tok == "TO" || tok == "FROM":
+			phase = grantees
+			continue
+		case tok == "GRANTED" && n+2 < len(sig) && strings.EqualFold(tokens[sig[n+2]], "BY"):
+			phase = grantor
+			continue
+		case tok == "BY" && phase == grantor:
+			continue
+		case tok == "WITH" || tok == "CASCADE" || tok == "RESTRICT" || tok == ";":
+			phase = options
+			continue
+		}
+		switch phase {
+		case head:
+			// GRANT role TO member, privileges are listed instead of roles before ON
+			if !hasOn {
+				roles = append(roles, i)
+			}
+		case grantees:
+			if tok != "PUBLIC" && tok != "GROUP" {
+				roles = append(roles, i)
+			}
+		case grantor:
+			roles = append(roles, i)
+			phase = options
+		}
+	}
+	return roles
+}
+
+// databaseOwner returns the owner of a renamed database, there's none with --no-owner or when the role is skipped
+func (r *roleRewriter) databaseOwner(noOwner bool, owner string) (string, bool) {
+	if noOwner || owner == "" {
+		return "", false
+	}
+	if r.empty() {
+		return owner, true
+	}
+	if r.isSkipped(owner) {
+		return "", false
+	}
+	owner, _ = r.mapRole(owner)
+	return owner, true
+}
+
+// identValue is the name of an identifier written by pg_dump: quoted ones are unescaped, others are folded
+func identValue(ident string) string {
+	if strings.HasPrefix(ident, `"`) && strings.HasSuffix(ident, `"`) && len(ident) > 1 {
+		return strings.ReplaceAll(ident[1:len(ident)-1], `""`, `"`)
+	}
+	return strings.ToLower(ident)
+}
+
+type scriptChunk struct {
+	text      string
+	statement bool
+}
+
+// splitStatements splits a psql script into statements (ending with ';'), and text between them:
+// whitespace, comments and psql meta-commands (i.e. \connect), which are kept as is.
+func splitStatements(script string) []scriptChunk {
+	var chunks []scriptChunk
+	other := func(text string) {
+		if text != "" {
+			chunks = append(chunks, scriptChunk{text: text})
+		}
+	}
+	i := 0
+	for i < len(script) {
+		start := i
+		// whitespace, comments and meta-commands
+	between:
+		for i < len(script) {
+			switch {
+			case script[i] == ' ' || script[i] == '\t' || script[i] == '\n' || script[i] == '\r':
+				i++
+			case strings.HasPrefix(script[i:], "--"), script[i] == '\\':
+				if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+					i += end + 1
+				} else {
+					i = len(script)
+				}
+			default:
+				break between
+			}
+		}
+		other(script[start:i])
+		if i == len(script) {
+			break
+		}
+
+		start = i
+		for i < len(script) && script[i] != ';' {
+			switch script[i] {
+			case '\'', '"':
+				i = skipQuoted(script, i)
+			default:
+				i++
+			}
+		}
+		if i < len(script) {
+			i++
+		}
+		chunks = append(chunks, scriptChunk{text: script[start:i], statement: true})
+	}
+	return chunks
+}
+
+// skipQuoted returns the position after the quoted literal or identifier which starts at i
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for i++; i < len(s); i++ {
+		if s[i] != quote {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(s)
+}
+
+// tokenize splits a statement into words, quoted identifiers, literals, punctuation and whitespace.
+// Tokens joined together give the statement back.
+func tokenize(statement string) []string {
+	var tokens []string
+	i := 0
+	for i < len(statement) {
+		start := i
+		c := statement[i]
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(statement, i)
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for i < len(statement) && strings.IndexByte(" \t\n\r", statement[i]) >= 0 {
+				i++
+			}
+		case isWordByte(c):
+			for i < len(statement) && isWordByte(statement[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+		tokens = append(tokens, statement[start:i])
+	}
+	return tokens
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// significant returns indexes of tokens which are not whitespace
+func significant(tokens []string) []int {
+	var sig []int
+	for i, tok := range tokens {
+		if strings.TrimSpace(tok) != "" {
+			sig = append(sig, i)
+		}
+	}
+	return sig
+}
+
+// rewriteGlobalsFile writes globals with roles rewritten to a temp file (in WorkDir), the backup itself is not changed.
+// The file has password hashes of roles, it's readable by the owner only, and must be removed after restore.
+func rewriteGlobalsFile(restoreContext *ClusterRestoreContext, globalsScript string) (string, error) {
+	data, err := os.ReadFile(globalsScript)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(restoreContext.WorkDir, "pgdump-each-globals-*.sql")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(restoreContext.roles.rewriteGlobals(string(data))); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	restoreContext.roles.logRewrite()
+	return f.Name(), nil
+}
+
+// logRewrite reports what was changed in globals
+func (r *roleRewriter) logRewrite() {
+	slog.Info("restore",
+		slog.String("globals", "roles rewritten"),
+		slog.Int("mapped-roles", len(r.mapping)),
+		slog.Int("skipped-roles", len(r.skipped)),
+		slog.Int("statements-rewritten", r.rewritten),
+		slog.Int("statements-dropped", r.dropped),
+	)
+}
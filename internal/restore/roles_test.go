@@ -0,0 +1,147 @@
+package restore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGlobals = `--
+-- PostgreSQL database cluster dump
+--
+
+\restrict abc
+
+SET default_transaction_read_only = off;
+
+--
+-- Drop roles
+--
+
+DROP ROLE IF EXISTS prod_app;
+DROP ROLE IF EXISTS "Prod Readonly";
+DROP ROLE IF EXISTS dba_alice;
+DROP ROLE IF EXISTS postgres;
+
+--
+-- Drop tablespaces
+--
+
+DROP TABLESPACE IF EXISTS fast;
+DROP TABLESPACE IF EXISTS archive;
+
+--
+-- Roles
+--
+
+CREATE ROLE prod_app;
+ALTER ROLE prod_app WITH NOSUPERUSER INHERIT NOCREATEROLE NOCREATEDB LOGIN NOREPLICATION NOBYPASSRLS PASSWORD 'SCRAM-SHA-256$4096:secret';
+COMMENT ON ROLE prod_app IS 'it''s the app; prod';
+CREATE ROLE "Prod Readonly";
+ALTER ROLE "Prod Readonly" WITH NOSUPERUSER INHERIT NOCREATEROLE NOCREATEDB LOGIN NOREPLICATION NOBYPASSRLS;
+CREATE ROLE dba_alice;
+ALTER ROLE dba_alice WITH SUPERUSER INHERIT CREATEROLE CREATEDB LOGIN NOREPLICATION NOBYPASSRLS;
+
+--
+-- Role memberships
+--
+
+GRANT prod_app TO "Prod Readonly" WITH INHERIT TRUE GRANTED BY postgres;
+GRANT pg_read_all_data TO dba_alice GRANTED BY postgres;
+
+--
+-- Tablespaces
+--
+
+CREATE TABLESPACE fast OWNER dba_alice LOCATION '/mnt/fast';
+CREATE TABLESPACE archive OWNER prod_app LOCATION '/mnt/archive';
+ALTER TABLESPACE archive OWNER TO "Prod Readonly";
+GRANT ALL ON TABLESPACE fast TO prod_app;
+`
+
+func TestRewriteGlobals(t *testing.T) {
+	roleMap := filepath.Join(t.TempDir(), "roles.map")
+	require.NoError(t, os.WriteFile(roleMap, []byte(`
+# prod -> stage
+prod_app -> stage_app
+Prod Readonly -> stage_readonly
+`), 0o600))
+
+	restoreContext := &ClusterRestoreContext{RoleMapFile: roleMap, SkipRoles: []string{"dba_alice"}, NoOwner: true, NoPrivileges: true}
+	require.NoError(t, validateRoles(restoreContext))
+
+	rewritten := restoreContext.roles.rewriteGlobals(testGlobals)
+
+	// mapped roles belong to the target environment, they're neither dropped, created nor altered
+	assert.NotContains(t, rewritten, "DROP ROLE IF EXISTS prod_app;")
+	assert.NotContains(t, rewritten, `DROP ROLE IF EXISTS "Prod Readonly";`)
+	assert.Contains(t, rewritten, "DROP ROLE IF EXISTS postgres;")
+	assert.Contains(t, rewritten, "DROP TABLESPACE IF EXISTS fast;")
+	assert.NotContains(t, rewritten, "CREATE ROLE")
+	assert.NotContains(t, rewritten, "PASSWORD")
+	assert.NotContains(t, rewritten, "COMMENT ON ROLE")
+	// skipped roles are not restored, their memberships and grants too
+	assert.NotContains(t, rewritten, "dba_alice")
+	assert.NotContains(t, rewritten, "pg_read_all_data")
+
+	// references are rewritten, the rest of the script is kept as is
+	assert.Contains(t, rewritten, `GRANT "stage_app" TO "stage_readonly" WITH INHERIT TRUE GRANTED BY postgres;`)
+	assert.Contains(t, rewritten, `CREATE TABLESPACE fast  LOCATION '/mnt/fast';`)
+	assert.Contains(t, rewritten, `CREATE TABLESPACE archive OWNER "stage_app" LOCATION '/mnt/archive';`)
+	assert.Contains(t, rewritten, `ALTER TABLESPACE archive OWNER TO "stage_readonly";`)
+	assert.Contains(t, rewritten, `GRANT ALL ON TABLESPACE fast TO "stage_app";`)
+	assert.Contains(t, rewritten, "\\restrict abc\n")
+	assert.Contains(t, rewritten, "SET default_transaction_read_only = off;")
+	assert.Equal(t, 5, restoreContext.roles.rewritten)
+	assert.Equal(t, 11, restoreContext.roles.dropped)
+}
+
+func TestRewriteGlobalsSkipOnly(t *testing.T) {
+	restoreContext := &ClusterRestoreContext{SkipRoles: []string{"Prod Readonly"}, NoOwner: true}
+	require.NoError(t, validateRoles(restoreContext))
+
+	rewritten := restoreContext.roles.rewriteGlobals(testGlobals)
+	assert.NotContains(t, rewritten, "Prod Readonly")
+	assert.Contains(t, rewritten, "DROP ROLE IF EXISTS prod_app;")
+	assert.Contains(t, rewritten, "CREATE ROLE prod_app;")
+	assert.Contains(t, rewritten, "COMMENT ON ROLE prod_app IS 'it''s the app; prod';")
+	// the object of a skipped owner is not altered, it's owned by the restoring user
+	assert.NotContains(t, rewritten, "ALTER TABLESPACE archive")
+}
+
+func TestValidateRoles(t *testing.T) {
+	roleMap := filepath.Join(t.TempDir(), "roles.map")
+
+	require.NoError(t, os.WriteFile(roleMap, []byte("prod_app => stage_app\n"), 0o600))
+	err := validateRoles(&ClusterRestoreContext{RoleMapFile: roleMap})
+	assert.ErrorContains(t, err, "roles.map:1: invalid role mapping")
+
+	require.NoError(t, os.WriteFile(roleMap, []byte("prod_app -> stage_app\nprod_app -> other\n"), 0o600))
+	err = validateRoles(&ClusterRestoreContext{RoleMapFile: roleMap})
+	assert.ErrorContains(t, err, "roles.map:2: role is mapped more than once")
+
+	require.NoError(t, os.WriteFile(roleMap, []byte("prod_app -> stage_app\n"), 0o600))
+	err = validateRoles(&ClusterRestoreContext{RoleMapFile: roleMap, SkipRoles: []string{"stage_app"}})
+	assert.ErrorContains(t, err, "both mapped and skipped")
+
+	// grants to mapped roles cannot be reassigned like owners
+	err = validateRoles(&ClusterRestoreContext{RoleMapFile: roleMap})
+	assert.ErrorContains(t, err, "--role-map requires --no-privileges")
+	// skipped roles are not created, objects they own in databases are restored without owners
+	err = validateRoles(&ClusterRestoreContext{SkipRoles: []string{"dba_alice"}})
+	assert.ErrorContains(t, err, "--skip-role requires --no-owner")
+	require.NoError(t, validateRoles(&ClusterRestoreContext{SkipRoles: []string{"dba_alice"}, NoOwner: true}))
+
+	// the owner of a renamed database
+	restoreContext := &ClusterRestoreContext{RoleMapFile: roleMap, NoPrivileges: true}
+	require.NoError(t, validateRoles(restoreContext))
+	assert.Equal(t, []string{"prod_app"}, restoreContext.roles.sources())
+	owner, ok := restoreContext.roles.databaseOwner(false, "prod_app")
+	assert.True(t, ok)
+	assert.Equal(t, `"stage_app"`, owner)
+	_, ok = restoreContext.roles.databaseOwner(true, "prod_app")
+	assert.False(t, ok)
+}
@@ -0,0 +1,207 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+const StateFileName = "restore-state.json"
+
+const (
+	statusPending = "pending"
+	statusRunning = "running"
+	statusDone    = "done"
+	statusFailed  = "failed"
+	// statusSkipped is of globals, which are not restored into a cluster that has databases of its own
+	statusSkipped = "skipped"
+)
+
+// restoreState tracks the progress of a restore, so a failed one may be resumed.
+// It is saved to the log-dir after every change (the backup dir is immutable, it's covered by checksums).
+type restoreState struct {
+	mu   sync.Mutex
+	path string
+	// databases that were started (and not finished) by a previous run
+	attempted map[string]bool
+
+	InputDir string `json:"input_dir"`
+	Globals  string `json:"globals"`
+	// ExistingCluster is set when the target cluster had databases before the restore (see --on-conflict)
+	ExistingCluster bool `json:"existing_cluster,omitempty"`
+	// PlaceholderRoles are mapped source roles created for the restore, see prepareMappedRoles
+	PlaceholderRoles []string            `json:"placeholder_roles,omitempty"`
+	Databases        map[string]*dbState `json:"databases"`
+}
+
+type dbState struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newState(restoreContext *ClusterRestoreContext, dirs, existing []*xutil.DBInfo) (*restoreState, error) {
+	inputDir, err := backupID(restoreContext.InputDir)
+	if err != nil {
+		return nil, err
+	}
+	state := &restoreState{
+		path:            filepath.Join(restoreContext.LogDir, StateFileName),
+		attempted:       map[string]bool{},
+		InputDir:        inputDir,
+		Globals:         globalsStatus(restoreContext, existing),
+		ExistingCluster: len(existing) > 0,
+		Databases:       map[string]*dbState{},
+	}
+	for _, dir := range dirs {
+		state.Databases[restoreContext.dumpTargetName(dir.DatName)] = &dbState{
+			Status:    statusPending,
+			UpdatedAt: time.Now(),
+		}
+	}
+	return state, state.save()
+}
+
+func loadState(restoreContext *ClusterRestoreContext) (*restoreState, error) {
+	path := filepath.Join(restoreContext.LogDir, StateFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot resume, state file not found: %s", path)
+		}
+		return nil, err
+	}
+
+	state := &restoreState{path: path, attempted: map[string]bool{}}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	inputDir, err := backupID(restoreContext.InputDir)
+	if err != nil {
+		return nil, err
+	}
+	if state.InputDir != inputDir {
+		return nil, fmt.Errorf("cannot resume, state file %s belongs to another backup: %s", path, state.InputDir)
+	}
+
+	for dbname, db := range state.Databases {
+		if db.Status != statusPending && db.Status != statusDone {
+			state.attempted[dbname] = true
+		}
+	}
+	return state, nil
+}
+
+// globalsStatus decides whether globals are restored: globals.sql drops and recreates roles and tablespaces
+// (pg_dumpall --clean), so they're restored into a cluster that has databases of its own only with RestoreGlobals.
+func globalsStatus(restoreContext *ClusterRestoreContext, existing []*xutil.DBInfo) string {
+	if len(existing) > 0 && !restoreContext.RestoreGlobals {
+		return statusSkipped
+	}
+	return statusPending
+}
+
+// backupID identifies the backup a state belongs to: an absolute path, or a storage URL
+func backupID(inputDir string) (string, error) {
+	if storage.IsRemote(inputDir) {
+		return inputDir, nil
+	}
+	return filepath.Abs(inputDir)
+}
+
+// resumeDumps returns dumps that are not restored yet.
+// Databases left by a failed run are dropped, databases unknown to the state are never touched.
+func resumeDumps(
+	ctx context.Context,
+	restoreContext *ClusterRestoreContext,
+	state *restoreState,
+	dirs []*xutil.DBInfo,
+	existing []*xutil.DBInfo,
+) ([]*xutil.DBInfo, error) {
+	for _, db := range existing {
+		if _, ok := state.Databases[db.DatName]; !ok {
+			return nil, fmt.Errorf("cannot resume, unknown database in target cluster: %s", db.DatName)
+		}
+	}
+
+	var pending []*xutil.DBInfo
+	for _, dir := range dirs {
+		dbname := restoreContext.dumpTargetName(dir.DatName)
+		db, ok := state.Databases[dbname]
+		if !ok {
+			db = &dbState{Status: statusPending}
+			state.Databases[dbname] = db
+		}
+		if db.Status == statusDone {
+			slog.Info("restore",
+				slog.String("status", "skip-completed"),
+				slog.String("dbname", dbname),
+			)
+			continue
+		}
+		if db.Status != statusPending && dbname != xutil.PostgresDB {
+			if err := xutil.DropDatabase(ctx, restoreContext.ConnStr, dbname); err != nil {
+				return nil, err
+			}
+			slog.Info("restore",
+				slog.String("status", "dropped-partial"),
+				slog.String("dbname", dbname),
+			)
+		}
+		pending = append(pending, dir)
+	}
+	return pending, state.save()
+}
+
+func (s *restoreState) setGlobals(status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Globals = status
+	return s.saveLocked()
+}
+
+func (s *restoreState) setDatabase(dbname, status string, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := &dbState{Status: status, UpdatedAt: time.Now()}
+	if cause != nil {
+		db.Error = cause.Error()
+	}
+	s.Databases[dbname] = db
+	return s.saveLocked()
+}
+
+func (s *restoreState) setPlaceholderRoles(roles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PlaceholderRoles = roles
+	return s.saveLocked()
+}
+
+func (s *restoreState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+// saveLocked writes the state atomically, so a crash never leaves a truncated file
+func (s *restoreState) saveLocked() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,54 @@
+package restore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateResume(t *testing.T) {
+	restoreContext := &ClusterRestoreContext{
+		InputDir: t.TempDir(),
+		LogDir:   t.TempDir(),
+	}
+	dirs := []*xutil.DBInfo{
+		{DatName: filepath.Join(restoreContext.InputDir, "d1.dmp")},
+		{DatName: filepath.Join(restoreContext.InputDir, "d2.dmp")},
+	}
+
+	state, err := newState(restoreContext, dirs, nil)
+	require.NoError(t, err)
+	require.NoError(t, state.setDatabase("d1", statusDone, nil))
+
+	loaded, err := loadState(restoreContext)
+	require.NoError(t, err)
+	assert.Equal(t, statusDone, loaded.Databases["d1"].Status)
+	assert.Equal(t, statusPending, loaded.Databases["d2"].Status)
+
+	// completed databases are skipped
+	pending, err := resumeDumps(context.Background(), restoreContext, loaded, dirs, []*xutil.DBInfo{{DatName: "d1"}})
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "d2", xutil.DumpDirDBName(pending[0].DatName))
+
+	// unknown databases are never touched
+	_, err = resumeDumps(context.Background(), restoreContext, loaded, dirs, []*xutil.DBInfo{{DatName: "d3"}})
+	assert.ErrorContains(t, err, "unknown database")
+}
+
+func TestStateBelongsToAnotherBackup(t *testing.T) {
+	restoreContext := &ClusterRestoreContext{
+		InputDir: t.TempDir(),
+		LogDir:   t.TempDir(),
+	}
+	_, err := newState(restoreContext, nil, nil)
+	require.NoError(t, err)
+
+	restoreContext.InputDir = t.TempDir()
+	_, err = loadState(restoreContext)
+	assert.ErrorContains(t, err, "belongs to another backup")
+}
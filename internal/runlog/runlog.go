@@ -0,0 +1,121 @@
+package runlog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// ToolLogFileName is the log of pgdump-each itself in the run dir, logs of subprocesses are next to it
+	ToolLogFileName = "pgdump-each.log"
+)
+
+// Logger is the default slog logger of a run, every line has the run ID.
+// Lines are printed to the console, and to the run dir once it's opened (see OpenRunDir).
+type Logger struct {
+	runID  string
+	format string
+	level  slog.Level
+	dir    string
+	file   *os.File
+}
+
+// Setup validates the format and the level, and installs the logger as the default one.
+func Setup(format, level string) (*Logger, error) {
+	l := &Logger{runID: newRunID(), format: format}
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("unknown log format: %s (expected: %s or %s)", format, FormatText, FormatJSON)
+	}
+	if err := l.level.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level: %s (expected: debug, info, warn or error)", level)
+	}
+	l.install(xutil.ConsoleWriter())
+	return l, nil
+}
+
+// newRunID is unique enough to tell runs apart in aggregated logs, and sorts by time
+func newRunID() string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func (l *Logger) install(w io.Writer) {
+	opts := &slog.HandlerOptions{Level: l.level}
+	var h slog.Handler
+	if l.format == FormatJSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h).With(slog.String("run-id", l.runID)))
+}
+
+func (l *Logger) RunID() string {
+	return l.runID
+}
+
+// Dir is the run dir, it's empty until OpenRunDir
+func (l *Logger) Dir() string {
+	return l.dir
+}
+
+// OpenRunDir creates '<baseDir>/<operation>-<run-id>', and logs into its ToolLogFileName from now on.
+func (l *Logger) OpenRunDir(baseDir, operation string) error {
+	dir := filepath.Join(baseDir, operation+"-"+l.runID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create log dir %s, cause: %w", dir, err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, ToolLogFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.dir = dir
+	l.file = file
+	l.install(io.MultiWriter(xutil.ConsoleWriter(), file))
+	slog.Info("log", slog.String("dir", filepath.ToSlash(dir)))
+	return nil
+}
+
+// Close stops logging into the run dir
+func (l *Logger) Close() {
+	if l.file == nil {
+		return
+	}
+	l.install(xutil.ConsoleWriter())
+	if err := l.file.Close(); err != nil {
+		slog.Warn("log", slog.String("err-close", err.Error()))
+	}
+	l.file = nil
+}
+
+// CreateFile creates a log of a subprocess in the run dir, logs are discarded without it.
+func CreateFile(runDir, name string) (io.WriteCloser, error) {
+	if runDir == "" {
+		return nopCloser{io.Discard}, nil
+	}
+	f, err := os.Create(filepath.Join(runDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %w", err)
+	}
+	return f, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package runlog
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	_, err := Setup("xml", "info")
+	assert.ErrorContains(t, err, "unknown log format")
+	_, err = Setup(FormatText, "verbose")
+	assert.ErrorContains(t, err, "unknown log level")
+
+	l, err := Setup(FormatJSON, "warn")
+	require.NoError(t, err)
+	assert.Regexp(t, `^\d{14}-[0-9a-f]{6}$`, l.RunID())
+	assert.Empty(t, l.Dir())
+}
+
+func TestOpenRunDir(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	l, err := Setup(FormatJSON, "info")
+	require.NoError(t, err)
+	base := t.TempDir()
+	require.NoError(t, l.OpenRunDir(base, "dump"))
+	assert.Equal(t, filepath.Join(base, "dump-"+l.RunID()), l.Dir())
+
+	slog.Debug("dump", slog.String("status", "hidden"))
+	slog.Info("dump", slog.String("status", "ok"))
+	logFile, err := CreateFile(l.Dir(), "pg_dump-db1.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(logFile, "pg_dump: error: connection failed\n")
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+	l.Close()
+
+	data, err := os.ReadFile(filepath.Join(l.Dir(), ToolLogFileName))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2) // the dir itself, and the 'ok' line
+	for _, line := range lines {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, l.RunID(), record["run-id"])
+	}
+	assert.Contains(t, lines[1], `"status":"ok"`)
+
+	data, err = os.ReadFile(filepath.Join(l.Dir(), "pg_dump-db1.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "pg_dump: error: connection failed\n", string(data))
+
+	// nothing is written without the run dir
+	discard, err := CreateFile("", "pg_dump-db1.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(discard, "lost")
+	require.NoError(t, err)
+	require.NoError(t, discard.Close())
+}
@@ -0,0 +1,110 @@
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// Method is recorded in the manifest of signed backups
+	Method = "ed25519"
+	// Suffix is appended to the name of the signed file, i.e. 'checksums.txt.sig'
+	Suffix = ".sig"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// LoadPrivateKey reads a PEM-encoded PKCS #8 Ed25519 private key,
+// i.e. created by 'openssl genpkey -algorithm ed25519 -out signing.pem'
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an %s private key", path, Method)
+	}
+	return privateKey, nil
+}
+
+// LoadPublicKey reads a PEM-encoded PKIX Ed25519 public key,
+// i.e. created by 'openssl pkey -in signing.pem -pubout -out signing.pub'
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an %s public key", path, Method)
+	}
+	return publicKey, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: PEM block %q is not found", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// PublicKeyString returns the base64 public key, it is recorded in the manifest,
+// so it is known which key the backup is verifiable with.
+func PublicKeyString(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// SignFile writes a detached signature of the file next to it (path + Suffix).
+func SignFile(path string, key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return os.WriteFile(path+Suffix, []byte(signature+"\n"), 0o600)
+}
+
+// Verify checks the detached signature (as written by SignFile) of data.
+func Verify(data, signature []byte, key ed25519.PublicKey) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(key, data, raw) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyFile checks the detached signature of the file (path + Suffix).
+func VerifyFile(path string, key ed25519.PublicKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signature, err := os.ReadFile(path + Suffix)
+	if err != nil {
+		return fmt.Errorf("backup is not signed: %w", err)
+	}
+	return Verify(data, signature, key)
+}
@@ -0,0 +1,65 @@
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeys(t *testing.T, dir string) (privatePath, publicPath string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+
+	privatePath = filepath.Join(dir, "signing.pem")
+	publicPath = filepath.Join(dir, "signing.pub")
+	require.NoError(t, os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0o600))
+	require.NoError(t, os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0o600))
+	return privatePath, publicPath
+}
+
+func TestSignVerifyFile(t *testing.T) {
+	dir := t.TempDir()
+	privatePath, publicPath := writeKeys(t, dir)
+	_, strangerPath := writeKeys(t, t.TempDir())
+
+	privateKey, err := LoadPrivateKey(privatePath)
+	require.NoError(t, err)
+	publicKey, err := LoadPublicKey(publicPath)
+	require.NoError(t, err)
+	stranger, err := LoadPublicKey(strangerPath)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "checksums.txt")
+	require.NoError(t, os.WriteFile(path, []byte("abc  globals.sql\n"), 0o600))
+	assert.ErrorContains(t, VerifyFile(path, publicKey), "backup is not signed")
+
+	require.NoError(t, SignFile(path, privateKey))
+	assert.NoError(t, VerifyFile(path, publicKey))
+	assert.ErrorIs(t, VerifyFile(path, stranger), ErrInvalidSignature)
+
+	// checksums regenerated after tampering
+	require.NoError(t, os.WriteFile(path, []byte("def  globals.sql\n"), 0o600))
+	assert.ErrorIs(t, VerifyFile(path, publicKey), ErrInvalidSignature)
+}
+
+func TestLoadKeyErrors(t *testing.T) {
+	privatePath, publicPath := writeKeys(t, t.TempDir())
+
+	_, err := LoadPublicKey(privatePath)
+	assert.ErrorContains(t, err, `PEM block "PUBLIC KEY" is not found`)
+	_, err = LoadPrivateKey(publicPath)
+	assert.ErrorContains(t, err, `PEM block "PRIVATE KEY" is not found`)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type localStorage struct {
+	root string
+}
+
+var _ Storage = &localStorage{}
+
+func NewLocal(root string) Storage {
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	p := s.LocalPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localStorage) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.LocalPath(key))
+}
+
+func (s *localStorage) List(_ context.Context, prefix string) ([]*ObjectInfo, error) {
+	var result []*ObjectInfo
+	if _, err := os.Stat(s.LocalPath(prefix)); os.IsNotExist(err) {
+		return result, nil
+	}
+	err := filepath.Walk(s.LocalPath(prefix), func(p string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		result = append(result, &ObjectInfo{Key: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *localStorage) Remove(_ context.Context, prefix string) error {
+	return os.RemoveAll(s.LocalPath(prefix))
+}
+
+func (s *localStorage) IsLocal() bool {
+	return true
+}
+
+func (s *localStorage) LocalPath(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *localStorage) String() string {
+	return s.root
+}
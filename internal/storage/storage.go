@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const s3Scheme = "s3://"
+
+// ObjectInfo describes a single file in a storage, the Key is slash-separated and relative to the storage root.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// Storage is where finished backups are kept: a local directory, or an S3-compatible bucket.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns all objects under the prefix, recursively
+	List(ctx context.Context, prefix string) ([]*ObjectInfo, error)
+	// Remove deletes all objects under the prefix
+	Remove(ctx context.Context, prefix string) error
+	// IsLocal reports whether keys are plain files under LocalPath, so pg_dump/pg_restore may use them directly
+	IsLocal() bool
+	LocalPath(key string) string
+	String() string
+}
+
+type Options struct {
+	S3Endpoint string
+	S3Region   string
+}
+
+// IsRemote reports whether the location is an object storage URL, i.e. 's3://bucket/prefix'
+func IsRemote(location string) bool {
+	return strings.HasPrefix(location, s3Scheme)
+}
+
+// Open returns a storage for the location, and the prefix of the location inside of it.
+func Open(location string, opts *Options) (st Storage, prefix string, err error) {
+	if !IsRemote(location) {
+		return NewLocal(location), "", nil
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, s3Scheme), "/")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("invalid s3 location, bucket is required: %s", location)
+	}
+	st, err = NewS3(bucket, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return st, strings.Trim(prefix, "/"), nil
+}
+
+// Join concatenates keys
+func Join(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+// UploadDir copies every file of the local directory into the storage under the prefix.
+func UploadDir(ctx context.Context, st Storage, localDir, prefix string) error {
+	return filepath.Walk(localDir, func(p string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		return UploadFile(ctx, st, p, Join(prefix, filepath.ToSlash(rel)))
+	})
+}
+
+func UploadFile(ctx context.Context, st Storage, localPath, key string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := st.Put(ctx, key, f, info.Size()); err != nil {
+		return fmt.Errorf("cannot upload %s to %s: %w", localPath, key, err)
+	}
+	return nil
+}
+
+// DownloadDir copies every object under the prefix into the local directory.
+func DownloadDir(ctx context.Context, st Storage, prefix, localDir string) error {
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(strings.TrimPrefix(obj.Key, prefix), "/")
+		if err := DownloadFile(ctx, st, obj.Key, filepath.Join(localDir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DownloadFile(ctx context.Context, st Storage, key, localPath string) error {
+	r, err := st.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("cannot download %s: %w", key, err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("cannot download %s: %w", key, err)
+	}
+	return f.Close()
+}
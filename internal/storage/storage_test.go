@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	st, prefix, err := Open("./backups", &Options{})
+	require.NoError(t, err)
+	assert.True(t, st.IsLocal())
+	assert.Empty(t, prefix)
+
+	_, _, err = Open("s3:///prefix", &Options{})
+	assert.Error(t, err)
+}
+
+func TestUploadDownloadDir(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "db1.dmp", "data"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "db1.dmp", "data", "toc.dat"), []byte("toc"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "globals.sql"), []byte("roles"), 0o600))
+
+	st := NewLocal(t.TempDir())
+	require.NoError(t, UploadDir(ctx, st, src, "20250328154501.dmp"))
+
+	objects, err := st.List(ctx, "20250328154501.dmp")
+	require.NoError(t, err)
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	assert.ElementsMatch(t, []string{
+		"20250328154501.dmp/db1.dmp/data/toc.dat",
+		"20250328154501.dmp/globals.sql",
+	}, keys)
+
+	dst := t.TempDir()
+	require.NoError(t, DownloadDir(ctx, st, "20250328154501.dmp/db1.dmp", dst))
+	data, err := os.ReadFile(filepath.Join(dst, "data", "toc.dat"))
+	require.NoError(t, err)
+	assert.Equal(t, "toc", string(data))
+
+	require.NoError(t, st.Remove(ctx, "20250328154501.dmp"))
+	objects, err = st.List(ctx, "20250328154501.dmp")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
@@ -0,0 +1,450 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"filippo.io/age"
+	"github.com/hashmap-kz/pgdump-each/internal/crypt"
+	"github.com/hashmap-kz/pgdump-each/internal/manifest"
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+)
+
+const (
+	// problem kinds, in addition to xutil.Checksum* ones
+	problemUnreadable  = "unreadable"
+	problemToc         = "toc"
+	problemMissingDump = "missing-dump"
+	problemSignature   = "signature"
+
+	tocStatusOK      = "ok"
+	tocStatusFailed  = "failed"
+	tocStatusSkipped = "skipped"
+)
+
+type VerifyContext struct {
+	// Location is a backup dir: a local path, or s3://bucket/prefix/<timestamp>.dmp
+	Location       string
+	StorageOptions storage.Options
+	PgBinPath      string
+	// ChecksumWorkers is the number of files hashed concurrently
+	ChecksumWorkers int
+	// DecryptIdentities are age identity files, toc.dat of encrypted backups is checked only if they're set
+	DecryptIdentities []string
+	// VerifyKey is a PEM Ed25519 public key file, checksums.txt must be signed with its private key (optional)
+	VerifyKey string
+	WorkDir   string
+	// ReportPath is a file to save JSON report to (optional)
+	ReportPath string
+}
+
+type Report struct {
+	Location  string            `json:"location"`
+	Passed    bool              `json:"passed"`
+	Files     int               `json:"files"`
+	Problems  []*Problem        `json:"problems"`
+	Databases []*DatabaseReport `json:"databases"`
+}
+
+type Problem struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path"`
+	Message string `json:"message,omitempty"`
+}
+
+type DatabaseReport struct {
+	DatName    string `json:"datname"`
+	TocStatus  string `json:"toc_status"`
+	TocEntries int    `json:"toc_entries"`
+	Message    string `json:"message,omitempty"`
+}
+
+// RunVerify checks the integrity of a backup: checksums of every file, and readability of every dump's toc.dat.
+// Every problem is reported, an error is returned if there are any.
+func RunVerify(ctx context.Context, verifyContext *VerifyContext) (*Report, error) {
+	st, prefix, err := storage.Open(verifyContext.Location, &verifyContext.StorageOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var verifyKey ed25519.PublicKey
+	if verifyContext.VerifyKey != "" {
+		verifyKey, err = sign.LoadPublicKey(verifyContext.VerifyKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("backup not found: %s", verifyContext.Location)
+	}
+
+	algorithm, expected, err := readChecksums(ctx, st, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Location: verifyContext.Location, Problems: []*Problem{}, Databases: []*DatabaseReport{}}
+	if verifyKey != nil {
+		if p := checkSignature(ctx, st, prefix, verifyKey); p != nil {
+			report.Problems = append(report.Problems, p)
+		}
+	}
+
+	current, unreadable := hashObjects(ctx, verifyContext, st, prefix, objects, algorithm)
+	report.Files = len(current) + len(unreadable)
+	for _, p := range xutil.DiffChecksums(expected, current) {
+		if _, ok := unreadable[p.Path]; ok {
+			continue
+		}
+		report.Problems = append(report.Problems, &Problem{Kind: p.Kind, Path: p.Path})
+	}
+	for rel, readErr := range unreadable {
+		report.Problems = append(report.Problems, &Problem{Kind: problemUnreadable, Path: rel, Message: readErr.Error()})
+	}
+
+	if err := checkDumps(ctx, verifyContext, st, prefix, report, expected); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Path < report.Problems[j].Path
+	})
+	report.Passed = len(report.Problems) == 0
+
+	slog.Info("verify",
+		slog.String("location", verifyContext.Location),
+		slog.Int("files", report.Files),
+		slog.Int("problems", len(report.Problems)),
+	)
+
+	if verifyContext.ReportPath != "" {
+		if err := writeReport(verifyContext.ReportPath, report); err != nil {
+			return report, err
+		}
+	}
+	if !report.Passed {
+		return report, fmt.Errorf("backup verification failed: %d problem(s)", len(report.Problems))
+	}
+	return report, nil
+}
+
+// readChecksums returns the algorithm, and expected checksums of all files (nested checksums files are expanded)
+func readChecksums(ctx context.Context, st storage.Storage, prefix string) (string, map[string]string, error) {
+	r, err := st.Get(ctx, storage.Join(prefix, xutil.ChecksumsFileName))
+	if err != nil {
+		return "", nil, fmt.Errorf("backup is incomplete, cannot read %s: %w", xutil.ChecksumsFileName, err)
+	}
+	defer r.Close()
+	list, err := xutil.ParseChecksums(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("backup is incomplete, cannot read %s: %w", xutil.ChecksumsFileName, err)
+	}
+	expected, err := xutil.ExpandChecksums(list, func(rel string) (io.ReadCloser, error) {
+		data, err := readObject(ctx, st, storage.Join(prefix, rel))
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return list.Algorithm, expected, nil
+}
+
+// checkSignature ensures checksums.txt is signed by the key, so checksums themselves may be trusted
+func checkSignature(ctx context.Context, st storage.Storage, prefix string, key ed25519.PublicKey) *Problem {
+	problem := func(err error) *Problem {
+		return &Problem{Kind: problemSignature, Path: xutil.ChecksumsSignatureFileName, Message: err.Error()}
+	}
+	data, err := readObject(ctx, st, storage.Join(prefix, xutil.ChecksumsFileName))
+	if err != nil {
+		return problem(err)
+	}
+	signature, err := readObject(ctx, st, storage.Join(prefix, xutil.ChecksumsSignatureFileName))
+	if err != nil {
+		return problem(fmt.Errorf("backup is not signed: %w", err))
+	}
+	if err := sign.Verify(data, signature, key); err != nil {
+		return problem(err)
+	}
+	return nil
+}
+
+// hashObjects streams every object of the backup through a hasher, nothing is stored locally.
+// Keys of results are relative to the backup root.
+func hashObjects(
+	ctx context.Context,
+	verifyContext *VerifyContext,
+	st storage.Storage,
+	prefix string,
+	objects []*storage.ObjectInfo,
+	algorithm string,
+) (current map[string]string, unreadable map[string]error) {
+	current = map[string]string{}
+	unreadable = map[string]error{}
+
+	workerCount := verifyContext.ChecksumWorkers
+	if workerCount < 1 {
+		workerCount = runtime.NumCPU()
+	}
+	objChan := make(chan *storage.ObjectInfo, len(objects))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range objChan {
+				rel := strings.TrimPrefix(strings.TrimPrefix(obj.Key, prefix), "/")
+				checksum, err := hashObject(ctx, st, obj.Key, algorithm)
+				mu.Lock()
+				if err != nil {
+					unreadable[rel] = err
+				} else {
+					current[rel] = checksum
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, obj := range objects {
+		switch strings.TrimPrefix(strings.TrimPrefix(obj.Key, prefix), "/") {
+		case xutil.ChecksumsFileName, xutil.ChecksumsSignatureFileName:
+			continue
+		}
+		objChan <- obj
+	}
+	close(objChan)
+	wg.Wait()
+	return current, unreadable
+}
+
+func hashObject(ctx context.Context, st storage.Storage, key, algorithm string) (string, error) {
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	hasher, err := xutil.NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	r, err := st.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return xutil.ComputeChecksum(r, hasher)
+}
+
+// checkDumps ensures every dump recorded in the manifest exists, and its toc.dat is readable by pg_restore
+func checkDumps(
+	ctx context.Context,
+	verifyContext *VerifyContext,
+	st storage.Storage,
+	prefix string,
+	report *Report,
+	expected map[string]string,
+) error {
+	// dbname -> dump dir, relative to the location
+	dumps := map[string]string{}
+	for rel := range expected {
+		if dir, _, ok := strings.Cut(rel, "/"); ok && strings.HasSuffix(dir, ".dmp") {
+			dumps[xutil.DumpDirDBName(dir)] = dir
+		}
+	}
+	if isDumpDir(expected) {
+		// the location is a single '<dbname>.dmp' dir of a backup
+		dumps[xutil.DumpDirDBName(strings.TrimRight(verifyContext.Location, "/"))] = ""
+	}
+
+	var m *manifest.Manifest
+	if _, ok := expected[manifest.FileName]; ok {
+		data, err := readObject(ctx, st, storage.Join(prefix, manifest.FileName))
+		if err == nil {
+			m, err = manifest.Parse(data)
+		}
+		if err != nil {
+			report.Problems = append(report.Problems, &Problem{Kind: problemUnreadable, Path: manifest.FileName, Message: err.Error()})
+		}
+	}
+	if m != nil {
+		for _, db := range m.Databases {
+			if _, ok := dumps[db.DatName]; !ok {
+				report.Problems = append(report.Problems, &Problem{
+					Kind:    problemMissingDump,
+					Path:    db.DatName + ".dmp",
+					Message: "database is recorded in the manifest, but its dump is not found",
+				})
+			}
+		}
+	}
+
+	identities, err := crypt.LoadIdentities(verifyContext.DecryptIdentities)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp(verifyContext.WorkDir, "pgdump-each-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	names := make([]string, 0, len(dumps))
+	for dbname := range dumps {
+		names = append(names, dbname)
+	}
+	sort.Strings(names)
+
+	for _, dbname := range names {
+		dumpRel := dumps[dbname]
+		dbReport := checkToc(ctx, verifyContext, st, prefix, workDir, dbname, dumpRel, expected, identities)
+		report.Databases = append(report.Databases, dbReport)
+		if dbReport.TocStatus == tocStatusFailed {
+			report.Problems = append(report.Problems, &Problem{
+				Kind:    problemToc,
+				Path:    storage.Join(dumpRel, "data/toc.dat"),
+				Message: dbReport.Message,
+			})
+		}
+	}
+	return nil
+}
+
+func isDumpDir(expected map[string]string) bool {
+	_, plain := expected["data/toc.dat"]
+	_, encrypted := expected["data/toc.dat"+crypt.Suffix]
+	return plain || encrypted
+}
+
+// checkToc fetches (and decrypts) toc.dat alone, 'pg_restore --list' does not need anything else
+func checkToc(
+	ctx context.Context,
+	verifyContext *VerifyContext,
+	st storage.Storage,
+	prefix, workDir, dbname, dumpRel string,
+	expected map[string]string,
+	identities []age.Identity,
+) *DatabaseReport {
+	dbReport := &DatabaseReport{DatName: dbname}
+	fail := func(err error) *DatabaseReport {
+		dbReport.TocStatus = tocStatusFailed
+		dbReport.Message = err.Error()
+		return dbReport
+	}
+
+	tocRel := storage.Join(dumpRel, "data/toc.dat")
+	encrypted := false
+	if _, ok := expected[tocRel]; !ok {
+		if _, ok := expected[tocRel+crypt.Suffix]; !ok {
+			return fail(fmt.Errorf("toc.dat is not found"))
+		}
+		encrypted = true
+	}
+	if encrypted && len(identities) == 0 {
+		dbReport.TocStatus = tocStatusSkipped
+		dbReport.Message = "encrypted, --decrypt-identity is not set"
+		return dbReport
+	}
+
+	dataDir := filepath.Join(workDir, dbname, "data")
+	tocPath := filepath.Join(dataDir, "toc.dat")
+	if encrypted {
+		if err := storage.DownloadFile(ctx, st, storage.Join(prefix, tocRel+crypt.Suffix), tocPath+crypt.Suffix); err != nil {
+			return fail(err)
+		}
+		if err := crypt.DecryptFile(tocPath+crypt.Suffix, tocPath, identities); err != nil {
+			return fail(err)
+		}
+	} else if err := storage.DownloadFile(ctx, st, storage.Join(prefix, tocRel), tocPath); err != nil {
+		return fail(err)
+	}
+
+	pgRestore, err := xutil.GetExec(verifyContext.PgBinPath, "pg_restore")
+	if err != nil {
+		return fail(err)
+	}
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd := exec.Command(pgRestore, "--list", dataDir)
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	if err := xutil.RunCmd(ctx, cmd); err != nil {
+		return fail(fmt.Errorf("pg_restore --list: %v - %s", err, strings.TrimSpace(stderrBuf.String())))
+	}
+
+	dbReport.TocStatus = tocStatusOK
+	dbReport.TocEntries = countTocEntries(stdoutBuf.Bytes())
+	return dbReport
+}
+
+// countTocEntries counts lines of 'pg_restore --list' output, except comments
+func countTocEntries(listing []byte) int {
+	n := 0
+	for _, line := range strings.Split(string(listing), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, ";") {
+			n++
+		}
+	}
+	return n
+}
+
+func readObject(ctx context.Context, st storage.Storage, key string) ([]byte, error) {
+	r, err := st.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func writeReport(path string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// PrintReport renders databases and problems as human-readable tables.
+func PrintReport(w io.Writer, report *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tTOC\tENTRIES\tMESSAGE")
+	for _, db := range report.Databases {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", db.DatName, db.TocStatus, db.TocEntries, db.Message)
+	}
+	if len(report.Problems) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "PROBLEM\tPATH\tMESSAGE")
+		for _, p := range report.Problems {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Kind, p.Path, p.Message)
+		}
+	}
+	result := "PASS"
+	if !report.Passed {
+		result = "FAIL"
+	}
+	fmt.Fprintf(tw, "\nfiles: %d, problems: %d, result: %s\n", report.Files, len(report.Problems), result)
+	return tw.Flush()
+}
@@ -0,0 +1,142 @@
+//go:build !windows
+
+package verify
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashmap-kz/pgdump-each/internal/sign"
+	"github.com/hashmap-kz/pgdump-each/internal/xutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePgRestore lists toc.dat that contains 'valid', and fails otherwise
+func fakePgRestore(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+if grep -q valid "$2/toc.dat"; then
+  printf ';\n; Archive created at ...\n;\n1; 2615 2200 SCHEMA - public pg_database_owner\n2; 1259 16385 TABLE public t1 postgres\n'
+else
+  echo 'pg_restore: error: did not find magic string in file header' >&2
+  exit 1
+fi
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pg_restore"), []byte(script), 0o700))
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestRunVerify(t *testing.T) {
+	ctx := context.Background()
+	backupDir := filepath.Join(t.TempDir(), "20250328154501.dmp")
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "toc.dat"), "valid")
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "3001.dat"), "rows")
+	writeFile(t, filepath.Join(backupDir, "d2.dmp", "data", "toc.dat"), "corrupted")
+	writeFile(t, filepath.Join(backupDir, "globals.sql"), "roles")
+	require.NoError(t, xutil.WriteChecksumsFile(backupDir, 2, ""))
+
+	verifyContext := &VerifyContext{
+		Location:        backupDir,
+		PgBinPath:       fakePgRestore(t),
+		ChecksumWorkers: 2,
+		ReportPath:      filepath.Join(t.TempDir(), "report.json"),
+	}
+
+	report, err := RunVerify(ctx, verifyContext)
+	require.Error(t, err)
+	require.Len(t, report.Databases, 2)
+	assert.Equal(t, tocStatusOK, report.Databases[0].TocStatus)
+	assert.Equal(t, 2, report.Databases[0].TocEntries)
+	assert.Equal(t, tocStatusFailed, report.Databases[1].TocStatus)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, problemToc, report.Problems[0].Kind)
+	assert.FileExists(t, verifyContext.ReportPath)
+
+	// every problem is reported, not only the first one
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "3001.dat"), "tampered")
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "9999.dat"), "stray")
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "globals.sql")))
+
+	report, err = RunVerify(ctx, verifyContext)
+	require.Error(t, err)
+	kinds := map[string]string{}
+	for _, p := range report.Problems {
+		kinds[p.Path] = p.Kind
+	}
+	assert.Equal(t, map[string]string{
+		"d1.dmp/data/3001.dat": xutil.ChecksumMismatch,
+		"d1.dmp/data/9999.dat": xutil.ChecksumStray,
+		"d2.dmp/data/toc.dat":  problemToc,
+		"globals.sql":          xutil.ChecksumMissing,
+	}, kinds)
+	assert.False(t, report.Passed)
+}
+
+func TestRunVerifySingleDump(t *testing.T) {
+	ctx := context.Background()
+	backupDir := filepath.Join(t.TempDir(), "20250328154501.dmp")
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "toc.dat"), "valid")
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "3001.dat"), "rows")
+	require.NoError(t, xutil.WriteChecksumsFile(backupDir, 2, xutil.HashBLAKE3))
+
+	verifyContext := &VerifyContext{
+		Location:        filepath.Join(backupDir, "d1.dmp"),
+		PgBinPath:       fakePgRestore(t),
+		ChecksumWorkers: 2,
+	}
+	report, err := RunVerify(ctx, verifyContext)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Files)
+	require.Len(t, report.Databases, 1)
+	assert.Equal(t, "d1", report.Databases[0].DatName)
+	assert.Equal(t, tocStatusOK, report.Databases[0].TocStatus)
+
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "3001.dat"), "tampered")
+	report, err = RunVerify(ctx, verifyContext)
+	require.Error(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, "data/3001.dat", report.Problems[0].Path)
+}
+
+func TestRunVerifySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "signing.pub")
+	writeFile(t, keyPath, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})))
+
+	ctx := context.Background()
+	backupDir := filepath.Join(t.TempDir(), "20250328154501.dmp")
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "toc.dat"), "valid")
+	require.NoError(t, xutil.WriteChecksumsFile(backupDir, 2, ""))
+	require.NoError(t, sign.SignFile(filepath.Join(backupDir, xutil.ChecksumsFileName), privateKey))
+
+	verifyContext := &VerifyContext{Location: backupDir, PgBinPath: fakePgRestore(t), VerifyKey: keyPath}
+	report, err := RunVerify(ctx, verifyContext)
+	require.NoError(t, err)
+	// the signature is not a part of checksums
+	assert.Equal(t, 2, report.Files)
+
+	// checksums are regenerated after tampering, they match, but the signature does not
+	writeFile(t, filepath.Join(backupDir, "d1.dmp", "data", "toc.dat"), "valid, tampered")
+	require.NoError(t, xutil.WriteChecksumsFile(backupDir, 2, ""))
+	report, err = RunVerify(ctx, verifyContext)
+	require.Error(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, problemSignature, report.Problems[0].Kind)
+}
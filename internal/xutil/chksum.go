@@ -3,123 +3,444 @@ package xutil
 import (
 	"bufio"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+
+	"lukechampine.com/blake3"
 )
 
+// ChecksumsFileName is written into the backup root, and into every '<dbname>.dmp' dir.
+// The root one lists files of the root, and checksums.txt of every dir, so each dir may be verified alone.
 const ChecksumsFileName = "checksums.txt"
 
-func WriteChecksumsFile(stageDir string) error {
-	f, err := os.Create(filepath.Join(stageDir, ChecksumsFileName))
+// ChecksumsSignatureFileName is a detached signature of the root checksums file (optional), it's not listed in it.
+const ChecksumsSignatureFileName = ChecksumsFileName + ".sig"
+
+const (
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+	HashBLAKE3 = "blake3"
+
+	// DefaultHash is also assumed for checksums files without the algorithm header (older backups)
+	DefaultHash = HashSHA256
+
+	algorithmHeader = "# algorithm: "
+)
+
+const (
+	ChecksumMismatch = "mismatch"
+	// ChecksumMissing is a file listed in checksums, but absent in the backup
+	ChecksumMissing = "missing"
+	// ChecksumStray is a file presented in the backup, but not listed in checksums
+	ChecksumStray = "stray"
+)
+
+type ChecksumProblem struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// ChecksumsList is the content of a checksums file, paths are relative to its dir.
+type ChecksumsList struct {
+	Algorithm string
+	Sums      map[string]string
+}
+
+// NewHash returns a hasher for the algorithm name.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	case HashBLAKE3:
+		return blake3.New(32, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %q (expected %s, %s or %s)",
+			algorithm, HashSHA256, HashSHA512, HashBLAKE3)
+	}
+}
+
+// Checksums collects checksums of files under root, they may be added piece by piece (i.e. a database dump
+// as soon as it is finished), while other pieces are still being written.
+// All files are hashed by a single pool of workers, no matter how many pieces are added concurrently.
+type Checksums struct {
+	root      string
+	algorithm string
+	sem       chan struct{}
+
+	mu    sync.Mutex
+	added map[string]bool
+}
+
+// NewChecksums creates a collector, workers < 1 means the number of CPUs, empty algorithm means DefaultHash.
+func NewChecksums(root string, workers int, algorithm string) (*Checksums, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if algorithm == "" {
+		algorithm = DefaultHash
+	}
+	if _, err := NewHash(algorithm); err != nil {
+		return nil, err
+	}
+	return &Checksums{
+		root:      root,
+		algorithm: algorithm,
+		sem:       make(chan struct{}, workers),
+		added:     map[string]bool{},
+	}, nil
+}
+
+// Add computes checksums of all files of the dir (i.e. 'mydb.dmp', relative to root), and writes its checksums.txt.
+func (c *Checksums) Add(dir string) error {
+	files, err := c.collect(dir, filepath.Join(dir, ChecksumsFileName))
+	if err != nil {
+		return err
+	}
+	sums, err := c.hashFiles(files)
+	if err != nil {
+		return err
+	}
+	relSums := make(map[string]string, len(sums))
+	for k, v := range sums {
+		relSums[strings.TrimPrefix(k, filepath.ToSlash(dir)+"/")] = v
+	}
+	if err := writeChecksumsList(filepath.Join(c.root, dir, ChecksumsFileName), c.algorithm, relSums); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.added[dir] = true
+	return nil
+}
+
+// Write adds dirs that were not added yet, and writes the root checksums.txt:
+// files of the root, and checksums.txt of every dir.
+func (c *Checksums) Write() error {
+	entries, err := os.ReadDir(c.root)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	checksums, err := getChecksums(stageDir)
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			if name != ChecksumsFileName && name != ChecksumsSignatureFileName {
+				files = append(files, name)
+			}
+			continue
+		}
+		c.mu.Lock()
+		added := c.added[name]
+		c.mu.Unlock()
+		if !added {
+			if err := c.Add(name); err != nil {
+				return err
+			}
+		}
+		files = append(files, name+"/"+ChecksumsFileName)
+	}
+
+	sums, err := c.hashFiles(files)
 	if err != nil {
 		return err
 	}
+	return writeChecksumsList(filepath.Join(c.root, ChecksumsFileName), c.algorithm, sums)
+}
 
-	for k, v := range checksums {
-		_, err := fmt.Fprintf(f, "%s  %s\n", v, k)
+// collect returns paths of all files under root/prefix, except the excluded ones, relative to root
+func (c *Checksums) collect(prefix string, exclude ...string) ([]string, error) {
+	excluded := make(map[string]bool, len(exclude))
+	for _, e := range exclude {
+		excluded[filepath.ToSlash(e)] = true
+	}
+	var files []string
+	err := filepath.Walk(filepath.Join(c.root, filepath.FromSlash(prefix)), func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return fmt.Errorf("error encountered during dir traverse %v: %w", path, walkErr)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(c.root, path)
 		if err != nil {
 			return err
 		}
+		if rel := filepath.ToSlash(relPath); !excluded[rel] {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// hashFiles hashes files (relative to root) concurrently
+func (c *Checksums) hashFiles(files []string) (map[string]string, error) {
+	sums := make(map[string]string, len(files))
+	fileChan := make(chan string, len(files))
+	for _, rel := range files {
+		fileChan <- rel
 	}
-	return nil
+	close(fileChan)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i := 0; i < min(cap(c.sem), len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range fileChan {
+				c.sem <- struct{}{}
+				checksum, err := c.computeChecksum(filepath.Join(c.root, filepath.FromSlash(rel)))
+				<-c.sem
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				sums[rel] = checksum
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return sums, nil
 }
 
-func CompareChecksums(root string) error {
-	expected, err := scanChecksumsFromFile(filepath.Join(root, ChecksumsFileName))
+func (c *Checksums) computeChecksum(filePath string) (string, error) {
+	hasher, err := NewHash(c.algorithm)
 	if err != nil {
+		return "", err
+	}
+	return computeChecksum(filePath, hasher)
+}
+
+func writeChecksumsList(path, algorithm string, sums map[string]string) error {
+	paths := make([]string, 0, len(sums))
+	for k := range sums {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if _, err := fmt.Fprintf(w, "%s%s\n", algorithmHeader, algorithm); err != nil {
+		return err
+	}
+	for _, k := range paths {
+		if _, err := fmt.Fprintf(w, "%s  %s\n", sums[k], k); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
 		return err
 	}
-	current, err := getChecksums(root)
+	return f.Close()
+}
+
+func WriteChecksumsFile(stageDir string, workers int, algorithm string) error {
+	c, err := NewChecksums(stageDir, workers, algorithm)
+	if err != nil {
+		return err
+	}
+	return c.Write()
+}
+
+// CompareChecksums verifies all files under root: a backup, or a single '<dbname>.dmp' dir of it.
+func CompareChecksums(root string, workers int) error {
+	list, err := scanChecksumsFromFile(filepath.Join(root, ChecksumsFileName))
+	if err != nil {
+		return err
+	}
+	expected, err := ExpandChecksums(list, openLocal(root))
+	if err != nil {
+		return err
+	}
+	c, err := NewChecksums(root, workers, list.Algorithm)
+	if err != nil {
+		return err
+	}
+	files, err := c.collect("", ChecksumsFileName, ChecksumsSignatureFileName)
+	if err != nil {
+		return err
+	}
+	current, err := c.hashFiles(files)
 	if err != nil {
 		return err
 	}
-	if len(current) != len(expected) {
-		return fmt.Errorf("checksums directory content mismatch")
+	return compareChecksums(expected, current)
+}
+
+// CompareChecksumsPrefix verifies only files under the prefix (i.e. 'mydb.dmp', relative to root),
+// list is the root checksums file. It's used when a backup is fetched from a storage piece by piece.
+func CompareChecksumsPrefix(root string, list *ChecksumsList, prefix string, workers int) error {
+	expected, err := ExpandChecksums(list, openLocal(root))
+	if err != nil {
+		return err
+	}
+	c, err := NewChecksums(root, workers, list.Algorithm)
+	if err != nil {
+		return err
+	}
+	files, err := c.collect(prefix, ChecksumsFileName)
+	if err != nil {
+		return err
 	}
+	current, err := c.hashFiles(files)
+	if err != nil {
+		return err
+	}
+	subset := make(map[string]string)
 	for k, v := range expected {
-		curVal, ok := current[k]
+		if k == prefix || strings.HasPrefix(k, prefix+"/") {
+			subset[k] = v
+		}
+	}
+	return compareChecksums(subset, current)
+}
+
+// ExpandChecksums returns checksums of all files of the backup, relative to its root:
+// entries of nested checksums files (i.e. 'mydb.dmp/checksums.txt') are added with their dir prefix.
+// A nested file that cannot be opened is skipped, it is reported as missing by the comparison.
+func ExpandChecksums(list *ChecksumsList, open func(rel string) (io.ReadCloser, error)) (map[string]string, error) {
+	result := make(map[string]string, len(list.Sums))
+	for k, v := range list.Sums {
+		result[k] = v
+		dir, ok := strings.CutSuffix(k, "/"+ChecksumsFileName)
 		if !ok {
-			return fmt.Errorf("checksums mismatch, stray file: %s", k)
+			continue
 		}
-		if v != curVal {
-			return fmt.Errorf("checksums value mismatch for file: %s", k)
+		r, err := open(k)
+		if err != nil {
+			continue
 		}
+		nested, err := ParseChecksums(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		if nested.Algorithm != list.Algorithm {
+			return nil, fmt.Errorf("%s: algorithm %s differs from %s", k, nested.Algorithm, list.Algorithm)
+		}
+		for nk, nv := range nested.Sums {
+			result[dir+"/"+nk] = nv
+		}
+	}
+	return result, nil
+}
+
+func openLocal(root string) func(rel string) (io.ReadCloser, error) {
+	return func(rel string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(root, filepath.FromSlash(rel)))
+	}
+}
+
+func compareChecksums(expected, current map[string]string) error {
+	problems := DiffChecksums(expected, current)
+	if len(problems) > 0 {
+		return fmt.Errorf("checksums %s: %s (%d problem(s) total)", problems[0].Kind, problems[0].Path, len(problems))
 	}
 	return nil
 }
 
+// DiffChecksums reports every difference between expected and current checksums, ordered by path.
+func DiffChecksums(expected, current map[string]string) []*ChecksumProblem {
+	var problems []*ChecksumProblem
+	for k, v := range expected {
+		curVal, ok := current[k]
+		switch {
+		case !ok:
+			problems = append(problems, &ChecksumProblem{Kind: ChecksumMissing, Path: k})
+		case v != curVal:
+			problems = append(problems, &ChecksumProblem{Kind: ChecksumMismatch, Path: k})
+		}
+	}
+	for k := range current {
+		if _, ok := expected[k]; !ok {
+			problems = append(problems, &ChecksumProblem{Kind: ChecksumStray, Path: k})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+	return problems
+}
+
 func computeChecksum(filePath string, hasher hash.Hash) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
+	return ComputeChecksum(file, hasher)
+}
 
+// ComputeChecksum returns a hex-encoded hash of everything read from r.
+func ComputeChecksum(r io.Reader, hasher hash.Hash) (string, error) {
 	hasher.Reset()
-	if _, err := io.Copy(hasher, file); err != nil {
+	if _, err := io.Copy(hasher, r); err != nil {
 		return "", err
 	}
-
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func getChecksums(root string) (map[string]string, error) {
-	checksums := make(map[string]string)
-	err := filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
-		if walkErr != nil {
-			return fmt.Errorf("error encountered during dir traverse %v: %w", path, walkErr)
-		}
-		if !info.IsDir() && (filepath.Base(path) != ChecksumsFileName) {
-			checksum, err := computeChecksum(path, sha256.New())
-			if err != nil {
-				return err
-			}
-			relPath, err := filepath.Rel(root, path)
-			if err != nil {
-				return err
-			}
-			checksums[filepath.ToSlash(relPath)] = checksum
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return checksums, nil
+// ReadChecksumsFile returns expected checksums by file path relative to the dir of the file.
+func ReadChecksumsFile(checksumsFilePath string) (*ChecksumsList, error) {
+	return scanChecksumsFromFile(checksumsFilePath)
 }
 
-func scanChecksumsFromFile(checksumsFilePath string) (map[string]string, error) {
+func scanChecksumsFromFile(checksumsFilePath string) (*ChecksumsList, error) {
 	file, err := os.Open(checksumsFilePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return ParseChecksums(file)
+}
 
-	checksums := make(map[string]string)
-	scanner := bufio.NewScanner(file)
+// ParseChecksums reads lines in sha256sum format: '<hash>  <path>', preceded by an optional algorithm header.
+// Files without the header (written by older versions) are sha256.
+func ParseChecksums(r io.Reader) (*ChecksumsList, error) {
+	list := &ChecksumsList{Algorithm: DefaultHash, Sums: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if algorithm, ok := strings.CutPrefix(line, algorithmHeader); ok {
+			list.Algorithm = strings.TrimSpace(algorithm)
+			if _, err := NewHash(list.Algorithm); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		parts := strings.SplitN(line, "  ", 2)
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid line: %s", line)
 		}
 		expectedHash := parts[0]
 		relPath := parts[1]
-		checksums[filepath.ToSlash(relPath)] = expectedHash
+		list.Sums[filepath.ToSlash(relPath)] = expectedHash
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
-	return checksums, nil
+	return list, nil
 }
@@ -0,0 +1,113 @@
+package xutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffChecksums(t *testing.T) {
+	expected := map[string]string{"a": "1", "b": "2", "c": "3"}
+	current := map[string]string{"a": "1", "b": "9", "d": "4"}
+
+	assert.Equal(t, []*ChecksumProblem{
+		{Kind: ChecksumMismatch, Path: "b"},
+		{Kind: ChecksumMissing, Path: "c"},
+		{Kind: ChecksumStray, Path: "d"},
+	}, DiffChecksums(expected, current))
+
+	assert.Empty(t, DiffChecksums(expected, expected))
+	assert.ErrorContains(t, compareChecksums(expected, current), "3 problem(s)")
+}
+
+func TestChecksumsWrite(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"b.dmp/data/toc.dat": "toc-b",
+		"a.dmp/data/toc.dat": "toc-a",
+		"a.dmp/data/1.dat":   "rows",
+		"globals.sql":        "roles",
+	}
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	sums, err := NewChecksums(root, 2, "")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for _, prefix := range []string{"a.dmp", "b.dmp"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, sums.Add(prefix))
+		}()
+	}
+	wg.Wait()
+	// globals.sql was not added, it's hashed on write
+	require.NoError(t, sums.Write())
+
+	data, err := os.ReadFile(filepath.Join(root, ChecksumsFileName))
+	require.NoError(t, err)
+	var paths []string
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, "# algorithm: sha256", lines[0])
+	for _, line := range lines[1:] {
+		_, path, ok := strings.Cut(line, "  ")
+		require.True(t, ok)
+		paths = append(paths, path)
+	}
+	assert.Equal(t, []string{"a.dmp/checksums.txt", "b.dmp/checksums.txt", "globals.sql"}, paths)
+	assert.NoError(t, CompareChecksums(root, 4))
+	// a single database dump is verifiable on its own
+	assert.NoError(t, CompareChecksums(filepath.Join(root, "a.dmp"), 4))
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.dmp", "data", "1.dat"), []byte("tampered"), 0o600))
+	assert.ErrorContains(t, CompareChecksums(root, 4), "mismatch: a.dmp/data/1.dat")
+	assert.ErrorContains(t, CompareChecksums(filepath.Join(root, "a.dmp"), 4), "mismatch: data/1.dat")
+	assert.NoError(t, CompareChecksums(filepath.Join(root, "b.dmp"), 4))
+
+}
+
+func TestChecksumsAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{HashSHA256, HashSHA512, HashBLAKE3} {
+		t.Run(algorithm, func(t *testing.T) {
+			root := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(root, "a.dmp"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(root, "a.dmp", "toc.dat"), []byte("toc"), 0o600))
+			require.NoError(t, os.WriteFile(filepath.Join(root, "globals.sql"), []byte("roles"), 0o600))
+			require.NoError(t, WriteChecksumsFile(root, 2, algorithm))
+
+			list, err := ReadChecksumsFile(filepath.Join(root, ChecksumsFileName))
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, list.Algorithm)
+			assert.NoError(t, CompareChecksums(root, 2))
+
+			require.NoError(t, os.WriteFile(filepath.Join(root, "globals.sql"), []byte("tampered"), 0o600))
+			assert.ErrorContains(t, CompareChecksums(root, 2), "mismatch: globals.sql")
+		})
+	}
+
+	_, err := NewChecksums(t.TempDir(), 1, "md5")
+	assert.ErrorContains(t, err, "unsupported checksum algorithm")
+}
+
+func TestCompareChecksumsLegacy(t *testing.T) {
+	// backups made by older versions have a single flat sha256 list without a header
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a.dmp"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.dmp", "toc.dat"), []byte("toc"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ChecksumsFileName),
+		[]byte("4ebde790877e2f92305cfb30ed1c0e2943dc00dfc24b49e3dc2a47889ca44151  a.dmp/toc.dat\n"), 0o600))
+
+	list, err := ReadChecksumsFile(filepath.Join(root, ChecksumsFileName))
+	require.NoError(t, err)
+	assert.Equal(t, HashSHA256, list.Algorithm)
+	assert.NoError(t, CompareChecksums(root, 2))
+}
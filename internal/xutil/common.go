@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+var versionRe = regexp.MustCompile(`\(PostgreSQL\)\s+(\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
 func GetExec(binPath, bin string) (string, error) {
 	if binPath != "" {
 		return exec.LookPath(filepath.Join(binPath, bin))
@@ -13,6 +18,60 @@ func GetExec(binPath, bin string) (string, error) {
 	return exec.LookPath(bin)
 }
 
+// GetExecVersion returns the output of '<bin> --version', i.e. 'pg_dump (PostgreSQL) 17.4'
+func GetExecVersion(binPath, bin string) (string, error) {
+	execPath, err := GetExec(binPath, bin)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(execPath, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get version of %s: %w", execPath, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ParseVersionNum converts the output of '<bin> --version' to the server_version_num format,
+// i.e. 'pg_dump (PostgreSQL) 17.4' -> 170004, 'psql (PostgreSQL) 9.6.24' -> 90624
+func ParseVersionNum(versionOutput string) (int, error) {
+	m := versionRe.FindStringSubmatch(versionOutput)
+	if m == nil {
+		return 0, fmt.Errorf("cannot parse version: %s", versionOutput)
+	}
+	parts := make([]int, 3)
+	for i, part := range m[1:] {
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse version: %s", versionOutput)
+		}
+		parts[i] = n
+	}
+	if parts[0] >= 10 {
+		return parts[0]*10000 + parts[1], nil
+	}
+	return parts[0]*10000 + parts[1]*100 + parts[2], nil
+}
+
+// MajorVersion returns the major version of server_version_num, i.e. 170004 -> 17, 90624 -> 9.6 (as 906)
+func MajorVersion(versionNum int) int {
+	if versionNum >= 100000 {
+		return versionNum / 10000
+	}
+	return versionNum / 100
+}
+
+// MajorVersionString renders MajorVersion in a human form, i.e. 17, 9.6
+func MajorVersionString(versionNum int) string {
+	major := MajorVersion(versionNum)
+	if versionNum >= 100000 {
+		return strconv.Itoa(major)
+	}
+	return fmt.Sprintf("%d.%d", major/100, major%100)
+}
+
 func ByteCountSI(b int64) string {
 	const unit = 1000
 	if b < unit {
@@ -40,3 +99,28 @@ func ByteCountIEC(b int64) string {
 	return fmt.Sprintf("%.1f %ciB",
 		float64(b)/float64(div), "KMGTPE"[exp])
 }
+
+// ParseByteSize parses sizes like '500MiB', '10GB', '1024' (bytes), both SI and IEC units are accepted.
+func ParseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"PiB", 1 << 50},
+		{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"PB", 1e15},
+		{"B", 1},
+	}
+	value := strings.TrimSpace(s)
+	mult := 1.0
+	for _, u := range units {
+		if rest, ok := strings.CutSuffix(value, u.suffix); ok {
+			value, mult = strings.TrimSpace(rest), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(n * mult), nil
+}
@@ -0,0 +1,53 @@
+package xutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersionNum(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+		major string
+	}{
+		{input: "pg_dump (PostgreSQL) 17.4", want: 170004, major: "17"},
+		{input: "pg_dump (PostgreSQL) 16.8 (Debian 16.8-1.pgdg120+1)", want: 160008, major: "16"},
+		{input: "psql (PostgreSQL) 18beta1", want: 180000, major: "18"},
+		{input: "pg_restore (PostgreSQL) 9.6.24", want: 90624, major: "9.6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseVersionNum(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.major, MajorVersionString(got))
+		})
+	}
+
+	_, err := ParseVersionNum("not a version")
+	assert.Error(t, err)
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024":    1024,
+		"500MiB":  500 << 20,
+		"1.5 GiB": 3 << 29,
+		"10GB":    10e9,
+		"2kB":     2000,
+		"7B":      7,
+	}
+	for input, want := range tests {
+		got, err := ParseByteSize(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+
+	for _, input := range []string{"", "MiB", "-1GiB", "ten"} {
+		_, err := ParseByteSize(input)
+		assert.Error(t, err, input)
+	}
+}
@@ -0,0 +1,36 @@
+package xutil
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// console is where log lines are printed, the progress view takes it over to print them above itself
+var console = struct {
+	sync.RWMutex
+	w io.Writer
+}{w: os.Stderr}
+
+// ConsoleWriter writes to the current console (stderr, or the progress view when it's drawn)
+func ConsoleWriter() io.Writer {
+	return consoleWriter{}
+}
+
+type consoleWriter struct{}
+
+func (consoleWriter) Write(b []byte) (int, error) {
+	console.RLock()
+	w := console.w
+	console.RUnlock()
+	return w.Write(b)
+}
+
+// setConsole replaces the console, and returns the previous one
+func setConsole(w io.Writer) io.Writer {
+	console.Lock()
+	defer console.Unlock()
+	prev := console.w
+	console.w = w
+	return prev
+}
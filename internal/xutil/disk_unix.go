@@ -0,0 +1,15 @@
+//go:build !windows
+
+package xutil
+
+import "syscall"
+
+// FreeDiskSpace returns the number of bytes available to the user on the filesystem of the path.
+func FreeDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	//nolint:unconvert // field types differ across platforms
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
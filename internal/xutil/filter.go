@@ -0,0 +1,100 @@
+package xutil
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	PostgresDB = "postgres"
+
+	// regexPatternPrefix marks a pattern as a regular expression, i.e. 're:^tmp_.*$'
+	regexPatternPrefix = "re:"
+)
+
+// DBFilter decides which databases take part in dump/restore.
+//
+// Patterns are matched against the database name and may be:
+//   - exact names: 'reports'
+//   - glob patterns: 'tmp_*', 'app_[0-9]'
+//   - regular expressions with the 're:' prefix: 're:^scratch_\d+$'
+//
+// The 'postgres' database is skipped, unless IncludePostgres is set.
+// Exclude patterns take precedence over include patterns.
+type DBFilter struct {
+	Include         []string `json:"include,omitempty"`
+	Exclude         []string `json:"exclude,omitempty"`
+	IncludePostgres bool     `json:"include_postgres"`
+}
+
+// Validate checks that all patterns are syntactically correct.
+func (f *DBFilter) Validate() error {
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := matchPattern(p, ""); err != nil {
+			return fmt.Errorf("invalid database pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the database with a given name is selected by the filter.
+func (f *DBFilter) Match(dbname string) bool {
+	if dbname == PostgresDB && !f.IncludePostgres {
+		return false
+	}
+	if matchAny(f.Exclude, dbname) {
+		return false
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	return matchAny(f.Include, dbname)
+}
+
+// Split partitions databases into selected and skipped ones.
+func (f *DBFilter) Split(databases []*DBInfo) (selected, skipped []*DBInfo) {
+	for _, db := range databases {
+		if f.Match(db.DatName) {
+			selected = append(selected, db)
+		} else {
+			skipped = append(skipped, db)
+		}
+	}
+	return selected, skipped
+}
+
+func matchAny(patterns []string, dbname string) bool {
+	for _, p := range patterns {
+		if ok, err := matchPattern(p, dbname); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, dbname string) (bool, error) {
+	if expr, ok := strings.CutPrefix(pattern, regexPatternPrefix); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(dbname), nil
+	}
+	// exact names are valid globs as well
+	return path.Match(pattern, dbname)
+}
+
+// DumpDirDBName returns the database name of a '<dbname>.dmp' directory.
+func DumpDirDBName(dumpDir string) string {
+	return strings.TrimSuffix(filepath.Base(dumpDir), ".dmp")
+}
+
+// Selection records which databases were dumped, and which were intentionally left out.
+type Selection struct {
+	Filter   DBFilter `json:"filter"`
+	Selected []string `json:"selected"`
+	Skipped  []string `json:"skipped"`
+}
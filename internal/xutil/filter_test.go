@@ -0,0 +1,48 @@
+package xutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter DBFilter
+		dbname string
+		want   bool
+	}{
+		{name: "empty filter", filter: DBFilter{}, dbname: "reports", want: true},
+		{name: "postgres skipped by default", filter: DBFilter{}, dbname: "postgres", want: false},
+		{name: "postgres opt-in", filter: DBFilter{IncludePostgres: true}, dbname: "postgres", want: true},
+		{name: "exact include", filter: DBFilter{Include: []string{"reports"}}, dbname: "reports", want: true},
+		{name: "exact include miss", filter: DBFilter{Include: []string{"reports"}}, dbname: "audit", want: false},
+		{name: "glob include", filter: DBFilter{Include: []string{"app_*"}}, dbname: "app_1", want: true},
+		{name: "regex include", filter: DBFilter{Include: []string{`re:^app_\d+$`}}, dbname: "app_42", want: true},
+		{name: "regex include miss", filter: DBFilter{Include: []string{`re:^app_\d+$`}}, dbname: "app_x", want: false},
+		{name: "exclude wins", filter: DBFilter{Include: []string{"*"}, Exclude: []string{"tmp_*"}}, dbname: "tmp_1", want: false},
+		{name: "exclude postgres", filter: DBFilter{IncludePostgres: true, Exclude: []string{"postgres"}}, dbname: "postgres", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(tt.dbname))
+		})
+	}
+}
+
+func TestDBFilterValidate(t *testing.T) {
+	assert.NoError(t, (&DBFilter{Include: []string{"app_*", `re:^\d+$`}}).Validate())
+	assert.Error(t, (&DBFilter{Include: []string{"app_["}}).Validate())
+	assert.Error(t, (&DBFilter{Exclude: []string{"re:("}}).Validate())
+}
+
+func TestConnStrWithDB(t *testing.T) {
+	got, err := ConnStrWithDB("postgres://u:p@localhost:5432/postgres?sslmode=disable", "d1")
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://u:p@localhost:5432/d1?sslmode=disable", got)
+
+	got, err = ConnStrWithDB("host=localhost port=5432", "it's")
+	assert.NoError(t, err)
+	assert.Equal(t, `host=localhost port=5432 dbname='it\'s'`, got)
+}
@@ -1,9 +1,14 @@
 package xutil
 
 import (
+	"context"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
 )
 
 func GetDumpsInDir(path string) ([]*DBInfo, error) {
@@ -16,21 +21,51 @@ func GetDumpsInDir(path string) ([]*DBInfo, error) {
 	for _, entry := range entries {
 		if entry.IsDir() && strings.HasSuffix(entry.Name(), ".dmp") {
 			dirPath := filepath.Join(path, entry.Name())
-			size, err := dirSize(dirPath)
+			size, err := DirSize(dirPath)
+			if err != nil {
+				return nil, err
+			}
+			tables, err := dumpTableStats(dirPath)
 			if err != nil {
 				return nil, err
 			}
 			results = append(results, &DBInfo{
 				DatName:   dirPath,
 				SizeBytes: size,
+				Tables:    tables,
 			})
 		}
 	}
 	return results, nil
 }
 
-// dirSize walks a directory and returns the total size of all files
-func dirSize(path string) (int64, error) {
+// dumpTableStats counts table data files of a dump made by pg_dump --format=directory
+func dumpTableStats(dumpDir string) (*TableStats, error) {
+	stats := &TableStats{}
+	err := filepath.Walk(dumpDir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			stats.add(info.Name(), info.Size())
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// add counts the file, if it's table data, i.e. '3001.dat.gz' (or '3001.dat.gz.age')
+func (t *TableStats) add(name string, size int64) {
+	if strings.HasPrefix(name, "toc.dat") || !strings.Contains(name, ".dat") {
+		return
+	}
+	t.Count++
+	t.TotalBytes += size
+	t.LargestBytes = max(t.LargestBytes, size)
+}
+
+// DirSize walks a directory and returns the total size of all files
+func DirSize(path string) (int64, error) {
 	var total int64
 	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -43,3 +78,39 @@ func dirSize(path string) (int64, error) {
 	})
 	return total, err
 }
+
+// GetDumpsInStorage is GetDumpsInDir for a backup kept in a storage (i.e. S3),
+// DatName is the key of a '<dbname>.dmp' dir.
+func GetDumpsInStorage(ctx context.Context, st storage.Storage, prefix string) ([]*DBInfo, error) {
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	tables := map[string]*TableStats{}
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(strings.TrimPrefix(obj.Key, prefix), "/")
+		dir, _, ok := strings.Cut(rel, "/")
+		if ok && strings.HasSuffix(dir, ".dmp") {
+			sizes[dir] += obj.Size
+			if tables[dir] == nil {
+				tables[dir] = &TableStats{}
+			}
+			tables[dir].add(path.Base(rel), obj.Size)
+		}
+	}
+
+	results := make([]*DBInfo, 0, len(sizes))
+	for dir, size := range sizes {
+		results = append(results, &DBInfo{
+			DatName:   storage.Join(prefix, dir),
+			SizeBytes: size,
+			Tables:    tables[dir],
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DatName < results[j].DatName
+	})
+	return results, nil
+}
@@ -0,0 +1,195 @@
+package xutil
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// JobsBudget limits pg_dump/pg_restore workers of all concurrently processed databases.
+type JobsBudget struct {
+	// ParallelDBS is the number of databases processed at once
+	ParallelDBS int
+	// MaxTotalJobs is the sum of --jobs of all concurrently processed databases (0 - number of CPUs)
+	MaxTotalJobs int
+}
+
+// Total returns the max number of pg_dump/pg_restore workers running at once.
+func (b JobsBudget) Total() int {
+	if b.MaxTotalJobs > 0 {
+		return b.MaxTotalJobs
+	}
+	return runtime.NumCPU()
+}
+
+// Workers returns the number of databases processed at once:
+// every database needs at least one job, so it never exceeds the total budget.
+func (b JobsBudget) Workers() int {
+	return max(1, min(b.ParallelDBS, b.Total()))
+}
+
+// GetJobsWeights assigns --jobs for pg_dump/pg_restore, so that jobs of any databases processed at once
+// (up to budget.Workers() of them) never exceed budget.Total().
+//
+// Every database gets a single job, and extra ones are handed out one by one to the database
+// with the most bytes per job (the D'Hondt method) until the budget is spent, so jobs are proportional to database sizes.
+// A database never gets more jobs than it has tables, and than its total table size
+// divided by its largest table: that table is dumped by a single worker, others would only wait for it.
+//
+// Example, given 8 jobs, and 4 databases processed at once:
+//
+// +------------+----------+------+
+// |datname     |size      |jobs  |
+// +------------+----------+------+
+// |reports     |23933411  |4     |
+// |online_store|13053796  |2     |
+// |internal_app|7877091   |1     |
+// |audit_logs  |1024      |1     |
+// +------------+----------+------+
+func GetJobsWeights(databases []*DBInfo, budget JobsBudget) map[string]int {
+	weights := make(map[string]int, len(databases))
+	if len(databases) == 0 {
+		return weights
+	}
+	total := budget.Total()
+	slots := min(budget.Workers(), len(databases))
+
+	jobs := make([]int, len(databases))
+	limits := make([]int, len(databases))
+	for i, db := range databases {
+		jobs[i] = 1
+		limits[i] = maxUsefulJobs(db, total)
+	}
+
+	for {
+		best := -1
+		for i, db := range databases {
+			if jobs[i] >= limits[i] {
+				continue
+			}
+			// size/jobs[i] > best.size/jobs[best]
+			if best == -1 || db.SizeBytes*int64(jobs[best]) > databases[best].SizeBytes*int64(jobs[i]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+		jobs[best]++
+		if largestSum(jobs, slots) > total {
+			// the budget is spent, leftovers are not handed out to smaller databases
+			jobs[best]--
+			break
+		}
+	}
+
+	for i, db := range databases {
+		weights[db.DatName] = jobs[i]
+	}
+	return weights
+}
+
+// maxUsefulJobs returns the number of jobs the database is able to keep busy (unknown stats - total)
+func maxUsefulJobs(db *DBInfo, total int) int {
+	limit := total
+	if t := db.Tables; t != nil {
+		limit = min(limit, t.Count)
+		if t.LargestBytes > 0 {
+			limit = min(limit, int((t.TotalBytes+t.LargestBytes-1)/t.LargestBytes))
+		}
+	}
+	return max(1, limit)
+}
+
+// largestSum returns the sum of n largest values, i.e. jobs of databases that may run at once
+func largestSum(values []int, n int) int {
+	sorted := append([]int(nil), values...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	sum := 0
+	for _, v := range sorted[:n] {
+		sum += v
+	}
+	return sum
+}
+
+// JobsScheduler hands out databases largest first, so the total time approaches the time of the largest one,
+// and assigns their --jobs when they start: jobs freed by finished databases are given to the ones starting later.
+type JobsScheduler struct {
+	mu      sync.Mutex
+	pending []*DBInfo
+	planned map[string]int
+	limits  map[string]int
+	held    map[string]int
+	total   int
+	workers int
+}
+
+// PlannedJob is a database in the order it's started, with --jobs planned by GetJobsWeights.
+// The actual number may be higher, if jobs of finished databases are free by then.
+type PlannedJob struct {
+	DatName   string `json:"datname"`
+	SizeBytes int64  `json:"size_bytes"`
+	Jobs      int    `json:"jobs"`
+}
+
+func NewJobsScheduler(databases []*DBInfo, budget JobsBudget) *JobsScheduler {
+	pending := append([]*DBInfo(nil), databases...)
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].SizeBytes > pending[j].SizeBytes
+	})
+	s := &JobsScheduler{
+		pending: pending,
+		planned: GetJobsWeights(databases, budget),
+		limits:  make(map[string]int, len(databases)),
+		held:    make(map[string]int, len(databases)),
+		total:   budget.Total(),
+		workers: budget.Workers(),
+	}
+	for _, db := range databases {
+		s.limits[db.DatName] = maxUsefulJobs(db, s.total)
+	}
+	return s
+}
+
+// Plan returns databases in the order they're started.
+func (s *JobsScheduler) Plan() []*PlannedJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan := make([]*PlannedJob, 0, len(s.pending))
+	for _, db := range s.pending {
+		plan = append(plan, &PlannedJob{DatName: db.DatName, SizeBytes: db.SizeBytes, Jobs: s.planned[db.DatName]})
+	}
+	return plan
+}
+
+// Next returns the largest pending database and its jobs: free jobs, except the ones planned for databases
+// that idle workers are about to start. Done must be called when the database is finished.
+func (s *JobsScheduler) Next() (db *DBInfo, jobs int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil, 0, false
+	}
+	db, s.pending = s.pending[0], s.pending[1:]
+
+	free := s.total
+	for _, n := range s.held {
+		free -= n
+	}
+	reserved := 0
+	idle := s.workers - len(s.held) - 1
+	for _, next := range s.pending[:max(0, min(idle, len(s.pending)))] {
+		reserved += s.planned[next.DatName]
+	}
+	jobs = max(1, min(s.limits[db.DatName], free-reserved))
+
+	s.held[db.DatName] = jobs
+	return db, jobs, true
+}
+
+// Done returns jobs of the finished database to the budget.
+func (s *JobsScheduler) Done(db *DBInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.held, db.DatName)
+}
@@ -0,0 +1,88 @@
+package xutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJobsWeights(t *testing.T) {
+	databases := []*DBInfo{
+		{DatName: "reports", SizeBytes: 23933411},
+		{DatName: "online_store", SizeBytes: 13053796},
+		{DatName: "internal_app", SizeBytes: 7877091},
+		{DatName: "audit_logs", SizeBytes: 1024},
+	}
+
+	t.Run("all databases at once", func(t *testing.T) {
+		weights := GetJobsWeights(databases, JobsBudget{ParallelDBS: 4, MaxTotalJobs: 8})
+		assert.Equal(t, map[string]int{"reports": 4, "online_store": 2, "internal_app": 1, "audit_logs": 1}, weights)
+	})
+
+	t.Run("budget is shared by concurrent databases only", func(t *testing.T) {
+		weights := GetJobsWeights(databases, JobsBudget{ParallelDBS: 2, MaxTotalJobs: 8})
+		assert.Equal(t, map[string]int{"reports": 5, "online_store": 3, "internal_app": 2, "audit_logs": 1}, weights)
+		assert.LessOrEqual(t, largestSum([]int{5, 3, 2, 1}, 2), 8)
+	})
+
+	t.Run("budget smaller than parallel databases", func(t *testing.T) {
+		budget := JobsBudget{ParallelDBS: 8, MaxTotalJobs: 3}
+		assert.Equal(t, 3, budget.Workers())
+		weights := GetJobsWeights(databases, budget)
+		assert.Equal(t, map[string]int{"reports": 1, "online_store": 1, "internal_app": 1, "audit_logs": 1}, weights)
+	})
+}
+
+func TestGetJobsWeightsTableStats(t *testing.T) {
+	databases := []*DBInfo{
+		// a single huge table gains nothing from more jobs
+		{DatName: "blob_store", SizeBytes: 100 << 30, Tables: &TableStats{Count: 1, TotalBytes: 100 << 30, LargestBytes: 100 << 30}},
+		// one table is the half of the data, the rest is dumped by the second worker meanwhile
+		{DatName: "events", SizeBytes: 40 << 30, Tables: &TableStats{Count: 50, TotalBytes: 40 << 30, LargestBytes: 20 << 30}},
+		{DatName: "crm", SizeBytes: 10 << 30, Tables: &TableStats{Count: 200, TotalBytes: 10 << 30, LargestBytes: 1 << 30}},
+		{DatName: "empty", SizeBytes: 8 << 20, Tables: &TableStats{}},
+	}
+	weights := GetJobsWeights(databases, JobsBudget{ParallelDBS: 4, MaxTotalJobs: 16})
+	assert.Equal(t, map[string]int{"blob_store": 1, "events": 2, "crm": 10, "empty": 1}, weights)
+}
+
+func TestJobsScheduler(t *testing.T) {
+	databases := []*DBInfo{
+		{DatName: "b", SizeBytes: 50},
+		{DatName: "d", SizeBytes: 10, Tables: &TableStats{Count: 2, TotalBytes: 10, LargestBytes: 5}},
+		{DatName: "a", SizeBytes: 100},
+		{DatName: "c", SizeBytes: 40},
+	}
+	sched := NewJobsScheduler(databases, JobsBudget{ParallelDBS: 2, MaxTotalJobs: 8})
+
+	assert.Equal(t, []*PlannedJob{
+		{DatName: "a", SizeBytes: 100, Jobs: 5},
+		{DatName: "b", SizeBytes: 50, Jobs: 3},
+		{DatName: "c", SizeBytes: 40, Jobs: 2},
+		{DatName: "d", SizeBytes: 10, Jobs: 1},
+	}, sched.Plan())
+
+	next := func(expectedName string, expectedJobs int) *DBInfo {
+		t.Helper()
+		db, jobs, ok := sched.Next()
+		assert.True(t, ok)
+		assert.Equal(t, expectedName, db.DatName)
+		assert.Equal(t, expectedJobs, jobs)
+		return db
+	}
+
+	// jobs planned for 'b' are reserved, the second worker is about to start it
+	a := next("a", 5)
+	b := next("b", 3)
+	sched.Done(b)
+	// 'c' gets jobs freed by 'b', not only the planned ones
+	c := next("c", 3)
+	sched.Done(a)
+	// 'd' is able to use 2 jobs only
+	d := next("d", 2)
+	sched.Done(c)
+	sched.Done(d)
+
+	_, _, ok := sched.Next()
+	assert.False(t, ok)
+}
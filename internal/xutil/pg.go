@@ -2,8 +2,9 @@ package xutil
 
 import (
 	"context"
-	"encoding/json"
-	"runtime"
+	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -11,8 +12,19 @@ import (
 type DBInfo struct {
 	DatName   string `json:"datname,omitempty"`
 	SizeBytes int64  `json:"size_bytes,omitempty"`
+	// Tables is nil if unknown, it limits useful --jobs of pg_dump/pg_restore
+	Tables *TableStats `json:"tables,omitempty"`
 }
 
+// TableStats describes table data of a database, pg_dump/pg_restore run one worker per table.
+type TableStats struct {
+	Count        int   `json:"count"`
+	TotalBytes   int64 `json:"total_bytes"`
+	LargestBytes int64 `json:"largest_bytes"`
+}
+
+// GetDatabases returns all connectable non-template databases, including 'postgres'.
+// Use DBFilter to select the ones that take part in dump/restore.
 func GetDatabases(ctx context.Context, connStr string) ([]*DBInfo, error) {
 	conn, err := pgx.Connect(ctx, connStr)
 	if err != nil {
@@ -26,7 +38,7 @@ func GetDatabases(ctx context.Context, connStr string) ([]*DBInfo, error) {
 	from pg_database d
 	where d.datistemplate = false
 	  and d.datallowconn
-	  and d.datname <> 'postgres';
+	order by d.datname;
 	`)
 	if err != nil {
 		return nil, err
@@ -51,90 +63,137 @@ func GetDatabases(ctx context.Context, connStr string) ([]*DBInfo, error) {
 	return scannedEntities, nil
 }
 
-// GetJobsWeights assigns --jobs for pg_dump, bases on database size and total numbers of CPU available
-// Example:
-//
-// Given this list of DBS, and 8 CPUs available:
-//
-// [
-//
-//	{
-//	  "datname": "audit_logs",
-//	  "size_bytes": 1024
-//	},
-//	{
-//	  "datname": "reports",
-//	  "size_bytes": 23933411
-//	},
-//	{
-//	  "datname": "online_store",
-//	  "size_bytes": 13053796
-//	},
-//	{
-//	  "datname": "internal_app",
-//	  "size_bytes": 7877091
-//	}
-//
-// ]
-//
-// Jobs assigned:
-//
-// +------------+----+
-// |datname     |jobs|
-// +------------+----+
-// |reports     |4   |
-// |online_store|2   |
-// |internal_app|1   |
-// |audit_logs  |1   |
-// +------------+----+
-func GetJobsWeights(ctx context.Context, dpmInfos []*DBInfo, connStr string) (map[string]int, error) {
+// GetRoles returns names of all roles of the cluster.
+func GetRoles(ctx context.Context, connStr string) (map[string]bool, error) {
 	conn, err := pgx.Connect(ctx, connStr)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close(ctx)
 
-	totalJobs := runtime.NumCPU() - 1
-	if totalJobs < 2 {
-		totalJobs = 1
+	rows, err := conn.Query(ctx, `select rolname from pg_roles`)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	jsonData, err := json.Marshal(dpmInfos)
+	roles := map[string]bool{}
+	for rows.Next() {
+		var rolname string
+		if err := rows.Scan(&rolname); err != nil {
+			return nil, err
+		}
+		roles[rolname] = true
+	}
+	return roles, rows.Err()
+}
+
+// GetServerVersion returns the human-readable and the numeric server version, i.e. '17.4' and 170004.
+func GetServerVersion(ctx context.Context, connStr string) (version string, versionNum int, err error) {
+	conn, err := pgx.Connect(ctx, connStr)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
+	defer conn.Close(ctx)
 
-	q := `
-	with db_sizes as (select datname, size_bytes
-					  from jsonb_to_recordset($1::jsonb) AS t(datname text, size_bytes bigint)),
-		 totals as (select sum(size_bytes) as total_size
-					from db_sizes)
-	select d.datname as datname,
-		   greatest(1,
-					round(d.size_bytes::numeric / t.total_size * $2)
-		   )::int as jobs
-	from db_sizes d,
-		 totals t
-	order by d.size_bytes desc
-`
-	rows, err := conn.Query(ctx, q, jsonData, totalJobs)
+	err = conn.QueryRow(ctx, `
+	select current_setting('server_version')             as server_version,
+		   current_setting('server_version_num')::int as server_version_num
+	`).Scan(&version, &versionNum)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
-	defer rows.Close()
+	return version, versionNum, nil
+}
 
-	scannedEntities := make(map[string]int)
-	for rows.Next() {
-		var dbname string
-		var jobs int
-		err := rows.Scan(&dbname, &jobs)
+// DropDatabase drops the database, if it exists.
+func DropDatabase(ctx context.Context, connStr, dbname string) error {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "drop database if exists "+pgx.Identifier{dbname}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("cannot drop database %s: %w", dbname, err)
+	}
+	return nil
+}
+
+// RenameDatabase renames the database, it fails if anyone is connected to it.
+func RenameDatabase(ctx context.Context, connStr, dbname, newName string) error {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "alter database "+pgx.Identifier{dbname}.Sanitize()+" rename to "+pgx.Identifier{newName}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("cannot rename database %s to %s: %w", dbname, newName, err)
+	}
+	return nil
+}
+
+// ExecSQL executes statements one by one outside of a transaction, i.e. CREATE DATABASE.
+func ExecSQL(ctx context.Context, connStr string, statements ...string) error {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	for _, statement := range statements {
+		if _, err := conn.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnStrWithDB returns the connection string pointed to the given database.
+// Both URL and keyword/value formats are supported.
+func ConnStrWithDB(connStr, dbname string) (string, error) {
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		u, err := url.Parse(connStr)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-		scannedEntities[dbname] = jobs
+		u.Path = "/" + dbname
+		u.RawPath = ""
+		return u.String(), nil
 	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
+	// in keyword/value format the last occurrence of a keyword wins
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(dbname)
+	return strings.TrimSpace(connStr) + " dbname='" + escaped + "'", nil
+}
+
+// GetTableStats returns the number of user tables (and materialized views) in the database, their total and largest size.
+func GetTableStats(ctx context.Context, connStr, dbname string) (*TableStats, error) {
+	dbConnStr, err := ConnStrWithDB(connStr, dbname)
+	if err != nil {
+		return nil, err
 	}
-	return scannedEntities, nil
+	conn, err := pgx.Connect(ctx, dbConnStr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	var stats TableStats
+	err = conn.QueryRow(ctx, `
+	select count(*)                                 as count,
+		   coalesce(sum(pg_table_size(c.oid)), 0)::bigint as total_bytes,
+		   coalesce(max(pg_table_size(c.oid)), 0)::bigint as largest_bytes
+	from pg_class c
+			 join pg_namespace n on n.oid = c.relnamespace
+	where c.relkind in ('r', 'm')
+	  and n.nspname not in ('pg_catalog', 'information_schema')
+	  and n.nspname not like 'pg_toast%'
+	`).Scan(&stats.Count, &stats.TotalBytes, &stats.LargestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get table stats of %s: %w", dbname, err)
+	}
+	return &stats, nil
 }
@@ -0,0 +1,164 @@
+package xutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BinSet is a group of client binaries required by a command, and the rule their version must satisfy.
+type BinSet struct {
+	Name string
+	Bins []string
+	// Accept reports whether the client major version may be used with the server major version
+	Accept func(clientMajor, serverMajor int) bool
+	// Rule is a human-readable form of Accept
+	Rule string
+}
+
+var (
+	// DumpBinaries must not be older than the source server
+	DumpBinaries = &BinSet{
+		Name:   "dump",
+		Bins:   []string{"pg_dump", "pg_dumpall"},
+		Accept: func(clientMajor, serverMajor int) bool { return clientMajor >= serverMajor },
+		Rule:   ">=",
+	}
+	// RestoreBinaries must match the target server
+	RestoreBinaries = &BinSet{
+		Name:   "restore",
+		Bins:   []string{"pg_restore", "psql"},
+		Accept: func(clientMajor, serverMajor int) bool { return clientMajor == serverMajor },
+		Rule:   "==",
+	}
+)
+
+// well-known locations of versioned client binaries (Debian/Ubuntu, RHEL, Homebrew)
+var binDirGlobs = []string{
+	"/usr/lib/postgresql/*/bin",
+	"/usr/pgsql-*/bin",
+	"/usr/local/pgsql/bin",
+	"/opt/homebrew/opt/postgresql@*/bin",
+	"/usr/local/opt/postgresql@*/bin",
+}
+
+type binDir struct {
+	path       string
+	versionNum int
+}
+
+// ResolvePgBinPath finds a directory with client binaries suitable for the server behind connStr.
+// If pgBinPath is set, it is only verified, otherwise installed versions are discovered.
+func ResolvePgBinPath(ctx context.Context, connStr, pgBinPath string, binSet *BinSet) (string, error) {
+	_, serverVersionNum, err := GetServerVersion(ctx, connStr)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{pgBinPath}
+	if pgBinPath == "" {
+		candidates = discoverBinDirs(binSet.Bins[0])
+	}
+
+	var found []*binDir
+	var problems []string
+	for _, dir := range candidates {
+		d, err := probeBinDir(dir, binSet.Bins)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		found = append(found, d)
+	}
+
+	selected := selectBinDir(found, serverVersionNum, binSet)
+	if selected == nil {
+		for _, d := range found {
+			problems = append(problems, fmt.Sprintf("%s: version %s", d.path, MajorVersionString(d.versionNum)))
+		}
+		return "", fmt.Errorf("no suitable PostgreSQL client binaries for %s: server version %s, required %s version %s %s; found: [%s]",
+			binSet.Name,
+			MajorVersionString(serverVersionNum),
+			strings.Join(binSet.Bins, "/"),
+			binSet.Rule,
+			MajorVersionString(serverVersionNum),
+			strings.Join(problems, "; "),
+		)
+	}
+
+	slog.Info("pgbin",
+		slog.String("purpose", binSet.Name),
+		slog.String("path", filepath.ToSlash(selected.path)),
+		slog.String("version", MajorVersionString(selected.versionNum)),
+		slog.String("server-version", MajorVersionString(serverVersionNum)),
+	)
+	return selected.path, nil
+}
+
+// selectBinDir picks the newest acceptable version
+func selectBinDir(found []*binDir, serverVersionNum int, binSet *BinSet) *binDir {
+	sorted := append([]*binDir{}, found...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].versionNum > sorted[j].versionNum
+	})
+	for _, d := range sorted {
+		if binSet.Accept(MajorVersion(d.versionNum), MajorVersion(serverVersionNum)) {
+			return d
+		}
+	}
+	return nil
+}
+
+// probeBinDir ensures all binaries exist in dir and have the same major version
+func probeBinDir(dir string, bins []string) (*binDir, error) {
+	result := &binDir{path: dir}
+	for _, bin := range bins {
+		versionOutput, err := GetExecVersion(dir, bin)
+		if err != nil {
+			return nil, err
+		}
+		versionNum, err := ParseVersionNum(versionOutput)
+		if err != nil {
+			return nil, err
+		}
+		if result.versionNum != 0 && MajorVersion(result.versionNum) != MajorVersion(versionNum) {
+			return nil, fmt.Errorf("%s: version mismatch, %s is %s, %s is %s", dir,
+				bins[0], MajorVersionString(result.versionNum), bin, MajorVersionString(versionNum))
+		}
+		result.versionNum = versionNum
+	}
+	return result, nil
+}
+
+// discoverBinDirs returns directories that may contain client binaries
+func discoverBinDirs(bin string) []string {
+	var dirs []string
+	for _, pattern := range binDirGlobs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, matches...)
+	}
+	if out, err := exec.Command("pg_config", "--bindir").Output(); err == nil {
+		dirs = append(dirs, strings.TrimSpace(string(out)))
+	}
+	if path, err := exec.LookPath(bin); err == nil {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+
+	seen := map[string]bool{}
+	var result []string
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			result = append(result, dir)
+		}
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package xutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeBinDir(t *testing.T, versions map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for bin, version := range versions {
+		script := fmt.Sprintf("#!/bin/sh\necho '%s (PostgreSQL) %s'\n", bin, version)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, bin), []byte(script), 0o700))
+	}
+	return dir
+}
+
+func TestSelectBinDir(t *testing.T) {
+	found := []*binDir{
+		{path: "/usr/lib/postgresql/15/bin", versionNum: 150012},
+		{path: "/usr/lib/postgresql/17/bin", versionNum: 170004},
+		{path: "/usr/lib/postgresql/16/bin", versionNum: 160008},
+	}
+
+	// the newest one for dump
+	assert.Equal(t, "/usr/lib/postgresql/17/bin", selectBinDir(found, 160003, DumpBinaries).path)
+	assert.Nil(t, selectBinDir(found, 180000, DumpBinaries))
+
+	// exact major for restore
+	assert.Equal(t, "/usr/lib/postgresql/16/bin", selectBinDir(found, 160003, RestoreBinaries).path)
+	assert.Nil(t, selectBinDir(found, 140000, RestoreBinaries))
+}
+
+func TestProbeBinDir(t *testing.T) {
+	dir := fakeBinDir(t, map[string]string{"pg_dump": "17.4", "pg_dumpall": "17.2"})
+	d, err := probeBinDir(dir, DumpBinaries.Bins)
+	require.NoError(t, err)
+	assert.Equal(t, 17, MajorVersion(d.versionNum))
+
+	dir = fakeBinDir(t, map[string]string{"pg_dump": "17.4", "pg_dumpall": "16.8"})
+	_, err = probeBinDir(dir, DumpBinaries.Bins)
+	assert.ErrorContains(t, err, "version mismatch")
+
+	dir = fakeBinDir(t, map[string]string{"pg_restore": "17.4"})
+	_, err = probeBinDir(dir, RestoreBinaries.Bins)
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package xutil
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	PlanStatusRun           = "run"
+	PlanStatusSkipCompleted = "skip-completed"
+	// PlanStatusRerun is a database left partial by a failed restore, it's dropped and restored again
+	PlanStatusRerun = "rerun"
+	// PlanStatusSkipExists, PlanStatusDropExisting, PlanStatusRenameExisting are databases
+	// that already exist in the target cluster, by the conflict policy of restore
+	PlanStatusSkipExists     = "skip-exists"
+	PlanStatusDropExisting   = "drop-existing"
+	PlanStatusRenameExisting = "rename-existing"
+)
+
+// RunPlan describes what dump/restore would do (--dry-run), nothing is written or executed.
+type RunPlan struct {
+	// Source and Target are a cluster (with the password redacted), or a backup location
+	Source       string             `json:"source"`
+	Target       string             `json:"target"`
+	Workers      int                `json:"workers"`
+	MaxTotalJobs int                `json:"max_total_jobs"`
+	Databases    []*PlannedDatabase `json:"databases"`
+	// Skipped are databases left out by filters
+	Skipped []string `json:"skipped"`
+	// Commands are executed before databases are processed, i.e. globals
+	Commands []string `json:"commands"`
+}
+
+// PlannedDatabase is a database in the order it's started, Jobs may be raised at run time
+// when jobs of finished databases are free (see JobsScheduler).
+type PlannedDatabase struct {
+	DatName   string `json:"datname"`
+	SizeBytes int64  `json:"size_bytes"`
+	Jobs      int    `json:"jobs"`
+	Status    string `json:"status"`
+	Path      string `json:"path"`
+	Command   string `json:"command,omitempty"`
+}
+
+var connStrPasswordRe = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactConnStr hides the password of a connection string, both URL and keyword/value formats are supported.
+func RedactConnStr(connStr string) string {
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		u, err := url.Parse(connStr)
+		if err != nil {
+			return "<invalid connection string>"
+		}
+		if q := u.Query(); q.Has("password") {
+			q.Set("password", "xxxxx")
+			u.RawQuery = q.Encode()
+		}
+		return u.Redacted()
+	}
+	return connStrPasswordRe.ReplaceAllString(connStr, "${1}xxxxx")
+}
+
+// CommandLine renders the command as it'd be typed in a shell, values of --dbname are redacted.
+func CommandLine(bin string, args []string) string {
+	parts := make([]string, 0, len(args)+1)
+	parts = append(parts, shellQuote(filepath.ToSlash(bin)))
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "--dbname="); ok {
+			arg = "--dbname=" + RedactConnStr(value)
+		}
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`&|;<>()*?[]{}!#~") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// PrintRunPlan renders the plan as a human-readable summary, and a per-database table.
+func PrintRunPlan(w io.Writer, plan *RunPlan) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Source:\t%s\n", plan.Source)
+	fmt.Fprintf(tw, "Target:\t%s\n", plan.Target)
+	fmt.Fprintf(tw, "Workers:\t%d\n", plan.Workers)
+	fmt.Fprintf(tw, "Max total jobs:\t%d\n", plan.MaxTotalJobs)
+	fmt.Fprintf(tw, "Skipped:\t%s\n", strings.Join(plan.Skipped, ", "))
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "DATABASE\tSIZE\tJOBS\tSTATUS\tPATH")
+	for _, db := range plan.Databases {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", db.DatName, ByteCountIEC(db.SizeBytes), db.Jobs, db.Status, db.Path)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range plan.Commands {
+		fmt.Fprintf(w, "  %s\n", cmd)
+	}
+	for _, db := range plan.Databases {
+		if db.Command != "" {
+			fmt.Fprintf(w, "  %s\n", db.Command)
+		}
+	}
+	return nil
+}
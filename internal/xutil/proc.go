@@ -0,0 +1,55 @@
+package xutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"time"
+)
+
+const (
+	DefaultGracePeriod = 10 * time.Second
+
+	// ExitCodeInterrupted is returned when the run was cancelled by SIGINT/SIGTERM.
+	ExitCodeInterrupted = 130
+)
+
+// GracePeriod is how long a subprocess is given to exit after SIGTERM, before its process group is killed.
+var GracePeriod = DefaultGracePeriod
+
+// RunCmd starts the command in its own process group and waits for it.
+// When ctx is cancelled, the whole group (i.e. pg_dump and its --jobs workers) receives SIGTERM,
+// and everything that is still alive after the GracePeriod is killed.
+func RunCmd(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	slog.Debug("exec", slog.String("cmd", CommandLine(cmd.Path, cmd.Args[1:])))
+	setProcGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		pid := cmd.Process.Pid
+		terminateProcGroup(pid)
+		select {
+		case <-done:
+		case <-time.After(GracePeriod):
+		}
+		// workers may outlive the leader, so the group is killed in any case
+		killProcGroup(pid)
+		<-done
+		return fmt.Errorf("%s interrupted: %w", cmd.Path, ctx.Err())
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package xutil
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCmdInterrupted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// the shell ignores SIGTERM, so the group has to be killed after the grace period
+	GracePeriod = 300 * time.Millisecond
+	defer func() { GracePeriod = DefaultGracePeriod }()
+
+	start := time.Now()
+	err := RunCmd(ctx, exec.Command("sh", "-c", "trap '' TERM; sleep 30 & wait"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunCmdOk(t *testing.T) {
+	assert.NoError(t, RunCmd(context.Background(), exec.Command("true")))
+	assert.Error(t, RunCmd(context.Background(), exec.Command("false")))
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package xutil
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func terminateProcGroup(pid int) {
+	_ = syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+func killProcGroup(pid int) {
+	_ = syscall.Kill(-pid, syscall.SIGKILL)
+}
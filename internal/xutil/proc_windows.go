@@ -0,0 +1,24 @@
+//go:build windows
+
+package xutil
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// there are no signals on windows, so the process is killed right away
+func terminateProcGroup(pid int) {
+	killProcGroup(pid)
+}
+
+func killProcGroup(pid int) {
+	if p, err := os.FindProcess(pid); err == nil {
+		_ = p.Kill()
+	}
+}
@@ -0,0 +1,396 @@
+package xutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DefaultProgressInterval = 30 * time.Second
+	// progressRedrawInterval is how often the terminal view is redrawn
+	progressRedrawInterval = time.Second
+	// progressMaxFraction is the estimate of a running database, until it's actually finished
+	progressMaxFraction = 0.99
+)
+
+var (
+	// pg_dump/pg_restore --verbose report table data of a serial run when it's started,
+	// and of a parallel run (--jobs > 1) when a worker finishes it
+	tableDataSerialRe   = regexp.MustCompile(`: (dumping contents of table|processing data for table) `)
+	tableDataParallelRe = regexp.MustCompile(`: finished item \d+ TABLE DATA `)
+)
+
+// Progress tracks databases being dumped or restored, and reports overall percent, throughput and ETA:
+// as a table redrawn in place when stderr is a terminal, or as periodic log lines otherwise.
+//
+// A database is estimated by the larger of two fractions: bytes written so far of its size,
+// and table data completed (parsed from --verbose stderr) of its tables.
+type Progress struct {
+	op        string
+	total     int64
+	databases int
+	started   time.Time
+
+	mu    sync.Mutex
+	tasks []*ProgressTask
+	// view is the terminal view drawn last time
+	view []byte
+}
+
+// ProgressTask is a database being processed, see Progress.Track
+type ProgressTask struct {
+	datName   string
+	sizeBytes int64
+	tables    int
+	jobs      int
+	started   time.Time
+	written   func() (int64, error)
+
+	tablesDone   atomic.Int64
+	writtenBytes atomic.Int64
+	done         atomic.Bool
+}
+
+// ProgressSnapshot is the state of a Progress at a moment
+type ProgressSnapshot struct {
+	Op             string
+	Elapsed        time.Duration
+	Databases      int
+	Finished       int
+	TotalBytes     int64
+	ProcessedBytes int64
+	Percent        float64
+	// BytesPerSec is the throughput in bytes of database size processed
+	BytesPerSec float64
+	// ETA is zero while unknown
+	ETA     time.Duration
+	Running []ProgressDatabase
+}
+
+// ProgressDatabase is the state of a running database
+type ProgressDatabase struct {
+	DatName   string
+	SizeBytes int64
+	// WrittenBytes is -1, when it's not tracked
+	WrittenBytes int64
+	Tables       int
+	TablesDone   int
+	Jobs         int
+	Percent      float64
+	Elapsed      time.Duration
+}
+
+// NewProgress creates a progress of the databases to be processed, sizes are weights of databases in the total.
+func NewProgress(op string, databases []*DBInfo) *Progress {
+	p := &Progress{op: op, databases: len(databases), started: time.Now()}
+	for _, db := range databases {
+		p.total += db.SizeBytes
+	}
+	return p
+}
+
+// Track starts tracking a database (or a dump of it), written reports bytes written so far (it may be nil).
+// Tables of the database are known from its stats, completed ones are counted by the Stderr writer.
+func (p *Progress) Track(datName string, db *DBInfo, jobs int, written func() (int64, error)) *ProgressTask {
+	t := &ProgressTask{
+		datName:   datName,
+		sizeBytes: db.SizeBytes,
+		jobs:      jobs,
+		started:   time.Now(),
+		written:   written,
+	}
+	if db.Tables != nil {
+		t.tables = db.Tables.Count
+	}
+	p.mu.Lock()
+	p.tasks = append(p.tasks, t)
+	p.mu.Unlock()
+	return t
+}
+
+// Stderr returns a writer which counts table data completed by pg_dump/pg_restore --verbose
+func (t *ProgressTask) Stderr() io.Writer {
+	re := tableDataSerialRe
+	if t.jobs > 1 {
+		re = tableDataParallelRe
+	}
+	return &lineCounter{re: re, count: &t.tablesDone}
+}
+
+// Done marks the database as finished, whether it succeeded or not
+func (t *ProgressTask) Done() {
+	t.done.Store(true)
+}
+
+func (t *ProgressTask) fraction() float64 {
+	if t.done.Load() {
+		return 1
+	}
+	var f float64
+	if t.sizeBytes > 0 {
+		f = float64(t.writtenBytes.Load()) / float64(t.sizeBytes)
+	}
+	if t.tables > 0 {
+		f = max(f, float64(t.tablesDone.Load())/float64(t.tables))
+	}
+	return min(f, progressMaxFraction)
+}
+
+// Snapshot samples bytes written by running databases, and estimates the overall progress.
+func (p *Progress) Snapshot() *ProgressSnapshot {
+	p.mu.Lock()
+	tasks := append([]*ProgressTask{}, p.tasks...)
+	p.mu.Unlock()
+
+	s := &ProgressSnapshot{
+		Op:         p.op,
+		Elapsed:    time.Since(p.started),
+		Databases:  p.databases,
+		TotalBytes: p.total,
+		Running:    []ProgressDatabase{},
+	}
+	var processed float64
+	for _, t := range tasks {
+		if !t.done.Load() && t.written != nil {
+			// a failed sample keeps the previous one, files may be changing while they're walked
+			if n, err := t.written(); err == nil {
+				t.writtenBytes.Store(n)
+			}
+		}
+		fraction := t.fraction()
+		processed += fraction * float64(t.sizeBytes)
+		if t.done.Load() {
+			s.Finished++
+			continue
+		}
+		written := int64(-1)
+		if t.written != nil {
+			written = t.writtenBytes.Load()
+		}
+		s.Running = append(s.Running, ProgressDatabase{
+			DatName:      t.datName,
+			SizeBytes:    t.sizeBytes,
+			WrittenBytes: written,
+			Tables:       t.tables,
+			TablesDone:   int(t.tablesDone.Load()),
+			Jobs:         t.jobs,
+			Percent:      fraction * 100,
+			Elapsed:      time.Since(t.started),
+		})
+	}
+	sort.SliceStable(s.Running, func(i, j int) bool {
+		return s.Running[i].SizeBytes > s.Running[j].SizeBytes
+	})
+
+	s.ProcessedBytes = int64(processed)
+	if s.TotalBytes > 0 {
+		s.Percent = processed / float64(s.TotalBytes) * 100
+	}
+	if secs := s.Elapsed.Seconds(); secs > 0 {
+		s.BytesPerSec = processed / secs
+	}
+	if s.BytesPerSec > 0 {
+		remaining := float64(s.TotalBytes) - processed
+		s.ETA = time.Duration(remaining / s.BytesPerSec * float64(time.Second)).Round(time.Second)
+	}
+	return s
+}
+
+// Run reports the progress until the returned func is called, interval of zero disables reporting.
+// On a terminal, the console is routed through the view, so log lines are printed above it.
+func (p *Progress) Run(ctx context.Context, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	if !IsTerminal(os.Stderr) {
+		return p.loop(ctx, interval, p.logSnapshot)
+	}
+	prevConsole := setConsole(&progressLogWriter{p: p, out: os.Stderr})
+	stopLoop := p.loop(ctx, progressRedrawInterval, func() { p.redraw(os.Stderr) })
+	return func() {
+		stopLoop()
+		p.mu.Lock()
+		p.clear(os.Stderr)
+		p.view = nil
+		p.mu.Unlock()
+		setConsole(prevConsole)
+	}
+}
+
+func (p *Progress) loop(ctx context.Context, interval time.Duration, report func()) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func (p *Progress) logSnapshot() {
+	s := p.Snapshot()
+	for _, db := range s.Running {
+		attrs := []any{
+			slog.String("status", "progress"),
+			slog.String("dbname", db.DatName),
+			slog.Int("percent", int(db.Percent)),
+		}
+		if db.WrittenBytes >= 0 {
+			attrs = append(attrs, slog.String("written", ByteCountSI(db.WrittenBytes)))
+		}
+		attrs = append(attrs,
+			slog.String("dbsize", ByteCountSI(db.SizeBytes)),
+			slog.String("tables", fmt.Sprintf("%d/%d", db.TablesDone, db.Tables)),
+			slog.Duration("elapsed", db.Elapsed.Round(time.Second)),
+		)
+		slog.Info(p.op, attrs...)
+	}
+	slog.Info(p.op,
+		slog.String("status", "progress"),
+		slog.String("databases", fmt.Sprintf("%d/%d", s.Finished, s.Databases)),
+		slog.Int("percent", int(s.Percent)),
+		slog.String("processed", ByteCountSI(s.ProcessedBytes)),
+		slog.String("total", ByteCountSI(s.TotalBytes)),
+		slog.String("rate", ByteCountSI(int64(s.BytesPerSec))+"/s"),
+		slog.String("eta", formatETA(s.ETA)),
+	)
+}
+
+// PrintProgress renders the snapshot as a summary line, and a table of running databases.
+func PrintProgress(w io.Writer, s *ProgressSnapshot) error {
+	fmt.Fprintf(w, "%s: %d/%d databases, %.0f%% (%s of %s), %s/s, ETA %s\n",
+		s.Op, s.Finished, s.Databases, s.Percent,
+		ByteCountSI(s.ProcessedBytes), ByteCountSI(s.TotalBytes), ByteCountSI(int64(s.BytesPerSec)), formatETA(s.ETA),
+	)
+	if len(s.Running) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  DATABASE\tPERCENT\tWRITTEN\tSIZE\tTABLES\tJOBS\tELAPSED")
+	for _, db := range s.Running {
+		written := "-"
+		if db.WrittenBytes >= 0 {
+			written = ByteCountSI(db.WrittenBytes)
+		}
+		fmt.Fprintf(tw, "  %s\t%.0f%%\t%s\t%s\t%d/%d\t%d\t%s\n",
+			db.DatName, db.Percent, written, ByteCountSI(db.SizeBytes),
+			db.TablesDone, db.Tables, db.Jobs, db.Elapsed.Round(time.Second),
+		)
+	}
+	return tw.Flush()
+}
+
+func formatETA(eta time.Duration) string {
+	if eta <= 0 {
+		return "-"
+	}
+	return eta.String()
+}
+
+// redraw replaces the view drawn last time with the current one
+func (p *Progress) redraw(out io.Writer) {
+	s := p.Snapshot()
+	var buf bytes.Buffer
+	if err := PrintProgress(&buf, s); err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear(out)
+	p.draw(out, buf.Bytes())
+}
+
+func (p *Progress) draw(out io.Writer, view []byte) {
+	_, _ = out.Write(view)
+	p.view = view
+}
+
+// clear moves the cursor to the first line of the view, and erases the screen below
+func (p *Progress) clear(out io.Writer) {
+	if lines := bytes.Count(p.view, []byte("\n")); lines > 0 {
+		fmt.Fprintf(out, "\x1b[%dF\x1b[J", lines)
+	}
+}
+
+// progressLogWriter prints log lines above the terminal view
+type progressLogWriter struct {
+	p   *Progress
+	out io.Writer
+}
+
+func (w *progressLogWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+	w.p.clear(w.out)
+	n, err := w.out.Write(b)
+	w.p.draw(w.out, w.p.view)
+	return n, err
+}
+
+// lineCounter counts lines of the output matching the pattern
+type lineCounter struct {
+	re      *regexp.Regexp
+	count   *atomic.Int64
+	partial []byte
+}
+
+func (c *lineCounter) Write(b []byte) (int, error) {
+	data := b
+	if len(c.partial) > 0 {
+		data = append(c.partial, b...)
+		c.partial = nil
+	}
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if c.re.Match(data[:i]) {
+			c.count.Add(1)
+		}
+		data = data[i+1:]
+	}
+	// a line is never that long, unless it's not a log at all
+	if len(data) < 64*1024 {
+		c.partial = append(c.partial, data...)
+	}
+	return len(b), nil
+}
+
+// IsTerminal reports whether the file is a terminal (a character device)
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0 && !strings.EqualFold(os.Getenv("TERM"), "dumb")
+}
@@ -0,0 +1,86 @@
+package xutil
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressStderr(t *testing.T) {
+	p := NewProgress("dump", nil)
+
+	serial := p.Track("db1", &DBInfo{SizeBytes: 100, Tables: &TableStats{Count: 3}}, 1, nil)
+	w := serial.Stderr()
+	// lines may be split between writes
+	_, err := io.WriteString(w, "pg_dump: dumping contents of table \"public.t1\"\npg_dump: dumping con")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "tents of table \"public.t2\"\npg_dump: finished item 10 TABLE DATA t1\n")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, serial.tablesDone.Load())
+
+	parallel := p.Track("db2", &DBInfo{SizeBytes: 100}, 4, nil)
+	_, err = io.WriteString(parallel.Stderr(), `pg_restore: processing data for table "public.t1"
+pg_restore: launching item 3412 TABLE DATA public t1
+pg_restore: finished item 3412 TABLE DATA public t1
+pg_restore: finished item 3413 INDEX public t1_idx
+`)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, parallel.tablesDone.Load())
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	p := NewProgress("dump", []*DBInfo{
+		{DatName: "db1", SizeBytes: 600},
+		{DatName: "db2", SizeBytes: 300},
+		{DatName: "db3", SizeBytes: 100},
+	})
+
+	db1 := p.Track("db1", &DBInfo{SizeBytes: 600, Tables: &TableStats{Count: 4}}, 2, func() (int64, error) {
+		return 150, nil
+	})
+	db2 := p.Track("db2", &DBInfo{SizeBytes: 300}, 1, nil)
+	db2.Done()
+	// tables are ahead of bytes
+	db1.tablesDone.Store(2)
+
+	s := p.Snapshot()
+	assert.Equal(t, 3, s.Databases)
+	assert.Equal(t, 1, s.Finished)
+	assert.EqualValues(t, 1000, s.TotalBytes)
+	assert.EqualValues(t, 600, s.ProcessedBytes)
+	assert.InDelta(t, 60, s.Percent, 0.01)
+	assert.Greater(t, s.BytesPerSec, float64(0))
+
+	require.Len(t, s.Running, 1)
+	assert.Equal(t, "db1", s.Running[0].DatName)
+	assert.EqualValues(t, 150, s.Running[0].WrittenBytes)
+	assert.InDelta(t, 50, s.Running[0].Percent, 0.01)
+
+	// a running database is never estimated as complete
+	db1.tablesDone.Store(4)
+	s = p.Snapshot()
+	assert.InDelta(t, 99, s.Running[0].Percent, 0.01)
+}
+
+func TestPrintProgress(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, PrintProgress(&buf, &ProgressSnapshot{
+		Op:             "restore",
+		Databases:      3,
+		Finished:       1,
+		TotalBytes:     2000,
+		ProcessedBytes: 1000,
+		Percent:        50,
+		BytesPerSec:    100,
+		ETA:            10e9,
+		Running: []ProgressDatabase{
+			{DatName: "db1", SizeBytes: 1000, WrittenBytes: -1, Tables: 4, TablesDone: 1, Jobs: 2, Percent: 25},
+		},
+	}))
+	out := buf.String()
+	assert.Contains(t, out, "restore: 1/3 databases, 50% (1.0 kB of 2.0 kB), 100 B/s, ETA 10s\n")
+	assert.Contains(t, out, "db1       25%      -        1.0 kB  1/4")
+}
@@ -0,0 +1,39 @@
+package xutil
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadRoleMap parses lines 'source_role -> target_role', empty lines and '#' comments are ignored
+func ReadRoleMap(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mapping := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		from, to, ok := strings.Cut(line, "->")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("%s:%d: invalid role mapping: %s (expected: source_role -> target_role)", path, n, line)
+		}
+		if _, ok := mapping[from]; ok {
+			return nil, fmt.Errorf("%s:%d: role is mapped more than once: %s", path, n, from)
+		}
+		mapping[from] = to
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
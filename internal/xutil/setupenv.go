@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"sync"
 	"time"
 
@@ -26,9 +25,9 @@ var (
 	setupErr  error
 )
 
-func SetupEnv(_ context.Context, connStr string) error {
+func SetupEnv(ctx context.Context, connStr string) error {
 	setupOnce.Do(func() {
-		if err := validateConnStr(connStr); err != nil {
+		if err := validateConnStr(ctx, connStr); err != nil {
 			setupErr = err
 			return
 		}
@@ -57,14 +56,7 @@ func checkRequired() error {
 		}
 	}
 
-	// ensure binaries
-	for _, requiredBin := range []string{
-		"pg_dump",
-	} {
-		if _, err := exec.LookPath(requiredBin); err != nil {
-			return fmt.Errorf("required binary not found: %s", requiredBin)
-		}
-	}
+	// binaries are resolved by version, see ResolvePgBinPath
 	return nil
 }
 
@@ -91,29 +83,40 @@ func setEnvFromConnStr(connStr string) error {
 	return nil
 }
 
-func validateConnStr(connStr string) error {
+func validateConnStr(ctx context.Context, connStr string) error {
 	deadline := time.Now().Add(DefaultConnWaitTimeout)
 
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-
-		conn, err := pgx.Connect(ctx, connStr)
+		err := pingConnStr(ctx, connStr)
 		if err == nil {
-			if err := conn.Ping(ctx); err != nil {
-				conn.Close(ctx)
-				return fmt.Errorf("ping failed: %w", err)
-			}
 			slog.Info("pg_isready", slog.String("status", "ok"))
-			conn.Close(ctx)
 			return nil // Ready
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
 		if time.Now().After(deadline) {
 			return fmt.Errorf("PostgreSQL not ready after %s: %w", DefaultConnWaitTimeout, err)
 		}
 
 		slog.Info("pg_isready", slog.String("status", "waiting"))
-		time.Sleep(DefaultConnSleepWhileWaiting)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(DefaultConnSleepWhileWaiting):
+		}
+	}
+}
+
+func pingConnStr(ctx context.Context, connStr string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return err
 	}
+	defer conn.Close(ctx)
+	return conn.Ping(ctx)
 }
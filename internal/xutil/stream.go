@@ -0,0 +1,115 @@
+package xutil
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// stderrTailSize is how much of stderr is kept for error messages, the whole one is in log files
+const stderrTailSize = 8 * 1024
+
+// Stderr fans out stderr of a subprocess as it's written: into log files, and to the console
+// (each line prefixed with the name) when it's streamed. Its tail is kept for error messages.
+type Stderr struct {
+	io.Writer
+	tail    *tailBuffer
+	console *prefixWriter
+}
+
+func NewStderr(name string, stream bool, writers ...io.Writer) *Stderr {
+	s := &Stderr{tail: &tailBuffer{size: stderrTailSize}}
+	writers = append(writers, s.tail)
+	if stream {
+		s.console = &prefixWriter{w: ConsoleWriter(), prefix: []byte("[" + name + "] ")}
+		writers = append(writers, s.console)
+	}
+	s.Writer = io.MultiWriter(writers...)
+	return s
+}
+
+// Tail returns the last lines of stderr
+func (s *Stderr) Tail() string {
+	return s.tail.String()
+}
+
+// Close prints the last line to the console, when it has no line break
+func (s *Stderr) Close() error {
+	if s.console == nil {
+		return nil
+	}
+	return s.console.flush()
+}
+
+// tailBuffer keeps the last size bytes written
+type tailBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, b...)
+	if over := len(t.buf) - t.size; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(b), nil
+}
+
+// String returns the tail, starting with a complete line if it was cut
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tail := t.buf
+	if len(tail) == t.size {
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+	return string(tail)
+}
+
+// prefixWriter writes complete lines with the prefix, so lines of concurrent subprocesses are not mixed
+type prefixWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  []byte
+	partial []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data := append(p.partial, b...)
+	var out []byte
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, p.prefix...)
+		out = append(out, data[:i+1]...)
+		data = data[i+1:]
+	}
+	p.partial = append([]byte(nil), data...)
+	if len(out) > 0 {
+		if _, err := p.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (p *prefixWriter) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.partial) == 0 {
+		return nil
+	}
+	line := append(append(append([]byte(nil), p.prefix...), p.partial...), '\n')
+	p.partial = nil
+	_, err := p.w.Write(line)
+	return err
+}
@@ -0,0 +1,55 @@
+package xutil
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStderr(t *testing.T) {
+	var console bytes.Buffer
+	prev := setConsole(&console)
+	defer setConsole(prev)
+
+	var logFile bytes.Buffer
+	stderr := NewStderr("db1", true, &logFile)
+	_, err := io.WriteString(stderr, "pg_dump: reading extensions\npg_dump: identifying")
+	require.NoError(t, err)
+	assert.Equal(t, "[db1] pg_dump: reading extensions\n", console.String())
+
+	_, err = io.WriteString(stderr, " extension members\npg_dump: error: connection lost")
+	require.NoError(t, err)
+	require.NoError(t, stderr.Close())
+
+	assert.Equal(t, "[db1] pg_dump: reading extensions\n"+
+		"[db1] pg_dump: identifying extension members\n"+
+		"[db1] pg_dump: error: connection lost\n", console.String())
+	assert.Equal(t, "pg_dump: reading extensions\npg_dump: identifying extension members\npg_dump: error: connection lost",
+		logFile.String())
+	assert.Equal(t, logFile.String(), stderr.Tail())
+}
+
+func TestStderrTail(t *testing.T) {
+	var console bytes.Buffer
+	prev := setConsole(&console)
+	defer setConsole(prev)
+
+	stderr := NewStderr("db1", false)
+	for i := 0; i < 1000; i++ {
+		_, err := io.WriteString(stderr, "pg_dump: dumping contents of table \"public.t\"\n")
+		require.NoError(t, err)
+	}
+	_, err := io.WriteString(stderr, "pg_dump: error: query failed\n")
+	require.NoError(t, err)
+
+	tail := stderr.Tail()
+	assert.LessOrEqual(t, len(tail), stderrTailSize)
+	assert.True(t, strings.HasPrefix(tail, "pg_dump: dumping contents"), "the cut line is dropped")
+	assert.True(t, strings.HasSuffix(tail, "pg_dump: error: query failed\n"))
+	// not streamed
+	assert.Empty(t, console.String())
+}
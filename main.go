@@ -2,16 +2,32 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/hashmap-kz/pgdump-each/internal/catalog"
+	"github.com/hashmap-kz/pgdump-each/internal/compare"
 	"github.com/hashmap-kz/pgdump-each/internal/dump"
+	"github.com/hashmap-kz/pgdump-each/internal/metrics"
+	"github.com/hashmap-kz/pgdump-each/internal/preflight"
 	"github.com/hashmap-kz/pgdump-each/internal/restore"
+	"github.com/hashmap-kz/pgdump-each/internal/runlog"
+	"github.com/hashmap-kz/pgdump-each/internal/storage"
+	"github.com/hashmap-kz/pgdump-each/internal/verify"
 	"github.com/hashmap-kz/pgdump-each/internal/version"
 	"github.com/hashmap-kz/pgdump-each/internal/xutil"
 
 	"github.com/spf13/cobra"
 )
 
+// connStrRequired is a command annotation, marks commands that need --connstr
+const connStrRequired = "connstr-required"
+
 var (
 	connStr       string
 	inputPath     string
@@ -20,7 +36,62 @@ var (
 	exitOnErr     bool
 	compress      string
 	parallelDBS   int
-	restoreLogDir string
+	maxTotalJobs  int
+	dryRun        bool
+	progressEvery time.Duration
+	metricsFile   string
+	streamStderr  bool
+	metricsListen string
+	logDir        string
+	logFormat     string
+	logLevel      string
+	gracePeriod   time.Duration
+	resume        bool
+	onConflict    string
+	confirmDrop   bool
+	restoreGlobs  bool
+	renames       []string
+	renamePrefix  string
+	renameSuffix  string
+	roleMapFile   string
+	skipRoles     []string
+	noOwner       bool
+	noPrivileges  bool
+	resumeStage   string
+	keepStage     bool
+	verifyAgainst string
+	sourceConnStr string
+	targetConnStr string
+	rowCounts     string
+	reportPath    string
+	workDir       string
+	s3Endpoint    string
+	s3Region      string
+
+	encryptRecipients      []string
+	encryptRecipientsFiles []string
+	decryptIdentities      []string
+	signingKey             string
+	verifyKey              string
+
+	keepLast     int
+	keepDaily    int
+	keepWeekly   int
+	keepMonthly  int
+	maxAge       time.Duration
+	maxTotalSize string
+	staleAfter   time.Duration
+	pruneDryRun  bool
+
+	checksumWorkers   int
+	checksumAlgorithm string
+
+	includeDBs      []string
+	excludeDBs      []string
+	includePostgres bool
+
+	// runLog is set up before any command is executed
+	runLog *runlog.Logger
 )
 
 func main() {
@@ -44,67 +115,605 @@ Explicitly specify the path to PostgreSQL binaries (optional)
 `)
 
 	rootCmd.PersistentFlags().IntVarP(&parallelDBS, "parallel-databases", "p", 2, "Number of concurrent dumps")
-
-	if err := rootCmd.MarkPersistentFlagRequired("connstr"); err != nil {
-		log.Fatal(err)
+	rootCmd.PersistentFlags().DurationVar(&gracePeriod, "grace-period", xutil.DefaultGracePeriod, `
+How long subprocesses are given to exit on SIGINT/SIGTERM, before they are killed
+`)
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", runlog.FormatText, "Log format: text or json")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", `
+Log level: debug, info, warn or error
+debug also logs command lines of subprocesses (passwords redacted)
+`)
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, _ []string) error {
+		var err error
+		runLog, err = runlog.Setup(logFormat, logLevel)
+		if err != nil {
+			return err
+		}
+		xutil.GracePeriod = gracePeriod
+		// --connstr is persistent, but not every command needs it
+		if cmd.Annotations[connStrRequired] == "true" && connStr == "" {
+			return fmt.Errorf(`required flag(s) "connstr" not set`)
+		}
+		return nil
 	}
 
 	// backup
 
 	dumpCmd := &cobra.Command{
-		Use:   "dump",
-		Short: "Dump all databases",
-		RunE: func(_ *cobra.Command, _ []string) error {
-			ctx := context.Background()
+		Use:         "dump",
+		Short:       "Dump all databases",
+		Annotations: map[string]string{connStrRequired: "true"},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+			// a dry-run writes nothing, logs included
+			if !dryRun {
+				if err := runLog.OpenRunDir(logDir, "dump"); err != nil {
+					return err
+				}
+			}
 			if err := xutil.SetupEnv(ctx, connStr); err != nil {
 				return err
 			}
-			return dump.RunDumpJobs(ctx, &dump.ClusterDumpContext{
+			dumpContext := &dump.ClusterDumpContext{
 				ConnStr:     connStr,
 				OutputDir:   outputDir,
 				PgBinPath:   pgBinPath,
 				Compress:    compress,
 				ParallelDBS: parallelDBS,
+				Filter:      dbFilter(),
+
+				MaxTotalJobs: maxTotalJobs,
+
+				ResumeStage:     resumeStage,
+				KeepFailedStage: keepStage,
+
+				WorkDir:        workDir,
+				StorageOptions: storageOptions(),
+
+				ChecksumWorkers:        checksumWorkers,
+				ChecksumAlgorithm:      checksumAlgorithm,
+				EncryptRecipients:      encryptRecipients,
+				EncryptRecipientsFiles: encryptRecipientsFiles,
+				SigningKey:             signingKey,
+
+				ProgressInterval: progressEvery,
+				StreamStderr:     streamStderr,
+				RunID:            runLog.RunID(),
+				LogDir:           runLog.Dir(),
+			}
+			if dryRun {
+				plan, err := dump.RunDumpPlan(ctx, dumpContext)
+				if err != nil {
+					return err
+				}
+				return xutil.PrintRunPlan(os.Stdout, plan)
+			}
+			return runWithMetrics("dump", func(m *metrics.Run) error {
+				dumpContext.Metrics = m
+				return dump.RunDumpJobs(ctx, dumpContext)
 			})
 		},
 	}
-	dumpCmd.Flags().StringVarP(&outputDir, "output", "D", "", "Directory to store backups (required)")
+	addDBFilterFlags(dumpCmd)
+	addJobsFlags(dumpCmd)
+	addDryRunFlag(dumpCmd)
+	addProgressFlag(dumpCmd)
+	addMetricsFlags(dumpCmd)
+	addLogFlags(dumpCmd, `
+Logs of each run (pgdump-each, pg_dump and pg_dumpall, including failed ones) are saved to '<log-dir>/dump-<run-id>'
+(default: current dir)
+`)
+	addStorageFlags(dumpCmd)
+	addChecksumFlags(dumpCmd)
+	dumpCmd.Flags().StringVar(&checksumAlgorithm, "checksum-algorithm", xutil.DefaultHash, `
+Hash algorithm of checksums files: sha256, sha512 or blake3
+Restore and verify read it from the checksums file
+`)
+	dumpCmd.Flags().StringVar(&resumeStage, "resume", "", `
+Resume a failed dump from its stage dir (i.e. ./backups/20250328154501.dirty)
+Only databases without a completed dump are processed, the stage is kept on failure
+The source cluster and selected databases must be the same as the failed run had
+`)
+	dumpCmd.Flags().StringArrayVar(&encryptRecipients, "encrypt-recipient", nil, `
+Encrypt every file of the backup for the age public key (age1...), repeatable
+Any of the recipients is able to restore the backup
+`)
+	dumpCmd.Flags().StringArrayVar(&encryptRecipientsFiles, "encrypt-recipients-file", nil, `
+File with age public keys, one per line (repeatable)
+`)
+	dumpCmd.Flags().StringVar(&signingKey, "signing-key", "", `
+PEM Ed25519 private key file, checksums.txt is signed with it (checksums.txt.sig)
+i.e. created by 'openssl genpkey -algorithm ed25519 -out signing.pem'
+`)
+	dumpCmd.Flags().BoolVar(&keepStage, "keep-failed-stage", false, "Keep the stage dir if the dump fails, so it can be resumed")
+	dumpCmd.Flags().StringVarP(&outputDir, "output", "D", "", `
+Directory to store backups (required, unless --resume is given: the output of the stage is used)
+Local path, or s3://bucket/prefix for S3-compatible storage
+`)
 	dumpCmd.Flags().StringVarP(&compress, "compress", "Z", "0", "Specify the compression method and/or the compression level to use")
-	if err := dumpCmd.MarkFlagRequired("output"); err != nil {
-		log.Fatal(err)
-	}
 
 	// restore
 
 	restoreCmd := &cobra.Command{
-		Use:   "restore",
-		Short: "Restore all databases from input",
-		RunE: func(_ *cobra.Command, _ []string) error {
-			ctx := context.Background()
+		Use:         "restore",
+		Short:       "Restore all databases from input",
+		Annotations: map[string]string{connStrRequired: "true"},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+			if !dryRun {
+				if err := runLog.OpenRunDir(logDir, "restore"); err != nil {
+					return err
+				}
+			}
 			if err := xutil.SetupEnv(ctx, connStr); err != nil {
 				return err
 			}
-			return restore.RunRestoreJobs(ctx, &restore.ClusterRestoreContext{
+			restoreContext := &restore.ClusterRestoreContext{
 				ConnStr:     connStr,
 				InputDir:    inputPath,
 				PgBinPath:   pgBinPath,
 				ExitOnError: exitOnErr,
 				ParallelDBS: parallelDBS,
-				LogDir:      restoreLogDir,
+				LogDir:      logDir,
+				Filter:      dbFilter(),
+				Resume:      resume,
+
+				OnConflict:  onConflict,
+				ConfirmDrop: confirmDrop,
+
+				RestoreGlobals: restoreGlobs,
+
+				Rename:       renames,
+				RenamePrefix: renamePrefix,
+				RenameSuffix: renameSuffix,
+
+				RoleMapFile:  roleMapFile,
+				SkipRoles:    skipRoles,
+				NoOwner:      noOwner,
+				NoPrivileges: noPrivileges,
+
+				MaxTotalJobs: maxTotalJobs,
+
+				VerifyAgainst:   verifyAgainst,
+				VerifyRowCounts: rowCounts,
+
+				WorkDir:        workDir,
+				StorageOptions: storageOptions(),
+
+				ChecksumWorkers:   checksumWorkers,
+				DecryptIdentities: decryptIdentities,
+				VerifyKey:         verifyKey,
+
+				ProgressInterval: progressEvery,
+				StreamStderr:     streamStderr,
+				RunLogDir:        runLog.Dir(),
+			}
+			if dryRun {
+				plan, err := restore.RunRestorePlan(ctx, restoreContext)
+				if err != nil {
+					return err
+				}
+				return xutil.PrintRunPlan(os.Stdout, plan)
+			}
+			return runWithMetrics("restore", func(m *metrics.Run) error {
+				restoreContext.Metrics = m
+				return restore.RunRestoreJobs(ctx, restoreContext)
 			})
 		},
 	}
-	restoreCmd.Flags().StringVarP(&inputPath, "input", "D", "", "Path to backup directory (required)")
+	addDBFilterFlags(restoreCmd)
+	addJobsFlags(restoreCmd)
+	addDryRunFlag(restoreCmd)
+	addProgressFlag(restoreCmd)
+	addMetricsFlags(restoreCmd)
+	addStorageFlags(restoreCmd)
+	addChecksumFlags(restoreCmd)
+	restoreCmd.Flags().StringVar(&verifyAgainst, "verify-against", "", `
+Source cluster connection string, restored databases are compared with it (optional)
+`)
+	addRowCountsFlag(restoreCmd)
+	restoreCmd.Flags().StringArrayVar(&decryptIdentities, "decrypt-identity", nil, `
+age identity file (i.e. created by age-keygen), required for encrypted backups (repeatable)
+`)
+	addVerifyKeyFlag(restoreCmd)
+	restoreCmd.Flags().BoolVar(&resume, "resume", false, `
+Resume a failed restore using the state file in --log-dir
+Completed databases are skipped, failed/partial ones are dropped and restored again
+`)
+	restoreCmd.Flags().StringVar(&onConflict, "on-conflict", "", `
+What to do with databases that already exist in the target cluster: fail|skip|drop|rename
+Without it, the target cluster must be empty (only the 'postgres' database is allowed)
+rename keeps the existing database as '<dbname>_<timestamp>', drop requires --confirm-drop
+`)
+	restoreCmd.Flags().BoolVar(&confirmDrop, "confirm-drop", false, "Allow --on-conflict=drop to drop existing databases")
+	restoreCmd.Flags().BoolVar(&restoreGlobs, "restore-globals", false, `
+Restore globals.sql into a non-empty cluster (with --on-conflict), skipped there by default
+DROP ROLE/TABLESPACE statements are removed, existing roles are still altered (i.e. their passwords)
+`)
+	restoreCmd.Flags().StringArrayVar(&renames, "rename", nil, `
+Restore a database under a new name: old=new (repeatable)
+The target database is created with the encoding, locale and owner of the original one
+`)
+	restoreCmd.Flags().StringVar(&renamePrefix, "rename-prefix", "", "Prefix added to names of databases not renamed by --rename (i.e. stage_)")
+	restoreCmd.Flags().StringVar(&renameSuffix, "rename-suffix", "", "Suffix added to names of databases not renamed by --rename (i.e. _stage)")
+	restoreCmd.Flags().StringVar(&roleMapFile, "role-map", "", `
+File of 'source_role -> target_role' lines, applied to globals.sql and owners of database objects
+Target roles must exist: mapped roles are not created, their memberships, owners and grants are rewritten
+Requires --no-privileges: grants inside databases cannot be carried over to target roles
+`)
+	restoreCmd.Flags().StringArrayVar(&skipRoles, "skip-role", nil, "Role not restored from globals.sql, with its memberships and grants (repeatable, requires --no-owner)")
+	restoreCmd.Flags().BoolVar(&noOwner, "no-owner", false, "Passed to pg_restore: objects are owned by the restoring user")
+	restoreCmd.Flags().BoolVar(&noPrivileges, "no-privileges", false, "Passed to pg_restore: access privileges (grant/revoke) are not restored")
+	restoreCmd.Flags().StringVarP(&inputPath, "input", "D", "", `
+Path to backup directory (required)
+Local path, or s3://bucket/prefix/<timestamp>.dmp for S3-compatible storage
+`)
 	restoreCmd.Flags().BoolVarP(&exitOnErr, "exit-on-error", "e", true, "Exit if an error is encountered while sending SQL commands to the database")
-	restoreCmd.Flags().StringVar(&restoreLogDir, "log-dir", "", "Specify where to save restore logs (i.e. /tmp)")
+	addLogFlags(restoreCmd, `
+Logs of each run are saved to '<log-dir>/restore-<run-id>', the state file (see --resume) to the log-dir itself
+(default: current dir)
+`)
 	if err := restoreCmd.MarkFlagRequired("input"); err != nil {
 		log.Fatal(err)
 	}
 
-	// runner
+	// verify-restore
+
+	verifyRestoreCmd := &cobra.Command{
+		Use:         "verify-restore",
+		Short:       "Compare databases of the restored cluster (--connstr) with the source one (--source)",
+		Annotations: map[string]string{connStrRequired: "true"},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var roleMapping map[string]string
+			if roleMapFile != "" {
+				var err error
+				roleMapping, err = xutil.ReadRoleMap(roleMapFile)
+				if err != nil {
+					return err
+				}
+			}
+			report, err := compare.RunCompare(cmd.Context(), &compare.CompareContext{
+				SourceConnStr: sourceConnStr,
+				TargetConnStr: connStr,
+				ParallelDBS:   parallelDBS,
+				Filter:        dbFilter(),
+				RowCounts:     rowCounts,
+				RoleMapping:   roleMapping,
+				SkipRoles:     skipRoles,
+				ReportPath:    reportPath,
+			})
+			if report != nil {
+				if printErr := compare.PrintReport(os.Stdout, report); printErr != nil {
+					return printErr
+				}
+			}
+			return err
+		},
+	}
+	addDBFilterFlags(verifyRestoreCmd)
+	verifyRestoreCmd.Flags().StringVar(&sourceConnStr, "source", "", "Source cluster connection string (required)")
+	addRowCountsFlag(verifyRestoreCmd)
+	verifyRestoreCmd.Flags().StringVar(&roleMapFile, "role-map", "", `
+The role map file the cluster was restored with (restore --role-map): memberships are compared under target role names
+`)
+	verifyRestoreCmd.Flags().StringArrayVar(&skipRoles, "skip-role", nil, "Role skipped by the restore, its memberships are not compared (repeatable)")
+	verifyRestoreCmd.Flags().StringVar(&reportPath, "report", "", "Save JSON report to file (optional)")
+	if err := verifyRestoreCmd.MarkFlagRequired("source"); err != nil {
+		log.Fatal(err)
+	}
+
+	// preflight
+
+	preflightCmd := &cobra.Command{
+		Use:   "preflight",
+		Short: "Check whether the source cluster is ready to be migrated into the target one",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			report, err := preflight.RunPreflight(cmd.Context(), &preflight.PreflightContext{
+				SourceConnStr: sourceConnStr,
+				TargetConnStr: targetConnStr,
+				PgBinPath:     pgBinPath,
+				OutputDir:     outputDir,
+				Filter:        dbFilter(),
+				ReportPath:    reportPath,
+			})
+			if report != nil {
+				if printErr := preflight.PrintReport(os.Stdout, report); printErr != nil {
+					return printErr
+				}
+			}
+			return err
+		},
+	}
+	addDBFilterFlags(preflightCmd)
+	preflightCmd.Flags().StringVar(&sourceConnStr, "source", "", "Source cluster connection string (required)")
+	preflightCmd.Flags().StringVar(&targetConnStr, "target", "", "Target cluster connection string (required)")
+	preflightCmd.Flags().StringVarP(&outputDir, "output", "D", "", "Directory to store backups, its free space is checked (optional)")
+	preflightCmd.Flags().StringVar(&reportPath, "report", "", "Save JSON report to file (optional)")
+	for _, name := range []string{"source", "target"} {
+		if err := preflightCmd.MarkFlagRequired(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// verify
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify <backup|dump>",
+		Short: "Verify integrity of a backup (or a single <dbname>.dmp dir of it): checksums of every file, and toc.dat of every dump",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := verify.RunVerify(cmd.Context(), &verify.VerifyContext{
+				Location:          args[0],
+				StorageOptions:    storageOptions(),
+				PgBinPath:         pgBinPath,
+				ChecksumWorkers:   checksumWorkers,
+				DecryptIdentities: decryptIdentities,
+				VerifyKey:         verifyKey,
+				WorkDir:           workDir,
+				ReportPath:        reportPath,
+			})
+			if report != nil {
+				if printErr := verify.PrintReport(os.Stdout, report); printErr != nil {
+					return printErr
+				}
+			}
+			return err
+		},
+	}
+	addStorageFlags(verifyCmd)
+	addChecksumFlags(verifyCmd)
+	addVerifyKeyFlag(verifyCmd)
+	verifyCmd.Flags().StringArrayVar(&decryptIdentities, "decrypt-identity", nil, `
+age identity file, toc.dat of encrypted dumps is checked only if it's set (repeatable)
+`)
+	verifyCmd.Flags().StringVar(&reportPath, "report", "", "Save JSON report to file (optional)")
+
+	// list
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List backups and unfinished stages in the output dir",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			backups, err := catalog.RunList(cmd.Context(), &catalog.CatalogContext{
+				Location:       outputDir,
+				StorageOptions: storageOptions(),
+			})
+			if err != nil {
+				return err
+			}
+			return catalog.PrintList(os.Stdout, backups)
+		},
+	}
+	addS3Flags(listCmd)
+	listCmd.Flags().StringVarP(&outputDir, "output", "D", "", "Directory with backups, local path or s3://bucket/prefix (required)")
+	if err := listCmd.MarkFlagRequired("output"); err != nil {
+		log.Fatal(err)
+	}
 
-	rootCmd.AddCommand(dumpCmd, restoreCmd)
-	if err := rootCmd.Execute(); err != nil {
+	// inspect
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect <backup>",
+		Short: "Show details of a backup (i.e. ./backups/20250328154501.dmp)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ins, err := catalog.RunInspect(cmd.Context(), &catalog.CatalogContext{
+				Location:       args[0],
+				StorageOptions: storageOptions(),
+			})
+			if err != nil {
+				return err
+			}
+			return catalog.PrintInspection(os.Stdout, ins)
+		},
+	}
+	addS3Flags(inspectCmd)
+
+	// prune
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old backups by retention rules, and stale stages",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			policy := catalog.Policy{
+				KeepLast:    keepLast,
+				KeepDaily:   keepDaily,
+				KeepWeekly:  keepWeekly,
+				KeepMonthly: keepMonthly,
+				MaxAge:      maxAge,
+				StaleAfter:  staleAfter,
+			}
+			if maxTotalSize != "" {
+				size, err := xutil.ParseByteSize(maxTotalSize)
+				if err != nil {
+					return err
+				}
+				policy.MaxTotalSize = size
+			}
+			result, err := catalog.RunPrune(cmd.Context(), &catalog.CatalogContext{
+				Location:       outputDir,
+				StorageOptions: storageOptions(),
+				Policy:         policy,
+				DryRun:         pruneDryRun,
+			})
+			if result != nil {
+				if printErr := catalog.PrintPruneResult(os.Stdout, result); printErr != nil {
+					return printErr
+				}
+			}
+			return err
+		},
+	}
+	addS3Flags(pruneCmd)
+	pruneCmd.Flags().StringVarP(&outputDir, "output", "D", "", "Directory with backups, local path or s3://bucket/prefix (required)")
+	pruneCmd.Flags().IntVar(&keepLast, "keep-last", 0, "Keep the last N backups")
+	pruneCmd.Flags().IntVar(&keepDaily, "keep-daily", 0, "Keep the newest backup of each of the last N days")
+	pruneCmd.Flags().IntVar(&keepWeekly, "keep-weekly", 0, "Keep the newest backup of each of the last N weeks")
+	pruneCmd.Flags().IntVar(&keepMonthly, "keep-monthly", 0, "Keep the newest backup of each of the last N months")
+	pruneCmd.Flags().DurationVar(&maxAge, "max-age", 0, "Remove backups older than this (i.e. 720h), the newest one is always kept")
+	pruneCmd.Flags().StringVar(&maxTotalSize, "max-total-size", "", "Remove older backups once total size of kept ones exceeds this (i.e. 500GiB)")
+	pruneCmd.Flags().DurationVar(&staleAfter, "stale-after", 0, `
+Remove '.dirty' stages and incomplete backups older than this (default 0 - keep them)
+Must be longer than the longest dump, a running dump's stage looks the same
+`)
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Show what would be removed, without removing anything")
+	if err := pruneCmd.MarkFlagRequired("output"); err != nil {
 		log.Fatal(err)
 	}
+
+	// runner
+
+	rootCmd.AddCommand(dumpCmd, restoreCmd, verifyRestoreCmd, preflightCmd, verifyCmd, listCmd, inspectCmd, pruneCmd)
+	os.Exit(run(rootCmd))
+}
+
+// run executes the root command with a context that is cancelled on SIGINT/SIGTERM.
+// Subprocesses are stopped, stages are cleaned up, and a distinct exit code is returned.
+func run(rootCmd *cobra.Command) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := rootCmd.ExecuteContext(ctx)
+	if err != nil {
+		slog.Error("result",
+			slog.String("status", "failed"),
+			slog.String("err", err.Error()),
+		)
+	}
+	// after the error, so it's logged into the run dir too
+	if runLog != nil {
+		runLog.Close()
+	}
+	switch {
+	case err == nil:
+		return 0
+	case ctx.Err() != nil:
+		return xutil.ExitCodeInterrupted
+	default:
+		return 1
+	}
+}
+
+// runWithMetrics runs a dump/restore with metrics, if they're enabled:
+// live gauges are served while it's running, and its results are written to the textfile when it's finished.
+func runWithMetrics(operation string, fn func(m *metrics.Run) error) error {
+	if metricsFile == "" && metricsListen == "" {
+		return fn(nil)
+	}
+	m := metrics.NewRun(operation)
+	stop, err := m.Serve(metricsListen)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	runErr := fn(m)
+	if err := m.WriteTextfile(metricsFile, runErr); err != nil {
+		slog.Warn("metrics", slog.String("err-write-textfile", err.Error()))
+	}
+	return runErr
+}
+
+func addDBFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&includeDBs, "include-db", nil, `
+Process only matching databases (repeatable)
+Exact name, glob pattern (app_*), or regex with 're:' prefix (re:^app_\d+$)
+`)
+	cmd.Flags().StringArrayVar(&excludeDBs, "exclude-db", nil, `
+Skip matching databases (repeatable), takes precedence over --include-db
+Exact name, glob pattern (tmp_*), or regex with 're:' prefix (re:^scratch_)
+`)
+	cmd.Flags().BoolVar(&includePostgres, "include-postgres", false, "Include the 'postgres' database (skipped by default)")
+}
+
+func addJobsFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&maxTotalJobs, "max-total-jobs", 0, `
+Max sum of --jobs of all concurrently processed databases (default: number of CPUs)
+Jobs are assigned proportionally to database sizes, but never more than a database is able to use
+(one per table, and no more than its total table size divided by its largest table)
+`)
+}
+
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, `
+Check connections, binaries and keys, print databases, jobs, paths and command lines (passwords redacted),
+without writing or executing anything
+`)
+}
+
+func addProgressFlag(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&progressEvery, "progress-interval", xutil.DefaultProgressInterval, `
+How often progress (percent, throughput, ETA) is logged, when stderr is not a terminal (0 - disabled)
+On a terminal, progress of running databases is redrawn in place every second
+`)
+}
+
+func addLogFlags(cmd *cobra.Command, logDirUsage string) {
+	cmd.Flags().StringVar(&logDir, "log-dir", "", logDirUsage)
+	cmd.Flags().BoolVar(&streamStderr, "stream-stderr", false, `
+Print stderr of subprocesses to the console as it's written, each line prefixed with [<dbname>]
+It's saved to log files in any case
+`)
+}
+
+func addMetricsFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&metricsFile, "metrics-textfile", "", `
+Write results of the run to a Prometheus textfile-collector file at the end (optional)
+i.e. /var/lib/node_exporter/textfile/pgdump_each_dump.prom
+`)
+	cmd.Flags().StringVar(&metricsListen, "metrics-listen", "", `
+Expose live progress gauges on http://<addr>/metrics while the run is in progress (optional)
+i.e. :9187
+`)
+}
+
+func addChecksumFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&checksumWorkers, "checksum-workers", 0, `
+Number of files hashed concurrently, independently of --parallel-databases (default: number of CPUs)
+`)
+}
+
+func addVerifyKeyFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&verifyKey, "verify-key", "", `
+PEM Ed25519 public key file, the backup must be signed with its private key (optional)
+i.e. created by 'openssl pkey -in signing.pem -pubout -out signing.pub'
+`)
+}
+
+func addRowCountsFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&rowCounts, "row-counts", compare.RowCountsEstimate, `
+How row counts of tables are compared: none, estimate (planner statistics, within 10%), exact (count(*) of every table)
+Exact counts read all the data of both clusters
+`)
+}
+
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&workDir, "work-dir", "", `
+Local directory for temporary files: remote backups are staged/fetched here,
+encrypted dumps are decrypted here before restore (default: system temp dir)
+`)
+	addS3Flags(cmd)
+}
+
+func addS3Flags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "", `
+S3 endpoint, i.e. https://s3.amazonaws.com, http://localhost:9000 (default: $AWS_ENDPOINT_URL)
+Credentials are taken from AWS_*/MINIO_* env vars or ~/.aws/credentials
+`)
+	cmd.Flags().StringVar(&s3Region, "s3-region", "", "S3 region (default: $AWS_REGION)")
+}
+
+func storageOptions() storage.Options {
+	return storage.Options{
+		S3Endpoint: s3Endpoint,
+		S3Region:   s3Region,
+	}
+}
+
+func dbFilter() xutil.DBFilter {
+	return xutil.DBFilter{
+		Include:         includeDBs,
+		Exclude:         excludeDBs,
+		IncludePostgres: includePostgres,
+	}
 }